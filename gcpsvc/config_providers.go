@@ -1,6 +1,8 @@
 package gcpsvc
 
 import (
+	"time"
+
 	"google.golang.org/api/option"
 	"oss.nandlabs.io/golly/managers"
 )
@@ -10,6 +12,13 @@ type Config struct {
 	Options   []option.ClientOption
 	ProjectId string
 	Location  string
+	// UserProject is the project billed for requests to requester-pays buckets.
+	UserProject string
+	// Retry overrides the retry behaviour of clients created from this config.
+	Retry *RetryPolicy
+	// Timeout bounds single-request operations made with this config, and each request of
+	// multi-request operations such as chunked uploads. Zero means no timeout.
+	Timeout time.Duration
 }
 
 // SetProjectId sets the GCP project ID.
@@ -17,6 +26,21 @@ func (c *Config) SetProjectId(projectId string) {
 	c.ProjectId = projectId
 }
 
+// SetUserProject sets the project billed for requests to requester-pays resources.
+func (c *Config) SetUserProject(userProject string) {
+	c.UserProject = userProject
+}
+
+// SetRetryPolicy sets the retry policy of clients created from this config.
+func (c *Config) SetRetryPolicy(policy *RetryPolicy) {
+	c.Retry = policy
+}
+
+// SetTimeout sets the timeout of single-request operations made with this config.
+func (c *Config) SetTimeout(timeout time.Duration) {
+	c.Timeout = timeout
+}
+
 // SetRegion sets the GCP region/location.
 func (c *Config) SetRegion(region string) {
 	c.Location = region
@@ -2,6 +2,7 @@ package gcpsvc
 
 import (
 	"testing"
+	"time"
 
 	"google.golang.org/api/option"
 )
@@ -22,6 +23,31 @@ func TestConfig_SetRegion(t *testing.T) {
 	}
 }
 
+func TestConfig_SetUserProject(t *testing.T) {
+	cfg := &Config{}
+	cfg.SetUserProject("billing-project")
+	if cfg.UserProject != "billing-project" {
+		t.Errorf("expected 'billing-project', got %q", cfg.UserProject)
+	}
+}
+
+func TestConfig_SetRetryPolicy(t *testing.T) {
+	cfg := &Config{}
+	policy := &RetryPolicy{MaxAttempts: 5, Idempotency: RetryAlways}
+	cfg.SetRetryPolicy(policy)
+	if cfg.Retry != policy {
+		t.Error("expected the retry policy to be set")
+	}
+}
+
+func TestConfig_SetTimeout(t *testing.T) {
+	cfg := &Config{}
+	cfg.SetTimeout(30 * time.Second)
+	if cfg.Timeout != 30*time.Second {
+		t.Errorf("expected 30s, got %v", cfg.Timeout)
+	}
+}
+
 func TestConfig_SetAuthCredentialFile(t *testing.T) {
 	cfg := &Config{}
 	opts := cfg.SetAuthCredentialFile(option.ServiceAccount, "/path/to/key.json")
@@ -0,0 +1,36 @@
+package gcpsvc
+
+import "time"
+
+// Idempotency controls which operations a RetryPolicy retries.
+type Idempotency int
+
+const (
+	// RetryIdempotent retries only operations that are idempotent, or made idempotent by
+	// a precondition such as a generation match. This is the client library default.
+	RetryIdempotent Idempotency = iota
+	// RetryAlways retries every operation, including non-idempotent ones.
+	RetryAlways
+	// RetryNever disables retries.
+	RetryNever
+)
+
+// RetryPolicy configures how failed requests are retried. Zero fields keep the client
+// library defaults.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts, including the first one.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between retries.
+	MaxBackoff time.Duration
+	// Multiplier is the factor the delay grows by after each retry.
+	Multiplier float64
+	// MaxDuration bounds the total time spent retrying an operation.
+	MaxDuration time.Duration
+	// Idempotency selects which operations are retried.
+	Idempotency Idempotency
+	// ShouldRetry decides whether an error is transient. When nil, the client library
+	// default is used, which retries 408, 429 and 5xx responses and network errors.
+	ShouldRetry func(err error) bool
+}
@@ -0,0 +1,749 @@
+package gs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+	"oss.nandlabs.io/golly/ioutils"
+	"oss.nandlabs.io/golly/textutils"
+)
+
+// ArchiveFormat identifies the container format used by CreateArchive and ExtractArchive.
+type ArchiveFormat int
+
+const (
+	// ArchiveAuto detects the format from the archive object key extension.
+	ArchiveAuto ArchiveFormat = iota
+	// ArchiveTar is an uncompressed tar archive (.tar).
+	ArchiveTar
+	// ArchiveTarGz is a gzip-compressed tar archive (.tar.gz, .tgz).
+	ArchiveTarGz
+	// ArchiveZip is a zip archive (.zip).
+	ArchiveZip
+)
+
+const (
+	// defaultArchiveConcurrency is the default number of concurrent uploads during extraction.
+	defaultArchiveConcurrency = 4
+	// defaultArchiveBufferSize is the default size up to which tar entries are buffered
+	// in memory so they can be uploaded concurrently.
+	defaultArchiveBufferSize = 8 << 20
+	// archiveReadBlockSize is the size of the ranged reads used to access zip central directories.
+	archiveReadBlockSize = 256 << 10
+	// paxContentType is the PAX record used to carry the object content type in tar archives.
+	paxContentType = "GOLLY.content-type"
+	// paxContentEncoding is the PAX record used to carry the object content encoding in tar
+	// archives, whose entries hold the stored, still encoded bytes of such objects.
+	paxContentEncoding = "GOLLY.content-encoding"
+	// defaultContentType is used when no content type is recorded or can be guessed.
+	defaultContentType = "application/octet-stream"
+)
+
+// ErrUnsafeArchivePath is returned by ExtractArchive for entries that are absolute or
+// would resolve outside the target prefix.
+var ErrUnsafeArchivePath = errors.New("unsafe path in archive")
+
+// ArchiveOptions configures CreateArchive and ExtractArchive. A nil *ArchiveOptions uses the defaults.
+type ArchiveOptions struct {
+	// Format of the archive. Defaults to detection from the archive key extension.
+	Format ArchiveFormat
+	// Concurrency is the number of concurrent uploads during extraction. Default: 4.
+	Concurrency int
+	// BufferSize is the size up to which tar entries are buffered in memory and uploaded
+	// concurrently; larger entries are streamed one at a time. Default: 8 MiB.
+	BufferSize int64
+}
+
+// contentType returns the MIME type of archive objects in this format.
+func (a ArchiveFormat) contentType() string {
+	switch a {
+	case ArchiveTar:
+		return "application/x-tar"
+	case ArchiveTarGz:
+		return "application/gzip"
+	case ArchiveZip:
+		return "application/zip"
+	default:
+		return defaultContentType
+	}
+}
+
+// resolveArchiveFormat returns format, or the format matching the key extension for ArchiveAuto.
+func resolveArchiveFormat(format ArchiveFormat, key string) (ArchiveFormat, error) {
+	if format != ArchiveAuto {
+		return format, nil
+	}
+	lower := strings.ToLower(key)
+	switch {
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return ArchiveTarGz, nil
+	case strings.HasSuffix(lower, ".tar"):
+		return ArchiveTar, nil
+	case strings.HasSuffix(lower, ".zip"):
+		return ArchiveZip, nil
+	}
+	return ArchiveAuto, fmt.Errorf("cannot detect archive format of %q", key)
+}
+
+// CreateArchive streams every object under the src prefix into a single tar, tar.gz or zip
+// object at dst without using local temporary files. Entry names are relative to the src
+// prefix and content types are recorded in the archive. The archive object is only committed
+// if all entries were written successfully.
+func (fs *StorageFS) CreateArchive(ctx context.Context, src, dst *url.URL, options *ArchiveOptions) (err error) {
+	if options == nil {
+		options = &ArchiveOptions{}
+	}
+	srcOpts, err := parseURL(src)
+	if err != nil {
+		return err
+	}
+	dstOpts, err := parseURL(dst)
+	if err != nil {
+		return err
+	}
+	format, err := resolveArchiveFormat(options.Format, dstOpts.Key)
+	if err != nil {
+		return err
+	}
+
+	client, err := getStorageClient(ctx, srcOpts)
+	if err != nil {
+		return err
+	}
+	defer ioutils.CloserFunc(client)
+
+	prefix := srcOpts.Key
+	if prefix != "" && !strings.HasSuffix(prefix, textutils.ForwardSlashStr) {
+		prefix = prefix + textutils.ForwardSlashStr
+	}
+
+	// Cancelling the writer context before Close aborts the upload, so a failed
+	// archive never replaces an existing object.
+	writeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	writer := newObjectWriter(writeCtx, bucketHandle(client, dstOpts).Object(dstOpts.Key), dstOpts)
+	writer.ContentType = format.contentType()
+	aw := newArchiveWriter(format, writer)
+	writerClosed := false
+	defer func() {
+		if err != nil && !writerClosed {
+			cancel()
+			_ = writer.Close()
+		}
+	}()
+
+	count := 0
+	bucket := bucketHandle(client, srcOpts)
+	it := bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, iterErr := it.Next()
+		if iterErr == iterator.Done {
+			break
+		}
+		if iterErr != nil {
+			return iterErr
+		}
+		if attrs.Name == prefix || (srcOpts.Bucket == dstOpts.Bucket && attrs.Name == dstOpts.Key) {
+			continue
+		}
+
+		name := strings.TrimPrefix(attrs.Name, prefix)
+		if strings.HasSuffix(name, textutils.ForwardSlashStr) {
+			err = aw.writeEntry(name, attrs, nil)
+		} else {
+			err = fs.archiveObject(ctx, bucket, aw, name, attrs, format != ArchiveZip)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to archive gs://%s/%s: %w", srcOpts.Bucket, attrs.Name, err)
+		}
+		count++
+	}
+
+	if err = aw.Close(); err != nil {
+		return err
+	}
+	writerClosed = true
+	if err = writer.Close(); err != nil {
+		return err
+	}
+	logger.InfoF("Archived %d objects from gs://%s/%s to gs://%s/%s", count, srcOpts.Bucket, prefix, dstOpts.Bucket, dstOpts.Key)
+	return nil
+}
+
+// archiveObject streams a single object generation into the archive. With compressed, the
+// stored bytes are read without decompressive transcoding, so that their length matches
+// attrs.Size as tar headers require.
+func (fs *StorageFS) archiveObject(ctx context.Context, bucket *storage.BucketHandle, aw archiveWriter, name string, attrs *storage.ObjectAttrs, compressed bool) error {
+	reader, err := bucket.Object(attrs.Name).Generation(attrs.Generation).ReadCompressed(compressed).NewReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer ioutils.CloserFunc(reader)
+	return aw.writeEntry(name, attrs, reader)
+}
+
+// ExtractArchive unpacks the tar, tar.gz or zip object at src into the dst prefix, uploading
+// entries concurrently. Recorded content types are restored, falling back to a guess from the
+// file extension. Entries with absolute paths or paths escaping dst fail with ErrUnsafeArchivePath;
+// entries naming dst itself, such as "./", links and other special tar entries are skipped.
+// Zip entry names are all validated before anything is written. Tar archives are read as a
+// stream, so when extraction fails, including on an unsafe entry, the objects already created
+// by the extraction are deleted again; objects it overwrote keep their new content.
+func (fs *StorageFS) ExtractArchive(ctx context.Context, src, dst *url.URL, options *ArchiveOptions) error {
+	if options == nil {
+		options = &ArchiveOptions{}
+	}
+	srcOpts, err := parseURL(src)
+	if err != nil {
+		return err
+	}
+	dstOpts, err := parseURL(dst)
+	if err != nil {
+		return err
+	}
+	format, err := resolveArchiveFormat(options.Format, srcOpts.Key)
+	if err != nil {
+		return err
+	}
+
+	client, err := getStorageClient(ctx, srcOpts)
+	if err != nil {
+		return err
+	}
+	defer ioutils.CloserFunc(client)
+
+	prefix := dstOpts.Key
+	if prefix != "" && !strings.HasSuffix(prefix, textutils.ForwardSlashStr) {
+		prefix = prefix + textutils.ForwardSlashStr
+	}
+
+	concurrency := options.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultArchiveConcurrency
+	}
+	bufferSize := options.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = defaultArchiveBufferSize
+	}
+
+	up := newArchiveUploader(ctx, bucketHandle(client, dstOpts), prefix, concurrency)
+	obj := bucketHandle(client, srcOpts).Object(srcOpts.Key)
+	if format == ArchiveZip {
+		err = extractZip(up, obj)
+	} else {
+		err = extractTar(up, obj, format == ArchiveTarGz, bufferSize)
+	}
+	if waitErr := up.wait(); err == nil {
+		err = waitErr
+	}
+	if err != nil {
+		up.rollback(ctx)
+		return err
+	}
+	logger.InfoF("Extracted %d entries from gs://%s/%s to gs://%s/%s", up.count, srcOpts.Bucket, srcOpts.Key, dstOpts.Bucket, prefix)
+	return nil
+}
+
+// extractTar reads a tar stream sequentially. Entries up to bufferSize are buffered and
+// uploaded concurrently; larger entries are streamed directly.
+func extractTar(up *archiveUploader, obj *storage.ObjectHandle, gzipped bool, bufferSize int64) error {
+	reader, err := obj.NewReader(up.ctx)
+	if err != nil {
+		return err
+	}
+	defer ioutils.CloserFunc(reader)
+
+	var stream io.Reader = reader
+	if gzipped {
+		gz, gzErr := gzip.NewReader(reader)
+		if gzErr != nil {
+			return gzErr
+		}
+		defer ioutils.CloserFunc(gz)
+		stream = gz
+	}
+
+	tr := tar.NewReader(stream)
+	for {
+		hdr, nextErr := tr.Next()
+		if nextErr == io.EOF {
+			return nil
+		}
+		if nextErr != nil {
+			return nextErr
+		}
+		if up.failed() {
+			return nil
+		}
+
+		if hdr.Typeflag != tar.TypeDir && hdr.Typeflag != tar.TypeReg {
+			logger.WarnF("Skipping unsupported tar entry %q (type %q)", hdr.Name, hdr.Typeflag)
+			continue
+		}
+		key, keyErr := archiveEntryKey(up.prefix, hdr.Name)
+		if keyErr != nil {
+			return keyErr
+		}
+		if key == "" {
+			// Entries such as "./" name the target prefix itself
+			continue
+		}
+
+		if hdr.Typeflag == tar.TypeDir {
+			up.async(key, "", "", func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(nil)), nil
+			})
+			continue
+		}
+		contentType, contentEncoding := hdr.PAXRecords[paxContentType], hdr.PAXRecords[paxContentEncoding]
+		if hdr.Size > bufferSize {
+			if err = up.upload(key, contentType, contentEncoding, tr); err != nil {
+				return err
+			}
+			continue
+		}
+		data, readErr := io.ReadAll(tr)
+		if readErr != nil {
+			return readErr
+		}
+		up.async(key, contentType, contentEncoding, func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(data)), nil
+		})
+	}
+}
+
+// extractZip reads the zip central directory with ranged reads and uploads every entry
+// concurrently, each from its own ranged read of the archive object.
+func extractZip(up *archiveUploader, obj *storage.ObjectHandle) error {
+	attrs, err := obj.Attrs(up.ctx)
+	if err != nil {
+		return err
+	}
+	obj = obj.Generation(attrs.Generation)
+	zr, err := zip.NewReader(&objectReaderAt{ctx: up.ctx, obj: obj}, attrs.Size)
+	if err != nil {
+		return err
+	}
+
+	keys, err := zipEntryKeys(up.prefix, zr.File)
+	if err != nil {
+		return err
+	}
+
+	for i, f := range zr.File {
+		if up.failed() {
+			return nil
+		}
+		key := keys[i]
+		if key == "" {
+			continue
+		}
+		if strings.HasSuffix(key, textutils.ForwardSlashStr) {
+			up.async(key, "", "", func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(nil)), nil
+			})
+			continue
+		}
+		if !f.Mode().IsRegular() {
+			logger.WarnF("Skipping unsupported zip entry %q (mode %v)", f.Name, f.Mode())
+			continue
+		}
+		file := f
+		up.async(key, file.Comment, "", func() (io.ReadCloser, error) {
+			return openZipEntry(up.ctx, obj, file)
+		})
+	}
+	return nil
+}
+
+// zipEntryKeys maps every entry of a zip central directory to its object key, failing on
+// the first unsafe name before any entry is extracted.
+func zipEntryKeys(prefix string, files []*zip.File) ([]string, error) {
+	keys := make([]string, len(files))
+	for i, f := range files {
+		key, err := archiveEntryKey(prefix, f.Name)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = key
+	}
+	return keys, nil
+}
+
+// openZipEntry returns a reader over the decompressed content of a zip entry backed by a
+// single ranged read, verifying the CRC-32 checksum at EOF.
+func openZipEntry(ctx context.Context, obj *storage.ObjectHandle, f *zip.File) (io.ReadCloser, error) {
+	if f.Method != zip.Store && f.Method != zip.Deflate {
+		return nil, fmt.Errorf("unsupported compression method %d for zip entry %q", f.Method, f.Name)
+	}
+	offset, err := f.DataOffset()
+	if err != nil {
+		return nil, err
+	}
+	raw, err := obj.NewRangeReader(ctx, offset, int64(f.CompressedSize64))
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &zipEntryReader{
+		Reader:  raw,
+		closers: []io.Closer{raw},
+		name:    f.Name,
+		want:    f.CRC32,
+		hash:    crc32.NewIEEE(),
+	}
+	if f.Method == zip.Deflate {
+		inflater := flate.NewReader(raw)
+		entry.Reader = inflater
+		entry.closers = []io.Closer{inflater, raw}
+	}
+	return entry, nil
+}
+
+// zipEntryReader closes the underlying readers and verifies the CRC-32 checksum at EOF.
+type zipEntryReader struct {
+	io.Reader
+	closers []io.Closer
+	name    string
+	want    uint32
+	hash    hash.Hash32
+}
+
+// Read reads from the entry, checking the checksum once the content is exhausted.
+func (z *zipEntryReader) Read(p []byte) (int, error) {
+	n, err := z.Reader.Read(p)
+	_, _ = z.hash.Write(p[:n])
+	if err == io.EOF && z.hash.Sum32() != z.want {
+		return n, fmt.Errorf("checksum mismatch for zip entry %q", z.name)
+	}
+	return n, err
+}
+
+// Close closes the underlying readers.
+func (z *zipEntryReader) Close() error {
+	var err error
+	for _, c := range z.closers {
+		if closeErr := c.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// objectReaderAt implements io.ReaderAt over a GCS object with ranged reads, caching the
+// most recently read block so that small sequential reads do not each cost a request.
+type objectReaderAt struct {
+	ctx      context.Context
+	obj      *storage.ObjectHandle
+	mu       sync.Mutex
+	block    []byte
+	blockOff int64
+}
+
+// ReadAt reads len(p) bytes starting at off.
+func (r *objectReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if r.block == nil || pos < r.blockOff || pos >= r.blockOff+int64(len(r.block)) {
+			length := int64(archiveReadBlockSize)
+			if remaining := int64(len(p) - n); remaining > length {
+				length = remaining
+			}
+			reader, err := r.obj.NewRangeReader(r.ctx, pos, length)
+			if err != nil {
+				return n, err
+			}
+			block, err := io.ReadAll(reader)
+			_ = reader.Close()
+			if err != nil {
+				return n, err
+			}
+			if len(block) == 0 {
+				return n, io.EOF
+			}
+			r.block, r.blockOff = block, pos
+		}
+		n += copy(p[n:], r.block[pos-r.blockOff:])
+	}
+	return n, nil
+}
+
+// archiveEntryKey maps an archive entry name to an object key under prefix. It returns an
+// empty key for entries that resolve to the prefix itself and ErrUnsafeArchivePath for
+// absolute names or names escaping the prefix.
+func archiveEntryKey(prefix, name string) (string, error) {
+	name = strings.ReplaceAll(name, `\`, textutils.ForwardSlashStr)
+	if path.IsAbs(name) || (len(name) >= 2 && name[1] == ':') {
+		return "", fmt.Errorf("%w: %q", ErrUnsafeArchivePath, name)
+	}
+	isDir := strings.HasSuffix(name, textutils.ForwardSlashStr)
+	clean := path.Clean(name)
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("%w: %q", ErrUnsafeArchivePath, name)
+	}
+	if clean == "." {
+		return "", nil
+	}
+	if isDir {
+		clean = clean + textutils.ForwardSlashStr
+	}
+	return prefix + clean, nil
+}
+
+// archiveWriter writes objects into an archive stream.
+type archiveWriter interface {
+	// writeEntry adds an entry. content is nil for directory markers.
+	writeEntry(name string, attrs *storage.ObjectAttrs, content io.Reader) error
+	// Close finishes the archive without closing the underlying writer.
+	Close() error
+}
+
+// newArchiveWriter returns an archiveWriter for format writing to w.
+func newArchiveWriter(format ArchiveFormat, w io.Writer) archiveWriter {
+	switch format {
+	case ArchiveZip:
+		return &zipArchiveWriter{zw: zip.NewWriter(w)}
+	case ArchiveTarGz:
+		gz := gzip.NewWriter(w)
+		return &tarArchiveWriter{tw: tar.NewWriter(gz), gz: gz}
+	default:
+		return &tarArchiveWriter{tw: tar.NewWriter(w)}
+	}
+}
+
+// tarArchiveWriter writes tar and tar.gz archives.
+type tarArchiveWriter struct {
+	tw *tar.Writer
+	gz *gzip.Writer
+}
+
+func (t *tarArchiveWriter) writeEntry(name string, attrs *storage.ObjectAttrs, content io.Reader) error {
+	hdr := &tar.Header{
+		Name:    name,
+		ModTime: attrs.Updated,
+		Format:  tar.FormatPAX,
+	}
+	if content == nil {
+		hdr.Typeflag = tar.TypeDir
+		hdr.Mode = 0o755
+		return t.tw.WriteHeader(hdr)
+	}
+	hdr.Typeflag = tar.TypeReg
+	hdr.Mode = 0o644
+	hdr.Size = attrs.Size
+	hdr.PAXRecords = make(map[string]string)
+	if attrs.ContentType != "" {
+		hdr.PAXRecords[paxContentType] = attrs.ContentType
+	}
+	if attrs.ContentEncoding != "" {
+		hdr.PAXRecords[paxContentEncoding] = attrs.ContentEncoding
+	}
+	if err := t.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := io.Copy(t.tw, content)
+	return err
+}
+
+func (t *tarArchiveWriter) Close() error {
+	if err := t.tw.Close(); err != nil {
+		return err
+	}
+	if t.gz != nil {
+		return t.gz.Close()
+	}
+	return nil
+}
+
+// zipArchiveWriter writes zip archives. Content types are stored in the entry comment.
+type zipArchiveWriter struct {
+	zw *zip.Writer
+}
+
+func (z *zipArchiveWriter) writeEntry(name string, attrs *storage.ObjectAttrs, content io.Reader) error {
+	hdr := &zip.FileHeader{
+		Name:     name,
+		Modified: attrs.Updated,
+		Method:   zip.Deflate,
+		Comment:  attrs.ContentType,
+	}
+	if content == nil {
+		hdr.Method = zip.Store
+		hdr.Comment = ""
+		hdr.SetMode(os.ModeDir | 0o755)
+		_, err := z.zw.CreateHeader(hdr)
+		return err
+	}
+	hdr.SetMode(0o644)
+	w, err := z.zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, content)
+	return err
+}
+
+func (z *zipArchiveWriter) Close() error {
+	return z.zw.Close()
+}
+
+// archiveUploader uploads extracted entries with bounded concurrency. The first failure
+// cancels the remaining uploads.
+type archiveUploader struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	bucket *storage.BucketHandle
+	prefix string
+	sem    chan struct{}
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	err    error
+	count  int
+	// created holds the generations of the objects created so far, deleted by rollback.
+	// Objects that existed before the extraction are overwritten and not recorded.
+	created map[string]int64
+}
+
+// newArchiveUploader creates an uploader writing under prefix in bucket.
+func newArchiveUploader(ctx context.Context, bucket *storage.BucketHandle, prefix string, concurrency int) *archiveUploader {
+	ctx, cancel := context.WithCancel(ctx)
+	return &archiveUploader{
+		ctx:     ctx,
+		cancel:  cancel,
+		bucket:  bucket,
+		prefix:  prefix,
+		sem:     make(chan struct{}, concurrency),
+		created: make(map[string]int64),
+	}
+}
+
+// async uploads the content returned by open to key once a concurrency slot is free.
+func (u *archiveUploader) async(key, contentType, contentEncoding string, open func() (io.ReadCloser, error)) {
+	select {
+	case u.sem <- struct{}{}:
+	case <-u.ctx.Done():
+		u.fail(u.ctx.Err())
+		return
+	}
+	u.wg.Add(1)
+	go func() {
+		defer u.wg.Done()
+		defer func() { <-u.sem }()
+		content, err := open()
+		if err == nil {
+			err = u.upload(key, contentType, contentEncoding, content)
+			if closeErr := content.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		if err != nil {
+			u.fail(err)
+		}
+	}()
+}
+
+// upload writes content to key, guessing the content type from the extension if none is given.
+func (u *archiveUploader) upload(key, contentType, contentEncoding string, content io.Reader) error {
+	if contentType == "" {
+		contentType = mime.TypeByExtension(path.Ext(key))
+	}
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+
+	ctx, cancel := context.WithCancel(u.ctx)
+	defer cancel()
+	obj := u.bucket.Object(key)
+	_, err := obj.Attrs(ctx)
+	exists := err == nil
+	if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		return fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+	if !exists {
+		// The precondition makes sure that the object rollback may delete was created here
+		obj = obj.If(storage.Conditions{DoesNotExist: true})
+	}
+	writer := obj.NewWriter(ctx)
+	writer.ContentType = contentType
+	writer.ContentEncoding = contentEncoding
+	if _, err := io.Copy(writer, content); err != nil {
+		cancel()
+		_ = writer.Close()
+		return fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+
+	u.mu.Lock()
+	u.count++
+	if !exists {
+		u.created[key] = writer.Attrs().Generation
+	}
+	u.mu.Unlock()
+	return nil
+}
+
+// rollback deletes the objects created by a failed extraction, each only if it still has
+// the generation written by the extraction. Overwritten objects are left as they are. It
+// is not cancelled with ctx, so that a cancelled extraction is cleaned up too. Failed
+// deletes are logged.
+func (u *archiveUploader) rollback(ctx context.Context) {
+	ctx = context.WithoutCancel(ctx)
+	for key, generation := range u.created {
+		err := u.bucket.Object(key).If(storage.Conditions{GenerationMatch: generation}).Delete(ctx)
+		if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			logger.WarnF("Failed to delete %s after a failed extraction: %v", key, err)
+		}
+	}
+	if len(u.created) > 0 {
+		logger.WarnF("Deleted %d objects created by a failed extraction under %s", len(u.created), u.prefix)
+	}
+}
+
+// fail records the first error and cancels outstanding uploads.
+func (u *archiveUploader) fail(err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.err == nil {
+		u.err = err
+		u.cancel()
+	}
+}
+
+// failed reports whether an upload has failed.
+func (u *archiveUploader) failed() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.err != nil
+}
+
+// wait blocks until all uploads finished and returns the first error.
+func (u *archiveUploader) wait() error {
+	u.wg.Wait()
+	u.cancel()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.err
+}
@@ -0,0 +1,328 @@
+package gs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+	"oss.nandlabs.io/golly-gcp/gcpsvc"
+)
+
+func TestResolveArchiveFormat(t *testing.T) {
+	cases := map[string]ArchiveFormat{
+		"bundle.tar":       ArchiveTar,
+		"bundle.tar.gz":    ArchiveTarGz,
+		"bundle.TGZ":       ArchiveTarGz,
+		"exports/data.zip": ArchiveZip,
+	}
+	for key, want := range cases {
+		got, err := resolveArchiveFormat(ArchiveAuto, key)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", key, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: expected format %d, got %d", key, want, got)
+		}
+	}
+	if _, err := resolveArchiveFormat(ArchiveAuto, "bundle.rar"); err == nil {
+		t.Error("expected error for unknown extension")
+	}
+	if got, _ := resolveArchiveFormat(ArchiveZip, "bundle.bin"); got != ArchiveZip {
+		t.Errorf("expected explicit format to win, got %d", got)
+	}
+}
+
+func TestArchiveEntryKey(t *testing.T) {
+	cases := []struct {
+		name string
+		want string
+	}{
+		{"a.txt", "out/a.txt"},
+		{"dir/b.txt", "out/dir/b.txt"},
+		{"dir/", "out/dir/"},
+		{"./dir/../c.txt", "out/c.txt"},
+		{`win\path\d.txt`, "out/win/path/d.txt"},
+		{".", ""},
+		{"./", ""},
+	}
+	for _, c := range cases {
+		got, err := archiveEntryKey("out/", c.name)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", c.name, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%q: expected %q, got %q", c.name, c.want, got)
+		}
+	}
+}
+
+func TestArchiveEntryKey_Unsafe(t *testing.T) {
+	for _, name := range []string{"../escape.txt", "dir/../../escape.txt", "/etc/passwd", `..\escape.txt`, "C:/windows.txt"} {
+		if _, err := archiveEntryKey("out/", name); !errors.Is(err, ErrUnsafeArchivePath) {
+			t.Errorf("%q: expected ErrUnsafeArchivePath, got %v", name, err)
+		}
+	}
+}
+
+func TestZipEntryKeys(t *testing.T) {
+	files := []*zip.File{{FileHeader: zip.FileHeader{Name: "a.txt"}}, {FileHeader: zip.FileHeader{Name: "dir/"}}}
+	keys, err := zipEntryKeys("out/", files)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(keys) != 2 || keys[0] != "out/a.txt" || keys[1] != "out/dir/" {
+		t.Errorf("unexpected keys %v", keys)
+	}
+
+	files = append(files, &zip.File{FileHeader: zip.FileHeader{Name: "../escape.txt"}})
+	if _, err = zipEntryKeys("out/", files); !errors.Is(err, ErrUnsafeArchivePath) {
+		t.Errorf("expected ErrUnsafeArchivePath for a later unsafe entry, got %v", err)
+	}
+}
+
+func TestTarArchiveWriter_ContentType(t *testing.T) {
+	var buf bytes.Buffer
+	aw := newArchiveWriter(ArchiveTar, &buf)
+	attrs := &storage.ObjectAttrs{Size: 5, ContentType: "text/plain", Updated: time.Now()}
+	if err := aw.writeEntry("dir/", attrs, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := aw.writeEntry("dir/a.txt", attrs, strings.NewReader("hello")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tr := tar.NewReader(&buf)
+	hdr, err := tr.Next()
+	if err != nil || hdr.Typeflag != tar.TypeDir || hdr.Name != "dir/" {
+		t.Fatalf("expected directory entry, got %+v (%v)", hdr, err)
+	}
+	hdr, err = tr.Next()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if hdr.PAXRecords[paxContentType] != "text/plain" {
+		t.Errorf("expected content type record 'text/plain', got %q", hdr.PAXRecords[paxContentType])
+	}
+	if data, _ := io.ReadAll(tr); string(data) != "hello" {
+		t.Errorf("expected 'hello', got %q", data)
+	}
+}
+
+func TestTarArchiveWriter_ContentEncoding(t *testing.T) {
+	var buf bytes.Buffer
+	aw := newArchiveWriter(ArchiveTar, &buf)
+	attrs := &storage.ObjectAttrs{Size: 4, ContentType: "text/plain", ContentEncoding: "gzip", Updated: time.Now()}
+	if err := aw.writeEntry("a.txt", attrs, strings.NewReader("\x1f\x8b..")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	hdr, err := tar.NewReader(&buf).Next()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if hdr.Size != 4 || hdr.PAXRecords[paxContentEncoding] != "gzip" {
+		t.Errorf("expected size 4 and content encoding record 'gzip', got %d, %q", hdr.Size, hdr.PAXRecords[paxContentEncoding])
+	}
+}
+
+func TestZipArchiveWriter_ContentType(t *testing.T) {
+	var buf bytes.Buffer
+	aw := newArchiveWriter(ArchiveZip, &buf)
+	attrs := &storage.ObjectAttrs{Size: 5, ContentType: "application/json", Updated: time.Now()}
+	if err := aw.writeEntry("a.json", attrs, strings.NewReader("{}")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(zr.File) != 1 || zr.File[0].Comment != "application/json" {
+		t.Fatalf("expected one entry with content type comment, got %+v", zr.File)
+	}
+}
+
+func TestZipEntryReader_ChecksumMismatch(t *testing.T) {
+	r := &zipEntryReader{
+		Reader: strings.NewReader("data"),
+		name:   "a.txt",
+		want:   1,
+		hash:   crc32.NewIEEE(),
+	}
+	if _, err := io.ReadAll(r); err == nil {
+		t.Fatal("expected checksum mismatch error")
+	}
+}
+
+// fakeArchiveServer serves the JSON and XML requests of object reads, uploads and deletes
+// from an in-memory bucket.
+type fakeArchiveServer struct {
+	*httptest.Server
+	mu        sync.Mutex
+	objects   map[string][]byte
+	encodings map[string]string
+}
+
+func newFakeArchiveServer(objects map[string][]byte) *fakeArchiveServer {
+	s := &fakeArchiveServer{objects: objects, encodings: make(map[string]string)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+func (s *fakeArchiveServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	const objectsPath = "/storage/v1/b/bucket/o/"
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/upload/storage/v1/b/bucket/o":
+		_, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		mr := multipart.NewReader(r.Body, params["boundary"])
+		part, _ := mr.NextPart()
+		var resource struct{ Name, ContentEncoding string }
+		_ = json.NewDecoder(part).Decode(&resource)
+		part, _ = mr.NextPart()
+		data, _ := io.ReadAll(part)
+		if _, ok := s.objects[resource.Name]; ok && r.URL.Query().Get("ifGenerationMatch") == "0" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		s.objects[resource.Name] = data
+		s.encodings[resource.Name] = resource.ContentEncoding
+		_ = json.NewEncoder(w).Encode(map[string]any{"bucket": "bucket", "name": resource.Name, "generation": "1"})
+	case strings.HasPrefix(r.URL.Path, objectsPath):
+		name := strings.TrimPrefix(r.URL.Path, objectsPath)
+		data, ok := s.objects[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			delete(s.objects, name)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"bucket": "bucket", "name": name, "generation": "1", "size": strconv.Itoa(len(data))})
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/bucket/"):
+		data, ok := s.objects[strings.TrimPrefix(r.URL.Path, "/bucket/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(data)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// extract runs ExtractArchive for the archive object key into the dst prefix.
+func (s *fakeArchiveServer) extract(t *testing.T, key, dst string) error {
+	t.Helper()
+	gcpsvc.Manager.Register("bucket", &gcpsvc.Config{Options: []option.ClientOption{
+		option.WithoutAuthentication(), option.WithEndpoint(s.URL + "/storage/v1/")}})
+	defer gcpsvc.Manager.Unregister("bucket")
+	src, _ := url.Parse("gs://bucket/" + key)
+	dstURL, _ := url.Parse("gs://bucket/" + dst)
+	return NewStorageFS().ExtractArchive(context.Background(), src, dstURL, nil)
+}
+
+// tarArchive returns a tar archive of the given entries; names ending in "/" are directories.
+func tarArchive(t *testing.T, entries ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range entries {
+		hdr := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(name))}
+		if strings.HasSuffix(name, "/") {
+			hdr.Typeflag, hdr.Mode, hdr.Size = tar.TypeDir, 0o755, 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			_, _ = tw.Write([]byte(name))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractArchive_SkipsEntriesNamingThePrefix(t *testing.T) {
+	server := newFakeArchiveServer(map[string][]byte{})
+	defer server.Close()
+	server.objects["in.tar"] = tarArchive(t, "./", ".", "dir/..", "a.txt")
+
+	if err := server.extract(t, "in.tar", "out/"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	delete(server.objects, "in.tar")
+	if len(server.objects) != 1 || string(server.objects["out/a.txt"]) != "a.txt" {
+		t.Errorf("expected only out/a.txt to be extracted, got %v", server.objects)
+	}
+}
+
+func TestExtractArchive_RollbackKeepsExistingObjects(t *testing.T) {
+	server := newFakeArchiveServer(map[string][]byte{"out/a.txt": []byte("old")})
+	defer server.Close()
+	server.objects["in.tar"] = tarArchive(t, "a.txt", "b.txt", "../escape.txt")
+
+	if err := server.extract(t, "in.tar", "out/"); !errors.Is(err, ErrUnsafeArchivePath) {
+		t.Fatalf("expected ErrUnsafeArchivePath, got %v", err)
+	}
+	if _, ok := server.objects["out/b.txt"]; ok {
+		t.Error("expected the created object to be rolled back")
+	}
+	if string(server.objects["out/a.txt"]) != "a.txt" {
+		t.Errorf("expected the overwritten object to be kept, got %q", server.objects["out/a.txt"])
+	}
+}
+
+func TestExtractArchive_RestoresContentEncoding(t *testing.T) {
+	var buf bytes.Buffer
+	aw := newArchiveWriter(ArchiveTar, &buf)
+	attrs := &storage.ObjectAttrs{Size: 4, ContentEncoding: "gzip", Updated: time.Now()}
+	if err := aw.writeEntry("a.txt", attrs, strings.NewReader("data")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	server := newFakeArchiveServer(map[string][]byte{"in.tar": buf.Bytes()})
+	defer server.Close()
+
+	if err := server.extract(t, "in.tar", "out/"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if server.encodings["out/a.txt"] != "gzip" {
+		t.Errorf("expected content encoding 'gzip', got %q", server.encodings["out/a.txt"])
+	}
+}
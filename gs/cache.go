@@ -0,0 +1,313 @@
+package gs
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// cacheFileExt is the extension of files written to the cache directory.
+const cacheFileExt = ".gscache"
+
+// Every cache stores its files in its own subdirectory of CacheOptions.Dir, so that
+// processes and filesystems sharing Dir never delete each other's content. The owner file
+// of a subdirectory records the host and process that created it.
+const (
+	cacheInstancePattern = "instance-*" + cacheFileExt
+	cacheOwnerFile       = "owner"
+)
+
+// CacheOptions configures the local read-through cache of a StorageFS.
+type CacheOptions struct {
+	// Dir is the directory where cached object content is stored. Required.
+	Dir string
+	// MaxBytes bounds the total size of cached content. Least recently used objects
+	// are evicted once it is exceeded and larger objects are never cached.
+	// Zero means unbounded.
+	MaxBytes int64
+	// TTL is how long a cached object is served without revalidation. Once it expires,
+	// the object generation is checked with an Attrs call before the cached copy is
+	// reused. Zero revalidates on every open.
+	TTL time.Duration
+}
+
+// cacheEntry describes one object stored in the cache directory.
+type cacheEntry struct {
+	id          string
+	path        string
+	generation  int64
+	size        int64
+	contentType string
+	validated   time.Time
+}
+
+// objectCache is a disk-backed LRU cache of GCS object content keyed by
+// bucket/key/generation. It is safe for concurrent use.
+type objectCache struct {
+	opts     CacheOptions
+	dir      string
+	mu       sync.Mutex
+	entries  map[string]*list.Element
+	lru      *list.List
+	size     int64
+	inflight map[string]chan struct{}
+}
+
+// newObjectCache creates a subdirectory of the cache directory for this cache and removes
+// the subdirectories of caches whose process has exited, since the index is only kept in
+// memory. Content of live caches, including those of other processes, is left alone.
+func newObjectCache(opts *CacheOptions) (*objectCache, error) {
+	if opts.Dir == "" {
+		return nil, errors.New("cache directory is required")
+	}
+	if opts.MaxBytes < 0 || opts.TTL < 0 {
+		return nil, errors.New("cache MaxBytes and TTL cannot be negative")
+	}
+	if err := os.MkdirAll(opts.Dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	removeStaleCaches(opts.Dir)
+
+	dir, err := os.MkdirTemp(opts.Dir, cacheInstancePattern)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, cacheOwnerFile), []byte(cacheOwner()), 0o600); err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	return &objectCache{
+		opts:     *opts,
+		dir:      dir,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		inflight: make(map[string]chan struct{}),
+	}, nil
+}
+
+// close removes the content of the cache. Readers already open keep working on platforms
+// that allow unlinking open files.
+func (c *objectCache) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	c.size = 0
+	_ = os.RemoveAll(c.dir)
+}
+
+// cacheOwner identifies the current process in the owner file of a cache directory.
+func cacheOwner() string {
+	host, _ := os.Hostname()
+	return host + " " + strconv.Itoa(os.Getpid())
+}
+
+// removeStaleCaches removes the cache subdirectories of dir whose owner is a process of
+// this host that no longer runs. Directories that cannot be proven stale are kept.
+func removeStaleCaches(dir string) {
+	instances, err := filepath.Glob(filepath.Join(dir, cacheInstancePattern))
+	if err != nil {
+		return
+	}
+	host, _ := os.Hostname()
+	for _, instance := range instances {
+		owner, err := os.ReadFile(filepath.Join(instance, cacheOwnerFile))
+		if err != nil {
+			continue
+		}
+		ownerHost, pidStr, ok := strings.Cut(string(owner), " ")
+		if !ok || ownerHost != host {
+			continue
+		}
+		if pid, err := strconv.Atoi(pidStr); err == nil && !processAlive(pid) {
+			_ = os.RemoveAll(instance)
+		}
+	}
+}
+
+// processAlive reports whether a process with the given ID may still be running. It only
+// returns false when the process is known to have exited.
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = process.Signal(syscall.Signal(0))
+	return !errors.Is(err, os.ErrProcessDone) && !errors.Is(err, syscall.ESRCH)
+}
+
+// open returns a reader for the object content with its size and content type, serving it
+// from the cache when the cached generation is still current. The limits of t apply only to
+// the download from GCS, not to reads of cached content.
+func (c *objectCache) open(ctx context.Context, client *storage.Client, opts *urlOpts, t *transfer) (io.ReadCloser, int64, string, error) {
+	id := opts.Bucket + "/" + opts.Key
+	for {
+		c.mu.Lock()
+		if wait, ok := c.inflight[id]; ok {
+			c.mu.Unlock()
+			select {
+			case <-wait:
+				continue
+			case <-ctx.Done():
+				return nil, 0, "", ctx.Err()
+			}
+		}
+
+		var entry *cacheEntry
+		if elem, ok := c.entries[id]; ok {
+			c.lru.MoveToFront(elem)
+			entry = elem.Value.(*cacheEntry)
+			if c.opts.TTL > 0 && time.Since(entry.validated) < c.opts.TTL {
+				file, err := os.Open(entry.path)
+				if err == nil {
+					c.mu.Unlock()
+					return file, entry.size, entry.contentType, nil
+				}
+				c.remove(elem)
+				entry = nil
+			}
+		}
+		done := make(chan struct{})
+		c.inflight[id] = done
+		c.mu.Unlock()
+
+		reader, size, contentType, err := c.fill(ctx, client, opts, entry, t)
+
+		c.mu.Lock()
+		delete(c.inflight, id)
+		close(done)
+		c.mu.Unlock()
+		return reader, size, contentType, err
+	}
+}
+
+// fill revalidates entry against the current object attributes and downloads the
+// object into the cache, within the limits of t, if entry is missing or stale.
+func (c *objectCache) fill(ctx context.Context, client *storage.Client, opts *urlOpts, entry *cacheEntry, t *transfer) (io.ReadCloser, int64, string, error) {
+	id := opts.Bucket + "/" + opts.Key
+	obj := bucketHandle(client, opts).Object(opts.Key)
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	if entry != nil && entry.generation == attrs.Generation {
+		if file, openErr := os.Open(entry.path); openErr == nil {
+			c.mu.Lock()
+			entry.validated = time.Now()
+			c.mu.Unlock()
+			return file, entry.size, entry.contentType, nil
+		}
+	}
+
+	obj = obj.Generation(attrs.Generation)
+	if c.opts.MaxBytes > 0 && attrs.Size > c.opts.MaxBytes {
+		reader, readErr := obj.NewReader(ctx)
+		if readErr != nil {
+			return nil, 0, "", readErr
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{newTransferReader(ctx, reader, t), reader}, attrs.Size, attrs.ContentType, nil
+	}
+
+	tmp, err := os.CreateTemp(c.dir, "download-*.tmp")
+	if err != nil {
+		return nil, 0, "", err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	reader, err := obj.NewReader(ctx)
+	if err != nil {
+		_ = tmp.Close()
+		return nil, 0, "", err
+	}
+	size, err := io.Copy(tmp, newTransferReader(ctx, reader, t))
+	_ = reader.Close()
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	path := c.path(id, attrs.Generation)
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return nil, 0, "", err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	c.mu.Lock()
+	c.insert(&cacheEntry{
+		id:          id,
+		path:        path,
+		generation:  attrs.Generation,
+		size:        size,
+		contentType: attrs.ContentType,
+		validated:   time.Now(),
+	})
+	c.mu.Unlock()
+	return file, size, attrs.ContentType, nil
+}
+
+// invalidate drops any cached content for the given object.
+func (c *objectCache) invalidate(bucket, key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[bucket+"/"+key]; ok {
+		c.remove(elem)
+	}
+}
+
+// path returns the cache file path for an object generation.
+func (c *objectCache) path(id string, generation int64) string {
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+"-"+strconv.FormatInt(generation, 10)+cacheFileExt)
+}
+
+// insert adds entry as the most recently used one, replacing any previous generation
+// and evicting least recently used entries beyond MaxBytes. Must be called with mu held.
+func (c *objectCache) insert(entry *cacheEntry) {
+	if elem, ok := c.entries[entry.id]; ok {
+		if elem.Value.(*cacheEntry).path == entry.path {
+			c.lru.Remove(elem)
+			c.size -= elem.Value.(*cacheEntry).size
+			delete(c.entries, entry.id)
+		} else {
+			c.remove(elem)
+		}
+	}
+	c.entries[entry.id] = c.lru.PushFront(entry)
+	c.size += entry.size
+
+	for c.opts.MaxBytes > 0 && c.size > c.opts.MaxBytes && c.lru.Len() > 1 {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove deletes an entry and its file. Open readers keep working on platforms that
+// allow unlinking open files. Must be called with mu held.
+func (c *objectCache) remove(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	c.lru.Remove(elem)
+	delete(c.entries, entry.id)
+	c.size -= entry.size
+	_ = os.Remove(entry.path)
+}
@@ -0,0 +1,174 @@
+package gs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// addTestEntry writes a cache file of the given size and inserts it into the cache.
+func addTestEntry(t *testing.T, c *objectCache, key string, generation, size int64) *cacheEntry {
+	t.Helper()
+	id := "bucket/" + key
+	entry := &cacheEntry{id: id, path: c.path(id, generation), generation: generation, size: size}
+	if err := os.WriteFile(entry.path, make([]byte, size), 0o600); err != nil {
+		t.Fatalf("failed to write cache file: %v", err)
+	}
+	c.mu.Lock()
+	c.insert(entry)
+	c.mu.Unlock()
+	return entry
+}
+
+func TestNewObjectCache_Validation(t *testing.T) {
+	if _, err := newObjectCache(&CacheOptions{}); err == nil {
+		t.Error("expected error for empty cache directory")
+	}
+	if _, err := newObjectCache(&CacheOptions{Dir: t.TempDir(), MaxBytes: -1}); err == nil {
+		t.Error("expected error for negative MaxBytes")
+	}
+}
+
+// writeTestInstance creates a cache subdirectory owned by the given host and process.
+func writeTestInstance(t *testing.T, dir, name, host string, pid int) string {
+	t.Helper()
+	instance := filepath.Join(dir, "instance-"+name+cacheFileExt)
+	if err := os.MkdirAll(instance, 0o750); err != nil {
+		t.Fatal(err)
+	}
+	owner := host + " " + strconv.Itoa(pid)
+	if err := os.WriteFile(filepath.Join(instance, cacheOwnerFile), []byte(owner), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return instance
+}
+
+func TestNewObjectCache_RemovesStaleInstances(t *testing.T) {
+	dir := t.TempDir()
+	host, _ := os.Hostname()
+	// No process runs with a PID above the Linux PID limit.
+	stale := writeTestInstance(t, dir, "stale", host, 1<<30)
+	live := writeTestInstance(t, dir, "live", host, os.Getpid())
+	remote := writeTestInstance(t, dir, "remote", host+"-other", 1<<30)
+	other := filepath.Join(dir, "keep"+cacheFileExt)
+	_ = os.WriteFile(other, []byte("x"), 0o600)
+
+	c, err := newObjectCache(&CacheOptions{Dir: dir})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Error("expected the cache of an exited process to be removed")
+	}
+	for _, path := range []string{live, remote, other} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("expected %s to be kept", path)
+		}
+	}
+	if filepath.Dir(c.dir) != dir || c.dir == live {
+		t.Errorf("expected a new subdirectory of %s, got %s", dir, c.dir)
+	}
+
+	c.close()
+	if _, err := os.Stat(c.dir); !os.IsNotExist(err) {
+		t.Error("expected close to remove the cache subdirectory")
+	}
+}
+
+func TestObjectCache_LRUEviction(t *testing.T) {
+	c, err := newObjectCache(&CacheOptions{Dir: t.TempDir(), MaxBytes: 10})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	a := addTestEntry(t, c, "a", 1, 4)
+	addTestEntry(t, c, "b", 1, 4)
+
+	// Touch "a" so that "b" becomes the least recently used entry.
+	c.lru.MoveToFront(c.entries[a.id])
+	addTestEntry(t, c, "c", 1, 4)
+
+	if _, ok := c.entries["bucket/b"]; ok {
+		t.Error("expected 'b' to be evicted")
+	}
+	if _, ok := c.entries["bucket/a"]; !ok {
+		t.Error("expected 'a' to be kept")
+	}
+	if c.size != 8 {
+		t.Errorf("expected cache size 8, got %d", c.size)
+	}
+	if _, err := os.Stat(c.path("bucket/b", 1)); !os.IsNotExist(err) {
+		t.Error("expected evicted cache file to be removed")
+	}
+}
+
+func TestObjectCache_NewGenerationReplacesOld(t *testing.T) {
+	c, _ := newObjectCache(&CacheOptions{Dir: t.TempDir()})
+	old := addTestEntry(t, c, "a", 1, 4)
+	addTestEntry(t, c, "a", 2, 6)
+
+	if c.lru.Len() != 1 || c.size != 6 {
+		t.Errorf("expected a single entry of size 6, got %d entries of size %d", c.lru.Len(), c.size)
+	}
+	if _, err := os.Stat(old.path); !os.IsNotExist(err) {
+		t.Error("expected the previous generation to be removed")
+	}
+}
+
+func TestObjectCache_Invalidate(t *testing.T) {
+	c, _ := newObjectCache(&CacheOptions{Dir: t.TempDir()})
+	entry := addTestEntry(t, c, "a", 1, 4)
+	c.invalidate("bucket", "a")
+
+	if c.lru.Len() != 0 || c.size != 0 {
+		t.Errorf("expected empty cache, got %d entries of size %d", c.lru.Len(), c.size)
+	}
+	if _, err := os.Stat(entry.path); !os.IsNotExist(err) {
+		t.Error("expected invalidated cache file to be removed")
+	}
+}
+
+func TestStorageFS_SetCache(t *testing.T) {
+	fs := NewStorageFS()
+	if fs.getCache() != nil {
+		t.Fatal("expected cache to be disabled by default")
+	}
+	if err := fs.SetCache(&CacheOptions{Dir: t.TempDir()}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fs.getCache() == nil {
+		t.Fatal("expected cache to be enabled")
+	}
+	if err := fs.SetCache(nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fs.getCache() != nil {
+		t.Error("expected cache to be disabled")
+	}
+}
+
+func TestStorageFile_ReadCacheHitNotLimited(t *testing.T) {
+	fs := NewStorageFS()
+	if err := fs.SetCache(&CacheOptions{Dir: t.TempDir(), TTL: time.Hour}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	addTestEntry(t, fs.getCache(), "a", 1, 4096).validated = time.Now()
+	fs.SetBandwidthLimit(1)
+
+	var last TransferProgress
+	f := newStorageFile(nil, fs, objectURLOpts("bucket", "a"))
+	f.SetTransferOptions(&TransferOptions{RateLimit: 1, Progress: func(p TransferProgress) { last = p }})
+	start := time.Now()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(data) != 4096 || time.Since(start) > time.Second {
+		t.Errorf("expected the cached content at full speed, got %d bytes in %v", len(data), time.Since(start))
+	}
+	if !last.Done || last.Transferred != 4096 {
+		t.Errorf("expected a final progress report of 4096 bytes, got %+v", last)
+	}
+}
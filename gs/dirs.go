@@ -0,0 +1,329 @@
+package gs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	control "cloud.google.com/go/storage/control/apiv2"
+	"cloud.google.com/go/storage/control/apiv2/controlpb"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"oss.nandlabs.io/golly-gcp/gcpsvc"
+	"oss.nandlabs.io/golly/ioutils"
+	"oss.nandlabs.io/golly/textutils"
+	"oss.nandlabs.io/golly/vfs"
+)
+
+var (
+	// ErrNotDirectory is returned when a path component that must be a directory exists as a file.
+	ErrNotDirectory = errors.New("not a directory")
+	// ErrIsDirectory is returned when a file operation targets a path that exists as a directory.
+	ErrIsDirectory = errors.New("is a directory")
+)
+
+// DirMarkerStrategy selects how Mkdir and MkdirAll represent directories in GCS.
+type DirMarkerStrategy int
+
+const (
+	// DirMarkerObjects writes a zero-byte object with a trailing slash for every created
+	// directory. This is the default.
+	DirMarkerObjects DirMarkerStrategy = iota
+	// DirMarkerNone writes nothing. Directories only exist implicitly while objects are
+	// stored under them, so Mkdir and MkdirAll only validate the path.
+	DirMarkerNone
+	// DirMarkerFolders creates folders through the Storage Control API. It requires a bucket
+	// with hierarchical namespace enabled.
+	DirMarkerFolders
+)
+
+// pathKind is what a key refers to in a bucket.
+type pathKind int
+
+const (
+	pathMissing pathKind = iota
+	pathFile
+	pathDir
+)
+
+// SetDirMarkerStrategy selects how Mkdir and MkdirAll create directories.
+func (fs *StorageFS) SetDirMarkerStrategy(strategy DirMarkerStrategy) {
+	fs.dirMarkers.Store(int32(strategy))
+}
+
+// GetDirMarkerStrategy returns the strategy used by Mkdir and MkdirAll.
+func (fs *StorageFS) GetDirMarkerStrategy() DirMarkerStrategy {
+	return DirMarkerStrategy(fs.dirMarkers.Load())
+}
+
+// Mkdir creates a single directory. Like os.Mkdir, it fails with os.ErrExist if the path
+// already exists as a file or directory, with os.ErrNotExist if the parent directory does
+// not exist and with ErrNotDirectory if the parent is a file. The bucket root always exists.
+func (fs *StorageFS) Mkdir(u *url.URL) (vfs.VFile, error) {
+	opts, err := parseURL(u)
+	if err != nil {
+		return nil, err
+	}
+	key := strings.TrimSuffix(opts.Key, textutils.ForwardSlashStr)
+	if key == "" {
+		return nil, fmt.Errorf("mkdir gs://%s/: %w", opts.Bucket, os.ErrExist)
+	}
+
+	client, err := getStorageClient(context.Background(), opts)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := operationContext(opts)
+	defer cancel()
+
+	d := fs.newDirOps(client, opts)
+	defer d.close()
+	if err = checkMkdir(key, func(key string) (pathKind, error) { return d.kind(ctx, key) }); err != nil {
+		return nil, fmt.Errorf("mkdir gs://%s/%s: %w", opts.Bucket, key, err)
+	}
+	if err = d.create(ctx, []string{key}); err != nil {
+		return nil, err
+	}
+	return newStorageFile(client, fs, dirURLOpts(opts.Bucket, key)), nil
+}
+
+// MkdirAll creates a directory along with any missing parents, like os.MkdirAll. It succeeds
+// without writing anything if the directory already exists and fails with ErrNotDirectory if
+// any path component exists as a file.
+func (fs *StorageFS) MkdirAll(u *url.URL) (vfs.VFile, error) {
+	opts, err := parseURL(u)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := getStorageClient(context.Background(), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	key := strings.TrimSuffix(opts.Key, textutils.ForwardSlashStr)
+	if key != "" {
+		ctx, cancel := operationContext(opts)
+		defer cancel()
+
+		d := fs.newDirOps(client, opts)
+		defer d.close()
+		missing, resolveErr := resolveMkdirAll(key, func(key string) (pathKind, error) { return d.kind(ctx, key) })
+		if resolveErr != nil {
+			return nil, fmt.Errorf("mkdir gs://%s/%s: %w", opts.Bucket, key, resolveErr)
+		}
+		if err = d.create(ctx, missing); err != nil {
+			return nil, err
+		}
+	}
+	return newStorageFile(client, fs, dirURLOpts(opts.Bucket, key)), nil
+}
+
+// checkMkdir validates that key can be created by Mkdir.
+func checkMkdir(key string, kind func(key string) (pathKind, error)) error {
+	k, err := kind(key)
+	if err != nil {
+		return err
+	}
+	if k != pathMissing {
+		return os.ErrExist
+	}
+	parent := parentDirKey(key)
+	if parent == "" {
+		return nil
+	}
+	if k, err = kind(parent); err != nil {
+		return err
+	}
+	switch k {
+	case pathFile:
+		return fmt.Errorf("%s: %w", parent, ErrNotDirectory)
+	case pathMissing:
+		return fmt.Errorf("parent %s: %w", parent, os.ErrNotExist)
+	}
+	return nil
+}
+
+// resolveMkdirAll walks up from key to the closest existing directory and returns the
+// missing directories top-down.
+func resolveMkdirAll(key string, kind func(key string) (pathKind, error)) ([]string, error) {
+	var missing []string
+	for dir := key; dir != ""; dir = parentDirKey(dir) {
+		k, err := kind(dir)
+		if err != nil {
+			return nil, err
+		}
+		if k == pathFile {
+			return nil, fmt.Errorf("%s: %w", dir, ErrNotDirectory)
+		}
+		if k == pathDir {
+			break
+		}
+		missing = append(missing, dir)
+	}
+	for i, j := 0, len(missing)-1; i < j; i, j = i+1, j-1 {
+		missing[i], missing[j] = missing[j], missing[i]
+	}
+	return missing, nil
+}
+
+// parentDirKey returns the parent of a directory key without trailing slash, or "" for
+// a top-level key.
+func parentDirKey(key string) string {
+	idx := strings.LastIndex(key, textutils.ForwardSlashStr)
+	if idx < 0 {
+		return ""
+	}
+	return key[:idx]
+}
+
+// dirURLOpts returns the urlOpts of a directory key without trailing slash.
+func dirURLOpts(bucket, key string) *urlOpts {
+	if key != "" {
+		key += textutils.ForwardSlashStr
+	}
+	return &urlOpts{
+		u: &url.URL{
+			Scheme: GsScheme,
+			Host:   bucket,
+			Path:   "/" + key,
+		},
+		Bucket: bucket,
+		Key:    key,
+	}
+}
+
+// dirOps performs the directory lookups and creations of a single StorageFS call.
+type dirOps struct {
+	opts     *urlOpts
+	bucket   *storage.BucketHandle
+	strategy DirMarkerStrategy
+	control  *control.StorageControlClient
+}
+
+// newDirOps returns the directory operations for the bucket of opts.
+func (fs *StorageFS) newDirOps(client *storage.Client, opts *urlOpts) *dirOps {
+	return &dirOps{
+		opts:     opts,
+		bucket:   bucketHandle(client, opts),
+		strategy: fs.GetDirMarkerStrategy(),
+	}
+}
+
+// close releases the Storage Control client, if one was created.
+func (d *dirOps) close() {
+	if d.control != nil {
+		ioutils.CloserFunc(d.control)
+	}
+}
+
+// controlClient lazily creates a Storage Control client from the gcpsvc config of the URL.
+func (d *dirOps) controlClient() (*control.StorageControlClient, error) {
+	if d.control == nil {
+		var clientOpts []option.ClientOption
+		if cfg := gcpsvc.GetConfig(d.opts.u, GsScheme); cfg != nil {
+			clientOpts = cfg.Options
+		}
+		client, err := control.NewStorageControlClient(context.Background(), clientOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create storage control client: %w", err)
+		}
+		d.control = client
+	}
+	return d.control, nil
+}
+
+// kind reports whether key (without trailing slash) is a file, a directory or missing.
+// A directory exists if any object is stored under it or, with DirMarkerFolders, if a
+// folder with that name exists.
+func (d *dirOps) kind(ctx context.Context, key string) (pathKind, error) {
+	_, err := d.bucket.Object(key).Attrs(ctx)
+	if err == nil {
+		return pathFile, nil
+	}
+	if !errors.Is(err, storage.ErrObjectNotExist) {
+		return pathMissing, err
+	}
+
+	query := &storage.Query{Prefix: key + textutils.ForwardSlashStr}
+	if err = query.SetAttrSelection([]string{"Name"}); err != nil {
+		return pathMissing, err
+	}
+	_, err = d.bucket.Objects(ctx, query).Next()
+	if err == nil {
+		return pathDir, nil
+	}
+	if err != iterator.Done {
+		return pathMissing, err
+	}
+
+	if d.strategy != DirMarkerFolders {
+		return pathMissing, nil
+	}
+	client, err := d.controlClient()
+	if err != nil {
+		return pathMissing, err
+	}
+	_, err = client.GetFolder(ctx, &controlpb.GetFolderRequest{
+		Name: "projects/_/buckets/" + d.opts.Bucket + "/folders/" + key + textutils.ForwardSlashStr,
+	})
+	if err == nil {
+		return pathDir, nil
+	}
+	if status.Code(err) == codes.NotFound {
+		return pathMissing, nil
+	}
+	return pathMissing, err
+}
+
+// create creates the given directories, ordered top-down, using the configured strategy.
+// Directories created concurrently by another caller are not treated as errors.
+func (d *dirOps) create(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	switch d.strategy {
+	case DirMarkerNone:
+		return nil
+	case DirMarkerFolders:
+		client, err := d.controlClient()
+		if err != nil {
+			return err
+		}
+		deepest := keys[len(keys)-1]
+		_, err = client.CreateFolder(ctx, &controlpb.CreateFolderRequest{
+			Parent:    "projects/_/buckets/" + d.opts.Bucket,
+			FolderId:  deepest + textutils.ForwardSlashStr,
+			Recursive: true,
+		})
+		if err != nil && status.Code(err) != codes.AlreadyExists {
+			return fmt.Errorf("failed to create folder gs://%s/%s/: %w", d.opts.Bucket, deepest, err)
+		}
+		return nil
+	}
+
+	for _, key := range keys {
+		writer := d.bucket.Object(key + textutils.ForwardSlashStr).If(storage.Conditions{DoesNotExist: true}).NewWriter(ctx)
+		if err := writer.Close(); err != nil && !isPreconditionFailed(err) {
+			return fmt.Errorf("failed to create directory marker gs://%s/%s/: %w", d.opts.Bucket, key, err)
+		}
+	}
+	return nil
+}
+
+// isPreconditionFailed reports whether err is a failed request precondition.
+func isPreconditionFailed(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == http.StatusPreconditionFailed
+	}
+	return status.Code(err) == codes.FailedPrecondition
+}
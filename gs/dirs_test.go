@@ -0,0 +1,112 @@
+package gs
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// fakeKinds returns a kind lookup backed by a map; unknown keys are missing.
+func fakeKinds(kinds map[string]pathKind) func(key string) (pathKind, error) {
+	return func(key string) (pathKind, error) {
+		return kinds[key], nil
+	}
+}
+
+func TestParentDirKey(t *testing.T) {
+	tests := map[string]string{
+		"a":     "",
+		"a/b":   "a",
+		"a/b/c": "a/b",
+	}
+	for key, want := range tests {
+		if got := parentDirKey(key); got != want {
+			t.Errorf("parentDirKey(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestDirURLOpts(t *testing.T) {
+	opts := dirURLOpts("bucket", "a/b")
+	if opts.Key != "a/b/" || opts.u.String() != "gs://bucket/a/b/" {
+		t.Errorf("unexpected opts %q %q", opts.Key, opts.u.String())
+	}
+	root := dirURLOpts("bucket", "")
+	if root.Key != "" || root.u.String() != "gs://bucket/" {
+		t.Errorf("unexpected root opts %q %q", root.Key, root.u.String())
+	}
+}
+
+func TestCheckMkdir(t *testing.T) {
+	kinds := fakeKinds(map[string]pathKind{
+		"dir":      pathDir,
+		"file":     pathFile,
+		"dir/file": pathFile,
+	})
+	tests := []struct {
+		key  string
+		want error
+	}{
+		{"new", nil},
+		{"dir/new", nil},
+		{"dir", os.ErrExist},
+		{"file", os.ErrExist},
+		{"dir/file", os.ErrExist},
+		{"missing/new", os.ErrNotExist},
+		{"file/new", ErrNotDirectory},
+	}
+	for _, tt := range tests {
+		err := checkMkdir(tt.key, kinds)
+		if tt.want == nil && err != nil {
+			t.Errorf("checkMkdir(%q) = %v, want nil", tt.key, err)
+		}
+		if tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("checkMkdir(%q) = %v, want %v", tt.key, err, tt.want)
+		}
+	}
+}
+
+func TestResolveMkdirAll(t *testing.T) {
+	kinds := fakeKinds(map[string]pathKind{
+		"a":      pathDir,
+		"a/b":    pathDir,
+		"a/file": pathFile,
+	})
+
+	missing, err := resolveMkdirAll("a/b/c/d", kinds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a/b/c", "a/b/c/d"}; !reflect.DeepEqual(missing, want) {
+		t.Errorf("missing = %v, want %v", missing, want)
+	}
+
+	missing, err = resolveMkdirAll("a/b", kinds)
+	if err != nil || len(missing) != 0 {
+		t.Errorf("expected nothing to create for an existing directory, got %v, %v", missing, err)
+	}
+
+	missing, err = resolveMkdirAll("x/y", kinds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"x", "x/y"}; !reflect.DeepEqual(missing, want) {
+		t.Errorf("missing = %v, want %v", missing, want)
+	}
+
+	if _, err = resolveMkdirAll("a/file/c", kinds); !errors.Is(err, ErrNotDirectory) {
+		t.Errorf("expected ErrNotDirectory, got %v", err)
+	}
+}
+
+func TestDirMarkerStrategy(t *testing.T) {
+	fs := NewStorageFS()
+	if fs.GetDirMarkerStrategy() != DirMarkerObjects {
+		t.Error("expected marker objects by default")
+	}
+	fs.SetDirMarkerStrategy(DirMarkerFolders)
+	if fs.GetDirMarkerStrategy() != DirMarkerFolders {
+		t.Error("expected folders")
+	}
+}
@@ -0,0 +1,245 @@
+package gs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+
+	"cloud.google.com/go/iam"
+	"cloud.google.com/go/iam/apiv1/iampb"
+	"cloud.google.com/go/storage"
+	"google.golang.org/genproto/googleapis/type/expr"
+	"oss.nandlabs.io/golly/ioutils"
+)
+
+// GetBucketPolicy returns the IAM policy of the bucket in the given URL. The policy is
+// requested at version 3 so that conditional bindings are included.
+func (fs *StorageFS) GetBucketPolicy(ctx context.Context, u *url.URL) (*iam.Policy3, error) {
+	opts, err := parseURL(u)
+	if err != nil {
+		return nil, err
+	}
+	client, err := getStorageClient(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer ioutils.CloserFunc(client)
+
+	policy, err := bucketHandle(client, opts).IAM().V3().Policy(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get bucket IAM policy: %w", err)
+	}
+	return policy, nil
+}
+
+// SetBucketPolicy replaces the IAM policy of the bucket in the given URL. If policy was
+// obtained from GetBucketPolicy, the update only succeeds if the policy has not changed
+// since it was read.
+func (fs *StorageFS) SetBucketPolicy(ctx context.Context, u *url.URL, policy *iam.Policy3) error {
+	if policy == nil {
+		return errors.New("IAM policy cannot be nil")
+	}
+	opts, err := parseURL(u)
+	if err != nil {
+		return err
+	}
+	client, err := getStorageClient(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer ioutils.CloserFunc(client)
+
+	if err = bucketHandle(client, opts).IAM().V3().SetPolicy(ctx, policy); err != nil {
+		return fmt.Errorf("failed to set bucket IAM policy: %w", err)
+	}
+	return nil
+}
+
+// GrantRole grants role to the given members on the bucket in the given URL. If the URL has
+// a key, the binding is conditioned on the object name starting with that key, limiting the
+// grant to objects under the prefix. Prefix conditions require uniform bucket-level access
+// and do not apply to bucket-level permissions such as storage.objects.list.
+//
+// Members use the IAM format, e.g. "user:jane@example.com" or "serviceAccount:sa@p.iam.gserviceaccount.com".
+func (fs *StorageFS) GrantRole(ctx context.Context, u *url.URL, role string, members ...string) error {
+	if role == "" || len(members) == 0 {
+		return errors.New("role and at least one member are required")
+	}
+	return fs.updateBucketPolicy(ctx, u, func(policy *iam.Policy3, condition *expr.Expr) bool {
+		return addBinding(policy, role, members, condition)
+	})
+}
+
+// RevokeRole removes the given members from the bindings of role on the bucket in the given
+// URL. If the URL has a key, only the binding conditioned on that prefix is changed, as
+// created by GrantRole. Bindings left without members are removed.
+func (fs *StorageFS) RevokeRole(ctx context.Context, u *url.URL, role string, members ...string) error {
+	if role == "" || len(members) == 0 {
+		return errors.New("role and at least one member are required")
+	}
+	return fs.updateBucketPolicy(ctx, u, func(policy *iam.Policy3, condition *expr.Expr) bool {
+		return removeBinding(policy, role, members, condition)
+	})
+}
+
+// updateBucketPolicy reads the bucket policy, applies update and writes the policy back if
+// update reports a change. The write is guarded by the policy etag.
+func (fs *StorageFS) updateBucketPolicy(ctx context.Context, u *url.URL, update func(policy *iam.Policy3, condition *expr.Expr) bool) error {
+	opts, err := parseURL(u)
+	if err != nil {
+		return err
+	}
+	client, err := getStorageClient(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer ioutils.CloserFunc(client)
+
+	var condition *expr.Expr
+	if opts.Key != "" {
+		condition = PrefixCondition(opts.Bucket, opts.Key)
+	}
+	handle := bucketHandle(client, opts).IAM().V3()
+	policy, err := handle.Policy(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get bucket IAM policy: %w", err)
+	}
+	if !update(policy, condition) {
+		return nil
+	}
+	if err = handle.SetPolicy(ctx, policy); err != nil {
+		return fmt.Errorf("failed to set bucket IAM policy: %w", err)
+	}
+	logger.InfoF("Updated IAM policy of gs://%s/%s", opts.Bucket, opts.Key)
+	return nil
+}
+
+// TestPermissions returns the subset of the given IAM permissions (e.g. "storage.objects.get")
+// that the caller holds on the bucket in the given URL.
+func (fs *StorageFS) TestPermissions(ctx context.Context, u *url.URL, permissions []string) ([]string, error) {
+	opts, err := parseURL(u)
+	if err != nil {
+		return nil, err
+	}
+	client, err := getStorageClient(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer ioutils.CloserFunc(client)
+
+	granted, err := bucketHandle(client, opts).IAM().V3().TestPermissions(ctx, permissions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to test bucket permissions: %w", err)
+	}
+	return granted, nil
+}
+
+// PrefixCondition returns an IAM condition that matches objects in bucket whose name starts
+// with prefix.
+func PrefixCondition(bucket, prefix string) *expr.Expr {
+	resource := "projects/_/buckets/" + bucket + "/objects/" + prefix
+	return &expr.Expr{
+		Title:      "gs://" + bucket + "/" + prefix,
+		Expression: "resource.name.startsWith(" + strconv.Quote(resource) + ")",
+	}
+}
+
+// sameCondition reports whether two binding conditions are equivalent.
+func sameCondition(a, b *expr.Expr) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.GetExpression() == b.GetExpression()
+}
+
+// addBinding adds members to the binding of role with the given condition, creating the
+// binding if needed. It reports whether the policy changed.
+func addBinding(policy *iam.Policy3, role string, members []string, condition *expr.Expr) bool {
+	for _, binding := range policy.Bindings {
+		if binding.Role != role || !sameCondition(binding.Condition, condition) {
+			continue
+		}
+		changed := false
+		for _, member := range members {
+			if !slices.Contains(binding.Members, member) {
+				binding.Members = append(binding.Members, member)
+				changed = true
+			}
+		}
+		return changed
+	}
+	policy.Bindings = append(policy.Bindings, &iampb.Binding{
+		Role:      role,
+		Members:   slices.Clone(members),
+		Condition: condition,
+	})
+	return true
+}
+
+// removeBinding removes members from the binding of role with the given condition and drops
+// the binding once it has no members left. It reports whether the policy changed.
+func removeBinding(policy *iam.Policy3, role string, members []string, condition *expr.Expr) bool {
+	changed := false
+	bindings := policy.Bindings[:0]
+	for _, binding := range policy.Bindings {
+		if binding.Role == role && sameCondition(binding.Condition, condition) {
+			n := len(binding.Members)
+			binding.Members = slices.DeleteFunc(binding.Members, func(member string) bool {
+				return slices.Contains(members, member)
+			})
+			changed = changed || len(binding.Members) != n
+			if len(binding.Members) == 0 {
+				continue
+			}
+		}
+		bindings = append(bindings, binding)
+	}
+	policy.Bindings = bindings
+	return changed
+}
+
+// ACL returns the access control list of this object. Object ACLs only apply to buckets
+// with fine-grained access control.
+func (f *StorageFile) ACL() ([]storage.ACLRule, error) {
+	if err := f.checkObject(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := operationContext(f.urlOpts)
+	defer cancel()
+	rules, err := bucketHandle(f.client, f.urlOpts).Object(f.urlOpts.Key).ACL().List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list object ACL: %w", err)
+	}
+	return rules, nil
+}
+
+// SetACL grants role to entity (e.g. storage.AllUsers or "user-jane@example.com") on this object.
+func (f *StorageFile) SetACL(entity storage.ACLEntity, role storage.ACLRole) error {
+	if err := f.checkObject(); err != nil {
+		return err
+	}
+	ctx, cancel := operationContext(f.urlOpts)
+	defer cancel()
+	err := bucketHandle(f.client, f.urlOpts).Object(f.urlOpts.Key).ACL().Set(ctx, entity, role)
+	if err != nil {
+		return fmt.Errorf("failed to set object ACL: %w", err)
+	}
+	return nil
+}
+
+// DeleteACL removes the ACL entry of entity from this object.
+func (f *StorageFile) DeleteACL(entity storage.ACLEntity) error {
+	if err := f.checkObject(); err != nil {
+		return err
+	}
+	ctx, cancel := operationContext(f.urlOpts)
+	defer cancel()
+	err := bucketHandle(f.client, f.urlOpts).Object(f.urlOpts.Key).ACL().Delete(ctx, entity)
+	if err != nil {
+		return fmt.Errorf("failed to delete object ACL: %w", err)
+	}
+	return nil
+}
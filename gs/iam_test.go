@@ -0,0 +1,71 @@
+package gs
+
+import (
+	"testing"
+
+	"cloud.google.com/go/iam"
+	"cloud.google.com/go/iam/apiv1/iampb"
+)
+
+func TestPrefixCondition(t *testing.T) {
+	cond := PrefixCondition("my-bucket", "partners/acme/")
+	want := `resource.name.startsWith("projects/_/buckets/my-bucket/objects/partners/acme/")`
+	if cond.Expression != want {
+		t.Errorf("Expression = %q, want %q", cond.Expression, want)
+	}
+	if cond.Title != "gs://my-bucket/partners/acme/" {
+		t.Errorf("Title = %q", cond.Title)
+	}
+}
+
+func TestAddBinding(t *testing.T) {
+	policy := &iam.Policy3{}
+	cond := PrefixCondition("b", "p/")
+
+	if !addBinding(policy, "roles/storage.objectViewer", []string{"user:a@x.com"}, cond) {
+		t.Fatal("expected a change for a new binding")
+	}
+	if !addBinding(policy, "roles/storage.objectViewer", []string{"user:a@x.com"}, nil) {
+		t.Fatal("expected an unconditional binding to be separate from the conditional one")
+	}
+	if len(policy.Bindings) != 2 {
+		t.Fatalf("expected 2 bindings, got %d", len(policy.Bindings))
+	}
+	if addBinding(policy, "roles/storage.objectViewer", []string{"user:a@x.com"}, PrefixCondition("b", "p/")) {
+		t.Error("expected no change for an existing member")
+	}
+	if !addBinding(policy, "roles/storage.objectViewer", []string{"user:a@x.com", "user:b@x.com"}, cond) {
+		t.Error("expected a change for a new member")
+	}
+	if got := policy.Bindings[0].Members; len(got) != 2 || got[1] != "user:b@x.com" {
+		t.Errorf("unexpected members %v", got)
+	}
+}
+
+func TestRemoveBinding(t *testing.T) {
+	cond := PrefixCondition("b", "p/")
+	policy := &iam.Policy3{Bindings: []*iampb.Binding{
+		{Role: "roles/storage.objectViewer", Members: []string{"user:a@x.com", "user:b@x.com"}, Condition: cond},
+		{Role: "roles/storage.objectViewer", Members: []string{"user:a@x.com"}},
+		{Role: "roles/storage.admin", Members: []string{"user:a@x.com"}},
+	}}
+
+	if removeBinding(policy, "roles/storage.objectViewer", []string{"user:c@x.com"}, cond) {
+		t.Error("expected no change for an unknown member")
+	}
+	if !removeBinding(policy, "roles/storage.objectViewer", []string{"user:a@x.com"}, cond) {
+		t.Fatal("expected a change")
+	}
+	if got := policy.Bindings[0].Members; len(got) != 1 || got[0] != "user:b@x.com" {
+		t.Errorf("unexpected members %v", got)
+	}
+	if !removeBinding(policy, "roles/storage.objectViewer", []string{"user:a@x.com"}, nil) {
+		t.Fatal("expected a change")
+	}
+	if len(policy.Bindings) != 2 {
+		t.Fatalf("expected the empty binding to be dropped, got %d bindings", len(policy.Bindings))
+	}
+	if policy.Bindings[1].Role != "roles/storage.admin" {
+		t.Errorf("unexpected binding %v", policy.Bindings[1])
+	}
+}
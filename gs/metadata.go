@@ -0,0 +1,357 @@
+package gs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	raw "google.golang.org/api/storage/v1"
+	"oss.nandlabs.io/golly-gcp/gcpsvc"
+	"oss.nandlabs.io/golly/ioutils"
+	"oss.nandlabs.io/golly/textutils"
+)
+
+// defaultMetadataConcurrency is the default number of concurrent updates in UpdateMetadata.
+const defaultMetadataConcurrency = 16
+
+// MetadataUpdate describes a change to the metadata of an object. Empty header fields are
+// left unchanged.
+type MetadataUpdate struct {
+	// Set adds or replaces custom metadata keys.
+	Set map[string]string
+	// Remove deletes custom metadata keys.
+	Remove []string
+	// ContentType replaces the Content-Type header.
+	ContentType string
+	// CacheControl replaces the Cache-Control header.
+	CacheControl string
+	// ContentDisposition replaces the Content-Disposition header.
+	ContentDisposition string
+	// ContentEncoding replaces the Content-Encoding header.
+	ContentEncoding string
+	// ContentLanguage replaces the Content-Language header.
+	ContentLanguage string
+	// MetagenerationMatch applies the update only if the object metageneration matches.
+	// Zero means no precondition. Ignored by the prefix-wide StorageFS.UpdateMetadata,
+	// which conditions every update on the metageneration seen while listing.
+	MetagenerationMatch int64
+}
+
+// BatchMetadataOptions configures a prefix-wide UpdateMetadata. A nil *BatchMetadataOptions
+// updates every object under the prefix.
+type BatchMetadataOptions struct {
+	// Filter is an optional predicate; only objects for which it returns true are updated.
+	Filter func(attrs *storage.ObjectAttrs) bool
+	// Concurrency is the number of concurrent updates. Default: 16.
+	Concurrency int
+	// Progress is called after every selected object has been processed. It may be
+	// called from multiple goroutines.
+	Progress func(progress *MetadataProgress)
+}
+
+// MetadataProgress reports the outcome for a single object of a prefix-wide UpdateMetadata.
+type MetadataProgress struct {
+	// Name is the object key.
+	Name string
+	// Unchanged is true if the object already had the requested metadata and was skipped.
+	Unchanged bool
+	// Err is the update error, if the update failed.
+	Err error
+}
+
+// MetadataReport summarises a prefix-wide UpdateMetadata run.
+type MetadataReport struct {
+	// Selected is the number of objects matching the filter.
+	Selected int64
+	// Updated is the number of objects whose metadata was changed.
+	Updated int64
+	// Unchanged is the number of objects that already had the requested metadata.
+	Unchanged int64
+	// Failed maps object keys to their update errors. An object modified between listing
+	// and update fails with a precondition error.
+	Failed map[string]error
+}
+
+// UpdateMetadata applies update to this object in a single patch request.
+func (f *StorageFile) UpdateMetadata(update *MetadataUpdate) error {
+	if err := f.checkObject(); err != nil {
+		return err
+	}
+	if update == nil || update.empty() {
+		return nil
+	}
+	ctx, cancel := operationContext(f.urlOpts)
+	defer cancel()
+	svc, err := f.fs.rawService(f.urlOpts)
+	if err != nil {
+		return err
+	}
+	if err = patchMetadata(ctx, svc, f.urlOpts, f.urlOpts.Key, update, update.MetagenerationMatch); err != nil {
+		return err
+	}
+	if cache := f.fs.getCache(); cache != nil {
+		cache.invalidate(f.urlOpts.Bucket, f.urlOpts.Key)
+	}
+	return nil
+}
+
+// SetProperties adds or replaces several custom metadata keys at once. The update is
+// conditioned on the metageneration read before it, so it fails instead of overwriting
+// a concurrent metadata change.
+func (f *StorageFile) SetProperties(props map[string]string) error {
+	if err := f.checkObject(); err != nil {
+		return err
+	}
+	if len(props) == 0 {
+		return nil
+	}
+	return f.updateMetadataIfUnchanged(&MetadataUpdate{Set: props})
+}
+
+// RemoveProperty deletes a custom metadata key from the object. Removing a key that is not
+// set is not an error. The update is conditioned on the metageneration read before it.
+func (f *StorageFile) RemoveProperty(name string) error {
+	if err := f.checkObject(); err != nil {
+		return err
+	}
+	return f.updateMetadataIfUnchanged(&MetadataUpdate{Remove: []string{name}})
+}
+
+// updateMetadataIfUnchanged applies update conditioned on the current metageneration,
+// skipping the patch if the object already matches.
+func (f *StorageFile) updateMetadataIfUnchanged(update *MetadataUpdate) error {
+	ctx, cancel := operationContext(f.urlOpts)
+	defer cancel()
+	attrs, err := bucketHandle(f.client, f.urlOpts).Object(f.urlOpts.Key).Attrs(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get object metadata: %w", err)
+	}
+	if !update.changes(attrs) {
+		return nil
+	}
+	svc, err := f.fs.rawService(f.urlOpts)
+	if err != nil {
+		return err
+	}
+	if err = patchMetadata(ctx, svc, f.urlOpts, f.urlOpts.Key, update, attrs.Metageneration); err != nil {
+		return err
+	}
+	if cache := f.fs.getCache(); cache != nil {
+		cache.invalidate(f.urlOpts.Bucket, f.urlOpts.Key)
+	}
+	return nil
+}
+
+// UpdateMetadata applies update to every object under the given prefix that matches the
+// filter in options, patching objects concurrently. Each patch is conditioned on the
+// metageneration seen while listing, and objects that already match are skipped.
+// Directory markers are skipped.
+//
+// The returned report is non-nil whenever listing succeeded. If any update failed, the
+// failures are recorded in MetadataReport.Failed and an error is returned as well.
+func (fs *StorageFS) UpdateMetadata(ctx context.Context, u *url.URL, update *MetadataUpdate, options *BatchMetadataOptions) (*MetadataReport, error) {
+	if update == nil || update.empty() {
+		return nil, errors.New("metadata update cannot be empty")
+	}
+	if options == nil {
+		options = &BatchMetadataOptions{}
+	}
+	opts, err := parseURL(u)
+	if err != nil {
+		return nil, err
+	}
+	client, err := getStorageClient(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer ioutils.CloserFunc(client)
+	svc, err := fs.rawService(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := opts.Key
+	if prefix != "" && !strings.HasSuffix(prefix, textutils.ForwardSlashStr) {
+		prefix = prefix + textutils.ForwardSlashStr
+	}
+	concurrency := options.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultMetadataConcurrency
+	}
+
+	report := &MetadataReport{Failed: make(map[string]error)}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	cache := fs.getCache()
+
+	it := bucketHandle(client, opts).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, iterErr := it.Next()
+		if iterErr == iterator.Done {
+			break
+		}
+		if iterErr != nil {
+			err = iterErr
+			break
+		}
+		if strings.HasSuffix(attrs.Name, textutils.ForwardSlashStr) {
+			continue
+		}
+		if options.Filter != nil && !options.Filter(attrs) {
+			continue
+		}
+
+		mu.Lock()
+		report.Selected++
+		mu.Unlock()
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(attrs *storage.ObjectAttrs) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			progress := &MetadataProgress{Name: attrs.Name, Unchanged: !update.changes(attrs)}
+			if !progress.Unchanged {
+				progress.Err = patchMetadata(ctx, svc, opts, attrs.Name, update, attrs.Metageneration)
+				if progress.Err == nil && cache != nil {
+					cache.invalidate(opts.Bucket, attrs.Name)
+				}
+			}
+
+			mu.Lock()
+			switch {
+			case progress.Err != nil:
+				report.Failed[attrs.Name] = progress.Err
+			case progress.Unchanged:
+				report.Unchanged++
+			default:
+				report.Updated++
+			}
+			mu.Unlock()
+
+			if options.Progress != nil {
+				options.Progress(progress)
+			}
+		}(attrs)
+	}
+	wg.Wait()
+
+	if err != nil {
+		return nil, err
+	}
+	if len(report.Failed) > 0 {
+		return report, fmt.Errorf("%d of %d metadata updates under gs://%s/%s failed", len(report.Failed), report.Selected, opts.Bucket, prefix)
+	}
+	logger.InfoF("Updated metadata of %d objects under gs://%s/%s (%d unchanged)", report.Updated, opts.Bucket, prefix, report.Unchanged)
+	return report, nil
+}
+
+// empty reports whether the update changes nothing.
+func (m *MetadataUpdate) empty() bool {
+	return len(m.Set) == 0 && len(m.Remove) == 0 && m.ContentType == "" && m.CacheControl == "" &&
+		m.ContentDisposition == "" && m.ContentEncoding == "" && m.ContentLanguage == ""
+}
+
+// changes reports whether applying the update to an object with attrs would modify it.
+func (m *MetadataUpdate) changes(attrs *storage.ObjectAttrs) bool {
+	for k, v := range m.Set {
+		if current, ok := attrs.Metadata[k]; !ok || current != v {
+			return true
+		}
+	}
+	for _, k := range m.Remove {
+		if _, ok := attrs.Metadata[k]; ok {
+			return true
+		}
+	}
+	headers := [][2]string{
+		{m.ContentType, attrs.ContentType},
+		{m.CacheControl, attrs.CacheControl},
+		{m.ContentDisposition, attrs.ContentDisposition},
+		{m.ContentEncoding, attrs.ContentEncoding},
+		{m.ContentLanguage, attrs.ContentLanguage},
+	}
+	for _, h := range headers {
+		if h[0] != "" && h[0] != h[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// rawObject returns the JSON API patch body of the update. Removed keys are sent as null,
+// which the storage client has no way to express.
+func (m *MetadataUpdate) rawObject() *raw.Object {
+	obj := &raw.Object{
+		ContentType:        m.ContentType,
+		CacheControl:       m.CacheControl,
+		ContentDisposition: m.ContentDisposition,
+		ContentEncoding:    m.ContentEncoding,
+		ContentLanguage:    m.ContentLanguage,
+	}
+	if len(m.Set) > 0 || len(m.Remove) > 0 {
+		obj.Metadata = make(map[string]string, len(m.Set))
+		for k, v := range m.Set {
+			obj.Metadata[k] = v
+		}
+		obj.ForceSendFields = []string{"Metadata"}
+		for _, k := range m.Remove {
+			obj.NullFields = append(obj.NullFields, "Metadata."+k)
+		}
+	}
+	return obj
+}
+
+// patchMetadata applies update to the object key in the bucket of opts, conditioned on
+// metageneration unless it is zero. Transient failures are retried under the retry policy
+// in effect for opts; a conditioned patch counts as idempotent.
+func patchMetadata(ctx context.Context, svc *raw.Service, opts *urlOpts, key string, update *MetadataUpdate, metageneration int64) error {
+	call := svc.Objects.Patch(opts.Bucket, key, update.rawObject()).Context(ctx)
+	if metageneration != 0 {
+		call = call.IfMetagenerationMatch(metageneration)
+	}
+	if userProject := resolveUserProject(opts); userProject != "" {
+		call = call.UserProject(userProject)
+	}
+	err := retryCall(ctx, retryPolicy(ctx, opts), metageneration != 0, func() error {
+		_, err := call.Do()
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update metadata of gs://%s/%s: %w", opts.Bucket, key, err)
+	}
+	return nil
+}
+
+// rawService returns a JSON API client using the gcpsvc config resolved for opts, for
+// requests the storage client cannot express. A client is created once per config and
+// reused by later requests of the filesystem.
+func (fs *StorageFS) rawService(opts *urlOpts) (*raw.Service, error) {
+	cfg := gcpsvc.GetConfig(opts.u, GsScheme)
+	if fs != nil {
+		if svc, ok := fs.rawServices.Load(cfg); ok {
+			return svc.(*raw.Service), nil
+		}
+	}
+	var clientOpts []option.ClientOption
+	if cfg != nil {
+		clientOpts = cfg.Options
+	}
+	svc, err := raw.NewService(context.Background(), clientOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage JSON API client: %w", err)
+	}
+	if fs != nil {
+		cached, _ := fs.rawServices.LoadOrStore(cfg, svc)
+		svc = cached.(*raw.Service)
+	}
+	return svc, nil
+}
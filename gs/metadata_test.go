@@ -0,0 +1,90 @@
+package gs
+
+import (
+	"encoding/json"
+	"testing"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestMetadataUpdate_Empty(t *testing.T) {
+	if !(&MetadataUpdate{MetagenerationMatch: 3}).empty() {
+		t.Error("expected an update with only a precondition to be empty")
+	}
+	if (&MetadataUpdate{CacheControl: "no-cache"}).empty() {
+		t.Error("expected a header update not to be empty")
+	}
+	if (&MetadataUpdate{Remove: []string{"k"}}).empty() {
+		t.Error("expected a removal not to be empty")
+	}
+}
+
+func TestMetadataUpdate_Changes(t *testing.T) {
+	attrs := &storage.ObjectAttrs{
+		ContentType:  "text/plain",
+		CacheControl: "no-cache",
+		Metadata:     map[string]string{"owner": "data", "stage": "raw"},
+	}
+	tests := []struct {
+		name   string
+		update *MetadataUpdate
+		want   bool
+	}{
+		{"same value", &MetadataUpdate{Set: map[string]string{"owner": "data"}}, false},
+		{"new value", &MetadataUpdate{Set: map[string]string{"owner": "ml"}}, true},
+		{"new key", &MetadataUpdate{Set: map[string]string{"team": "x"}}, true},
+		{"remove missing", &MetadataUpdate{Remove: []string{"team"}}, false},
+		{"remove existing", &MetadataUpdate{Remove: []string{"stage"}}, true},
+		{"same header", &MetadataUpdate{ContentType: "text/plain", CacheControl: "no-cache"}, false},
+		{"new header", &MetadataUpdate{CacheControl: "public, max-age=3600"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.update.changes(attrs); got != tt.want {
+				t.Errorf("changes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetadataUpdate_RawObject(t *testing.T) {
+	update := &MetadataUpdate{
+		Set:          map[string]string{"owner": "ml"},
+		Remove:       []string{"stage"},
+		CacheControl: "no-store",
+	}
+	body, err := json.Marshal(update.rawObject())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	if err = json.Unmarshal(body, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["cacheControl"] != "no-store" {
+		t.Errorf("cacheControl = %v", got["cacheControl"])
+	}
+	if _, ok := got["contentType"]; ok {
+		t.Error("expected unchanged headers to be omitted")
+	}
+	metadata, ok := got["metadata"].(map[string]any)
+	if !ok {
+		t.Fatalf("expected a metadata object, got %s", body)
+	}
+	if metadata["owner"] != "ml" {
+		t.Errorf("owner = %v", metadata["owner"])
+	}
+	if v, ok := metadata["stage"]; !ok || v != nil {
+		t.Errorf("expected stage to be sent as null, got %s", body)
+	}
+}
+
+func TestMetadataUpdate_RawObjectRemoveOnly(t *testing.T) {
+	body, err := json.Marshal((&MetadataUpdate{Remove: []string{"stage"}}).rawObject())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != `{"metadata":{"stage":null}}` {
+		t.Errorf("unexpected body %s", body)
+	}
+}
@@ -0,0 +1,248 @@
+package gs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"oss.nandlabs.io/golly/ioutils"
+	"oss.nandlabs.io/golly/textutils"
+)
+
+// defaultMoveConcurrency is the default number of objects moved concurrently for a prefix.
+const defaultMoveConcurrency = 8
+
+// MoveOptions configures MoveWithOptions. A nil *MoveOptions overwrites existing destination
+// objects and preserves metadata.
+type MoveOptions struct {
+	// ResetMetadata drops custom metadata from moved objects. Content headers such as
+	// Content-Type and Content-Encoding are always kept. Across buckets, the tags and ACL of
+	// the objects are reset too, to the defaults of the destination bucket. Without it, all
+	// attributes of the source object are kept.
+	ResetMetadata bool
+	// NoOverwrite fails instead of replacing an existing destination object.
+	NoOverwrite bool
+	// Concurrency is the number of objects moved concurrently when the source is a
+	// prefix. Default: 8.
+	Concurrency int
+}
+
+// MoveWithOptions moves the object or prefix at src to dst.
+//
+// Within a bucket, every object is moved with the atomic GCS move operation, so the object
+// is never visible under both names or under neither. Across buckets, every object is
+// rewritten to dst and then deleted from src; both steps are conditioned on the source
+// generation, so a source object overwritten during the move is not deleted.
+//
+// A prefix is moved object by object; a failure leaves the objects moved so far at dst.
+func (fs *StorageFS) MoveWithOptions(ctx context.Context, src, dst *url.URL, options *MoveOptions) error {
+	if options == nil {
+		options = &MoveOptions{}
+	}
+	srcOpts, err := parseURL(src)
+	if err != nil {
+		return err
+	}
+	dstOpts, err := parseURL(dst)
+	if err != nil {
+		return err
+	}
+	if srcOpts.Bucket == dstOpts.Bucket && srcOpts.Key == dstOpts.Key {
+		return nil
+	}
+
+	client, err := getStorageClient(ctx, srcOpts)
+	if err != nil {
+		return err
+	}
+	defer ioutils.CloserFunc(client)
+
+	info, err := newStorageFile(client, fs, srcOpts).Info()
+	if err != nil || !info.IsDir() {
+		return fs.moveObject(ctx, client, srcOpts, dstOpts, options)
+	}
+	return fs.movePrefix(ctx, client, srcOpts, dstOpts, options)
+}
+
+// movePrefix moves every object under the src prefix to the same relative key under dst.
+func (fs *StorageFS) movePrefix(ctx context.Context, client *storage.Client, src, dst *urlOpts, options *MoveOptions) error {
+	srcPrefix := src.Key
+	if srcPrefix != "" && !strings.HasSuffix(srcPrefix, textutils.ForwardSlashStr) {
+		srcPrefix = srcPrefix + textutils.ForwardSlashStr
+	}
+	dstPrefix := dst.Key
+	if dstPrefix != "" && !strings.HasSuffix(dstPrefix, textutils.ForwardSlashStr) {
+		dstPrefix = dstPrefix + textutils.ForwardSlashStr
+	}
+	if src.Bucket == dst.Bucket && strings.HasPrefix(dstPrefix, srcPrefix) {
+		return fmt.Errorf("cannot move gs://%s/%s into itself", src.Bucket, srcPrefix)
+	}
+	concurrency := options.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultMoveConcurrency
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	count := 0
+
+	it := bucketHandle(client, src).Objects(ctx, &storage.Query{Prefix: srcPrefix})
+	for {
+		attrs, iterErr := it.Next()
+		if iterErr == iterator.Done {
+			break
+		}
+		if iterErr != nil {
+			mu.Lock()
+			if firstErr == nil {
+				firstErr = iterErr
+			}
+			mu.Unlock()
+			break
+		}
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		count++
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			childSrc := objectURLOpts(src.Bucket, name)
+			childDst := objectURLOpts(dst.Bucket, movedKey(name, srcPrefix, dstPrefix))
+			if moveErr := fs.moveObject(ctx, client, childSrc, childDst, options); moveErr != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = moveErr
+					cancel()
+				}
+				mu.Unlock()
+			}
+		}(attrs.Name)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	logger.InfoF("Moved %d objects from gs://%s/%s to gs://%s/%s", count, src.Bucket, srcPrefix, dst.Bucket, dstPrefix)
+	return nil
+}
+
+// moveObject moves a single object, using the atomic move within a bucket and a
+// preconditioned rewrite and delete across buckets.
+func (fs *StorageFS) moveObject(ctx context.Context, client *storage.Client, src, dst *urlOpts, options *MoveOptions) error {
+	ctx, cancel := timeoutContext(ctx, dst)
+	defer cancel()
+
+	srcObj := bucketHandle(client, src).Object(src.Key)
+	attrs, err := srcObj.Attrs(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get metadata of gs://%s/%s: %w", src.Bucket, src.Key, err)
+	}
+	var dstConds *storage.Conditions
+	if options.NoOverwrite {
+		dstConds = &storage.Conditions{DoesNotExist: true}
+	}
+	if cache := fs.getCache(); cache != nil {
+		defer cache.invalidate(src.Bucket, src.Key)
+		defer cache.invalidate(dst.Bucket, dst.Key)
+	}
+
+	if src.Bucket == dst.Bucket {
+		moved, moveErr := srcObj.If(storage.Conditions{GenerationMatch: attrs.Generation}).
+			Move(ctx, storage.MoveObjectDestination{Object: dst.Key, Conditions: dstConds})
+		if moveErr == nil {
+			if options.ResetMetadata && len(moved.Metadata) > 0 {
+				_, moveErr = bucketHandle(client, dst).Object(dst.Key).
+					If(storage.Conditions{MetagenerationMatch: moved.Metageneration}).
+					Update(ctx, storage.ObjectAttrsToUpdate{Metadata: map[string]string{}})
+				if moveErr != nil {
+					return fmt.Errorf("moved gs://%s/%s to gs://%s/%s but failed to reset its metadata: %w", src.Bucket, src.Key, dst.Bucket, dst.Key, moveErr)
+				}
+			}
+			return nil
+		}
+		if !isUnimplemented(moveErr) {
+			return fmt.Errorf("failed to move gs://%s/%s to gs://%s/%s: %w", src.Bucket, src.Key, dst.Bucket, dst.Key, moveErr)
+		}
+		logger.WarnF("Atomic move is not available for gs://%s, falling back to rewrite and delete", src.Bucket)
+	}
+
+	dstObj := bucketHandle(client, dst).Object(dst.Key)
+	if dstConds != nil {
+		dstObj = dstObj.If(*dstConds)
+	}
+	copier := dstObj.CopierFrom(srcObj.Generation(attrs.Generation))
+	if options.ResetMetadata {
+		copyContentHeaders(copier, attrs)
+	}
+	if _, err = copier.Run(ctx); err != nil {
+		return fmt.Errorf("failed to copy gs://%s/%s to gs://%s/%s: %w", src.Bucket, src.Key, dst.Bucket, dst.Key, err)
+	}
+	if err = srcObj.If(storage.Conditions{GenerationMatch: attrs.Generation}).Delete(ctx); err != nil {
+		return fmt.Errorf("copied gs://%s/%s to gs://%s/%s but failed to delete the source: %w", src.Bucket, src.Key, dst.Bucket, dst.Key, err)
+	}
+	return nil
+}
+
+// movedKey maps an object key under srcPrefix to the same relative key under dstPrefix.
+func movedKey(name, srcPrefix, dstPrefix string) string {
+	return dstPrefix + strings.TrimPrefix(name, srcPrefix)
+}
+
+// objectURLOpts returns the urlOpts of an object key.
+func objectURLOpts(bucket, key string) *urlOpts {
+	return &urlOpts{
+		u: &url.URL{
+			Scheme: GsScheme,
+			Host:   bucket,
+			Path:   "/" + key,
+		},
+		Bucket: bucket,
+		Key:    key,
+	}
+}
+
+// copyContentHeaders sets the content headers of attrs on copier. A rewrite without
+// destination attributes copies every attribute of the source object; once any is set, the
+// others are dropped, so the content headers are copied explicitly when metadata is reset.
+func copyContentHeaders(copier *storage.Copier, attrs *storage.ObjectAttrs) {
+	copier.ContentType = attrs.ContentType
+	copier.ContentLanguage = attrs.ContentLanguage
+	copier.ContentEncoding = attrs.ContentEncoding
+	copier.ContentDisposition = attrs.ContentDisposition
+	copier.CacheControl = attrs.CacheControl
+	copier.CustomTime = attrs.CustomTime
+}
+
+// isUnimplemented reports whether err means the requested operation is not supported.
+func isUnimplemented(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == http.StatusNotImplemented
+	}
+	return status.Code(err) == codes.Unimplemented
+}
@@ -0,0 +1,105 @@
+package gs
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+)
+
+func TestMovedKey(t *testing.T) {
+	tests := []struct {
+		name, src, dst, want string
+	}{
+		{"logs/a.txt", "logs/", "archive/logs/", "archive/logs/a.txt"},
+		{"logs/2024/b.txt", "logs/", "", "2024/b.txt"},
+		{"a.txt", "", "backup/", "backup/a.txt"},
+	}
+	for _, tt := range tests {
+		if got := movedKey(tt.name, tt.src, tt.dst); got != tt.want {
+			t.Errorf("movedKey(%q, %q, %q) = %q, want %q", tt.name, tt.src, tt.dst, got, tt.want)
+		}
+	}
+}
+
+func TestObjectURLOpts(t *testing.T) {
+	opts := objectURLOpts("bucket", "dir/file.txt")
+	if opts.Bucket != "bucket" || opts.Key != "dir/file.txt" || opts.u.String() != "gs://bucket/dir/file.txt" {
+		t.Errorf("unexpected opts %+v", opts)
+	}
+}
+
+func TestCopyContentHeaders(t *testing.T) {
+	attrs := &storage.ObjectAttrs{
+		ContentType:     "application/json",
+		ContentEncoding: "gzip",
+		CacheControl:    "no-cache",
+		CustomTime:      time.Unix(1700000000, 0),
+		Metadata:        map[string]string{"owner": "data"},
+	}
+
+	copier := &storage.Copier{}
+	copyContentHeaders(copier, attrs)
+	if copier.ContentType != "application/json" || copier.ContentEncoding != "gzip" || copier.CacheControl != "no-cache" {
+		t.Errorf("content headers not copied: %+v", copier.ObjectAttrs)
+	}
+	if !copier.CustomTime.Equal(attrs.CustomTime) {
+		t.Error("custom time not copied")
+	}
+	if copier.Metadata != nil {
+		t.Error("expected metadata not to be copied")
+	}
+}
+
+func TestMoveObject_CrossBucketAttributes(t *testing.T) {
+	tests := []struct {
+		name  string
+		reset bool
+		want  map[string]any
+	}{
+		// Without a destination resource the rewrite keeps every source attribute,
+		// including metadata, tags and ACL.
+		{"preserve", false, map[string]any{}},
+		{"reset", true, map[string]any{"contentType": "application/json", "cacheControl": "no-cache"}},
+	}
+	for _, tt := range tests {
+		var rewritten map[string]any
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.Method == http.MethodGet:
+				_, _ = io.WriteString(w, `{"bucket":"src","name":"a.json","generation":"7","contentType":"application/json",`+
+					`"cacheControl":"no-cache","metadata":{"owner":"data"},"contexts":{"custom":{"team":{"value":"x"}}}}`)
+			case r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/rewriteTo/"):
+				_ = json.NewDecoder(r.Body).Decode(&rewritten)
+				_, _ = io.WriteString(w, `{"done":true,"resource":{"bucket":"dst","name":"a.json"}}`)
+			case r.Method == http.MethodDelete:
+				w.WriteHeader(http.StatusNoContent)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		client, err := storage.NewClient(context.Background(), option.WithoutAuthentication(),
+			option.WithEndpoint(server.URL+"/storage/v1/"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = NewStorageFS().moveObject(context.Background(), client, objectURLOpts("src", "a.json"),
+			objectURLOpts("dst", "a.json"), &MoveOptions{ResetMetadata: tt.reset})
+		_ = client.Close()
+		server.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(rewritten, tt.want) {
+			t.Errorf("%s: got destination resource %v, want %v", tt.name, rewritten, tt.want)
+		}
+	}
+}
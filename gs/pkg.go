@@ -11,18 +11,59 @@ import (
 
 var logger = l3.Get()
 
+// storageFs is the StorageFS registered with the VFS manager.
+var storageFs = NewStorageFS()
+
 func init() {
-	storageFs := &StorageFS{}
-	storageFs.BaseVFS = &vfs.BaseVFS{VFileSystem: storageFs}
 	vfs.GetManager().Register(storageFs)
 }
 
+// GetStorageFS returns the StorageFS registered with the VFS manager, for access to
+// GCS-specific features that are not part of the vfs.VFileSystem interface.
+func GetStorageFS() *StorageFS {
+	return storageFs
+}
+
 // getStorageClient creates a GCS client using the gcpsvc config resolved for the given urlOpts.
-func getStorageClient(opts *urlOpts) (*storage.Client, error) {
+// The retry policy set on ctx with WithRetryPolicy takes precedence over the config's.
+func getStorageClient(ctx context.Context, opts *urlOpts) (*storage.Client, error) {
 	cfg := gcpsvc.GetConfig(opts.u, GsScheme)
+	var client *storage.Client
+	var err error
 	if cfg == nil {
 		// Fallback: load default GCS client without gcpsvc registration
-		return storage.NewClient(context.Background())
+		client, err = storage.NewClient(context.Background())
+	} else {
+		client, err = storage.NewClient(context.Background(), cfg.Options...)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if policy := retryPolicy(ctx, opts); policy != nil {
+		client.SetRetry(storageRetryOptions(policy)...)
+	}
+	return client, nil
+}
+
+// bucketHandle returns a handle for the bucket of the given urlOpts. If the gcpsvc config
+// resolved for the URL has a UserProject, requests are billed to that project, as required
+// for requester-pays buckets.
+func bucketHandle(client *storage.Client, opts *urlOpts) *storage.BucketHandle {
+	bucket := client.Bucket(opts.Bucket)
+	if opts.retry != nil {
+		bucket = bucket.Retryer(storageRetryOptions(opts.retry)...)
+	}
+	if userProject := resolveUserProject(opts); userProject != "" {
+		bucket = bucket.UserProject(userProject)
+	}
+	return bucket
+}
+
+// resolveUserProject returns the UserProject of the gcpsvc config resolved for opts, if any.
+func resolveUserProject(opts *urlOpts) string {
+	if cfg := gcpsvc.GetConfig(opts.u, GsScheme); cfg != nil {
+		return cfg.UserProject
 	}
-	return storage.NewClient(context.Background(), cfg.Options...)
+	return ""
 }
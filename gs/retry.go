@@ -0,0 +1,151 @@
+package gs
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/googleapis/gax-go/v2"
+	"oss.nandlabs.io/golly-gcp/gcpsvc"
+)
+
+// retryPolicyKey is the context key of a per-call retry policy.
+type retryPolicyKey struct{}
+
+// WithRetryPolicy returns a copy of ctx that makes the StorageFS methods called with it
+// retry according to policy instead of the policy of the resolved gcpsvc config. Methods of
+// the vfs interfaces take no context; use StorageFile.SetRetryPolicy for them.
+func WithRetryPolicy(ctx context.Context, policy *gcpsvc.RetryPolicy) context.Context {
+	return context.WithValue(ctx, retryPolicyKey{}, policy)
+}
+
+// retryPolicyFrom returns the per-call retry policy set on ctx, if any.
+func retryPolicyFrom(ctx context.Context) *gcpsvc.RetryPolicy {
+	policy, _ := ctx.Value(retryPolicyKey{}).(*gcpsvc.RetryPolicy)
+	return policy
+}
+
+// storageRetryOptions converts a gcpsvc retry policy into storage client retry options.
+// Unset fields are left to the library defaults.
+func storageRetryOptions(policy *gcpsvc.RetryPolicy) []storage.RetryOption {
+	var opts []storage.RetryOption
+	if policy.MaxAttempts > 0 {
+		opts = append(opts, storage.WithMaxAttempts(policy.MaxAttempts))
+	}
+	if policy.InitialBackoff > 0 || policy.MaxBackoff > 0 || policy.Multiplier > 0 {
+		opts = append(opts, storage.WithBackoff(gax.Backoff{
+			Initial:    policy.InitialBackoff,
+			Max:        policy.MaxBackoff,
+			Multiplier: policy.Multiplier,
+		}))
+	}
+	if policy.MaxDuration > 0 {
+		opts = append(opts, storage.WithMaxRetryDuration(policy.MaxDuration))
+	}
+	switch policy.Idempotency {
+	case gcpsvc.RetryAlways:
+		opts = append(opts, storage.WithPolicy(storage.RetryAlways))
+	case gcpsvc.RetryNever:
+		opts = append(opts, storage.WithPolicy(storage.RetryNever))
+	default:
+		opts = append(opts, storage.WithPolicy(storage.RetryIdempotent))
+	}
+	if policy.ShouldRetry != nil {
+		opts = append(opts, storage.WithErrorFunc(policy.ShouldRetry))
+	}
+	return opts
+}
+
+// retryCall calls fn until it succeeds or fails with an error that policy does not retry,
+// for requests made outside the storage client. idempotent tells whether the request can be
+// repeated under the RetryIdempotent policy. A nil policy retries idempotent requests with
+// the storage client defaults. The returned error is that of the last call.
+func retryCall(ctx context.Context, policy *gcpsvc.RetryPolicy, idempotent bool, fn func() error) error {
+	if policy == nil {
+		policy = &gcpsvc.RetryPolicy{}
+	}
+	retry := policy.Idempotency == gcpsvc.RetryAlways || (policy.Idempotency == gcpsvc.RetryIdempotent && idempotent)
+	shouldRetry := policy.ShouldRetry
+	if shouldRetry == nil {
+		shouldRetry = isTransient
+	}
+	backoff := gax.Backoff{Initial: policy.InitialBackoff, Max: policy.MaxBackoff, Multiplier: policy.Multiplier}
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !retry || !shouldRetry(err) || (policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts) {
+			return err
+		}
+		pause := backoff.Pause()
+		if policy.MaxDuration > 0 && time.Since(start)+pause > policy.MaxDuration {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(pause):
+		}
+	}
+}
+
+// isTransient reports whether err, or an error it wraps, is retried by the storage client.
+func isTransient(err error) bool {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if storage.ShouldRetry(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetRetryPolicy makes the requests of the file, and of the files listed from it, retry
+// according to policy instead of the policy of the client it was opened with. This
+// overrides the policy of the resolved gcpsvc config for the vfs methods, which take no
+// context. Nil restores the client policy.
+func (f *StorageFile) SetRetryPolicy(policy *gcpsvc.RetryPolicy) {
+	opts := *f.urlOpts
+	opts.retry = policy
+	f.urlOpts = &opts
+}
+
+// retryPolicy returns the policy in effect for requests on opts made with ctx: the policy
+// of opts, then that of ctx, then that of the resolved gcpsvc config. Nil means the client
+// library defaults.
+func retryPolicy(ctx context.Context, opts *urlOpts) *gcpsvc.RetryPolicy {
+	if opts.retry != nil {
+		return opts.retry
+	}
+	if policy := retryPolicyFrom(ctx); policy != nil {
+		return policy
+	}
+	if cfg := gcpsvc.GetConfig(opts.u, GsScheme); cfg != nil {
+		return cfg.Retry
+	}
+	return nil
+}
+
+// newObjectWriter returns a writer uploading to obj with ctx. The Timeout of the gcpsvc
+// config resolved for opts bounds every chunk request of the upload rather than the whole
+// upload, so that large objects are not cut off after the timeout.
+func newObjectWriter(ctx context.Context, obj *storage.ObjectHandle, opts *urlOpts) *storage.Writer {
+	writer := obj.NewWriter(ctx)
+	if cfg := gcpsvc.GetConfig(opts.u, GsScheme); cfg != nil && cfg.Timeout > 0 {
+		writer.ChunkTransferTimeout = cfg.Timeout
+	}
+	return writer
+}
+
+// operationContext returns a context for a single-request operation on opts, bounded by
+// the Timeout of the resolved gcpsvc config. Uploads use newObjectWriter instead.
+func operationContext(opts *urlOpts) (context.Context, context.CancelFunc) {
+	return timeoutContext(context.Background(), opts)
+}
+
+// timeoutContext returns ctx bounded by the Timeout of the gcpsvc config resolved for opts.
+func timeoutContext(ctx context.Context, opts *urlOpts) (context.Context, context.CancelFunc) {
+	if cfg := gcpsvc.GetConfig(opts.u, GsScheme); cfg != nil && cfg.Timeout > 0 {
+		return context.WithTimeout(ctx, cfg.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
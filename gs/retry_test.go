@@ -0,0 +1,161 @@
+package gs
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	"oss.nandlabs.io/golly-gcp/gcpsvc"
+)
+
+func TestStorageRetryOptions(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy *gcpsvc.RetryPolicy
+		want   int
+	}{
+		{"defaults", &gcpsvc.RetryPolicy{}, 1},
+		{"max attempts", &gcpsvc.RetryPolicy{MaxAttempts: 5}, 2},
+		{"backoff", &gcpsvc.RetryPolicy{InitialBackoff: time.Second, Multiplier: 1.5}, 2},
+		{"all", &gcpsvc.RetryPolicy{
+			MaxAttempts:    3,
+			MaxBackoff:     time.Minute,
+			MaxDuration:    5 * time.Minute,
+			Idempotency:    gcpsvc.RetryAlways,
+			ShouldRetry:    func(err error) bool { return true },
+			InitialBackoff: 100 * time.Millisecond,
+		}, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := len(storageRetryOptions(tt.policy)); got != tt.want {
+				t.Errorf("got %d options, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithRetryPolicy(t *testing.T) {
+	if retryPolicyFrom(context.Background()) != nil {
+		t.Fatal("expected no policy on a plain context")
+	}
+	policy := &gcpsvc.RetryPolicy{MaxAttempts: 2}
+	ctx := WithRetryPolicy(context.Background(), policy)
+	if retryPolicyFrom(ctx) != policy {
+		t.Error("expected the per-call policy")
+	}
+}
+
+func TestOperationContext(t *testing.T) {
+	u, _ := url.Parse("gs://timeout-test-bucket/key")
+	opts, _ := parseURL(u)
+
+	ctx, cancel := operationContext(opts)
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("expected no deadline without a configured timeout")
+	}
+	cancel()
+
+	gcpsvc.Manager.Register("timeout-test-bucket", &gcpsvc.Config{Timeout: time.Millisecond})
+	defer gcpsvc.Manager.Unregister("timeout-test-bucket")
+
+	ctx, cancel = operationContext(opts)
+	defer cancel()
+	<-ctx.Done()
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", ctx.Err())
+	}
+}
+
+func TestRetryPolicy_Precedence(t *testing.T) {
+	u, _ := url.Parse("gs://retry-precedence-bucket/key")
+	opts, _ := parseURL(u)
+	if retryPolicy(context.Background(), opts) != nil {
+		t.Fatal("expected no policy without a config")
+	}
+
+	cfgPolicy := &gcpsvc.RetryPolicy{MaxAttempts: 2}
+	gcpsvc.Manager.Register("retry-precedence-bucket", &gcpsvc.Config{Retry: cfgPolicy})
+	defer gcpsvc.Manager.Unregister("retry-precedence-bucket")
+	if retryPolicy(context.Background(), opts) != cfgPolicy {
+		t.Error("expected the config policy")
+	}
+
+	ctxPolicy := &gcpsvc.RetryPolicy{MaxAttempts: 3}
+	ctx := WithRetryPolicy(context.Background(), ctxPolicy)
+	if retryPolicy(ctx, opts) != ctxPolicy {
+		t.Error("expected the context policy over the config policy")
+	}
+
+	f := newStorageFile(nil, nil, opts)
+	filePolicy := &gcpsvc.RetryPolicy{MaxAttempts: 4}
+	f.SetRetryPolicy(filePolicy)
+	if retryPolicy(ctx, f.urlOpts) != filePolicy {
+		t.Error("expected the file policy over the context policy")
+	}
+	if opts.retry != nil {
+		t.Error("expected SetRetryPolicy not to change the shared location")
+	}
+}
+
+func TestRetryCall(t *testing.T) {
+	transient := &googleapi.Error{Code: 503}
+	fast := &gcpsvc.RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	tests := []struct {
+		name       string
+		policy     *gcpsvc.RetryPolicy
+		idempotent bool
+		err        error
+		want       int
+	}{
+		{"idempotent retried", &gcpsvc.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}, true, transient, 3},
+		{"non-idempotent not retried", &gcpsvc.RetryPolicy{MaxAttempts: 3}, false, transient, 1},
+		{"always retried", &gcpsvc.RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond, Idempotency: gcpsvc.RetryAlways}, false, transient, 2},
+		{"never retried", &gcpsvc.RetryPolicy{MaxAttempts: 3, Idempotency: gcpsvc.RetryNever}, true, transient, 1},
+		{"permanent error", &gcpsvc.RetryPolicy{MaxAttempts: 3}, true, &googleapi.Error{Code: 412}, 1},
+		{"custom predicate", &gcpsvc.RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond, ShouldRetry: func(error) bool { return true }}, true, errors.New("x"), 2},
+		{"succeeds", fast, true, nil, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := retryCall(context.Background(), tt.policy, tt.idempotent, func() error {
+				calls++
+				return tt.err
+			})
+			if calls != tt.want {
+				t.Errorf("got %d calls, want %d", calls, tt.want)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got error %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestRawService_CachedPerConfig(t *testing.T) {
+	gcpsvc.Manager.Register("raw-service-bucket", &gcpsvc.Config{Options: []option.ClientOption{option.WithoutAuthentication()}})
+	defer gcpsvc.Manager.Unregister("raw-service-bucket")
+
+	fs := NewStorageFS()
+	first, _ := parseURL(&url.URL{Scheme: GsScheme, Host: "raw-service-bucket", Path: "/a"})
+	second, _ := parseURL(&url.URL{Scheme: GsScheme, Host: "raw-service-bucket", Path: "/b"})
+	svc1, err := fs.rawService(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc2, err := fs.rawService(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if svc1 != svc2 {
+		t.Error("expected the JSON API client to be reused for the same config")
+	}
+	if other, _ := NewStorageFS().rawService(first); other == svc1 {
+		t.Error("expected a separate client per filesystem")
+	}
+}
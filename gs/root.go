@@ -0,0 +1,92 @@
+package gs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+	"oss.nandlabs.io/golly-gcp/gcpsvc"
+	"oss.nandlabs.io/golly/vfs"
+)
+
+// errRootReadOnly is returned by operations that would modify the gs:// root.
+var errRootReadOnly = errors.New("the gs:// root is a read-only listing of buckets")
+
+// isRootURL reports whether u is the gs:// root, the virtual directory holding the buckets.
+func isRootURL(u *url.URL) bool {
+	return u != nil && u.Scheme == GsScheme && u.Host == "" && (u.Path == "" || u.Path == "/")
+}
+
+// parseLocation parses a GCS URL like parseURL, additionally accepting the gs:// root, for
+// which the returned urlOpts has an empty Bucket.
+func parseLocation(u *url.URL) (*urlOpts, error) {
+	if isRootURL(u) {
+		return &urlOpts{u: u}, nil
+	}
+	return parseURL(u)
+}
+
+// isRoot reports whether the urlOpts refer to the gs:// root.
+func (o *urlOpts) isRoot() bool {
+	return o.Bucket == ""
+}
+
+// checkObject returns an error wrapping ErrIsDirectory if f is the gs:// root or a bucket,
+// which have no object to read, modify or describe; for the root it also wraps
+// errRootReadOnly. Object-level methods call it first rather than sending requests for an
+// object with an empty name.
+func (f *StorageFile) checkObject() error {
+	switch {
+	case f.urlOpts.isRoot():
+		return fmt.Errorf("%w, not an object: %w", errRootReadOnly, ErrIsDirectory)
+	case f.urlOpts.Key == "":
+		return fmt.Errorf("gs://%s is a bucket, not an object: %w", f.urlOpts.Bucket, ErrIsDirectory)
+	}
+	return nil
+}
+
+// listBuckets returns a directory for every bucket in the project of the gcpsvc config
+// resolved for the root URL of opts.
+func (fs *StorageFS) listBuckets(ctx context.Context, client *storage.Client, opts *urlOpts) ([]vfs.VFile, error) {
+	cfg := gcpsvc.GetConfig(opts.u, GsScheme)
+	if cfg == nil || cfg.ProjectId == "" {
+		return nil, errors.New("listing gs:// requires a gcpsvc config with a ProjectId")
+	}
+	var buckets []vfs.VFile
+	it := client.Buckets(ctx, cfg.ProjectId)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list buckets of project %s: %w", cfg.ProjectId, err)
+		}
+		buckets = append(buckets, newStorageFile(client, fs, dirURLOpts(attrs.Name, "")))
+	}
+	return buckets, nil
+}
+
+// walkRoot calls fn for every bucket directory and then walks the objects of that bucket.
+func (fs *StorageFS) walkRoot(opts *urlOpts, fn vfs.WalkFn) error {
+	client, err := getStorageClient(context.Background(), opts)
+	if err != nil {
+		return err
+	}
+	buckets, err := fs.listBuckets(context.Background(), client, opts)
+	if err != nil {
+		return err
+	}
+	for _, bucket := range buckets {
+		if err = fn(bucket); err != nil {
+			return err
+		}
+		if err = fs.Walk(bucket.Url(), fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
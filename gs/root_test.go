@@ -0,0 +1,124 @@
+package gs
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+)
+
+func TestIsRootURL(t *testing.T) {
+	tests := map[string]bool{
+		"gs://":        true,
+		"gs:///":       true,
+		"gs://bucket":  false,
+		"gs://bucket/": false,
+		"gs:///key":    false,
+		"s3://":        false,
+	}
+	for raw, want := range tests {
+		u, err := url.Parse(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := isRootURL(u); got != want {
+			t.Errorf("isRootURL(%q) = %v, want %v", raw, got, want)
+		}
+	}
+	if isRootURL(nil) {
+		t.Error("expected nil URL not to be the root")
+	}
+}
+
+func TestParseLocation(t *testing.T) {
+	root, _ := url.Parse("gs://")
+	opts, err := parseLocation(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opts.isRoot() || opts.Key != "" {
+		t.Errorf("expected root opts, got %+v", opts)
+	}
+
+	u, _ := url.Parse("gs://bucket/key")
+	if opts, err = parseLocation(u); err != nil || opts.isRoot() || opts.Bucket != "bucket" {
+		t.Errorf("unexpected opts %+v, %v", opts, err)
+	}
+
+	// Object URLs without a bucket are still rejected
+	u, _ = url.Parse("gs:///key")
+	if _, err = parseLocation(u); err == nil {
+		t.Error("expected error for key without bucket")
+	}
+}
+
+func TestRootFile_ReadOnly(t *testing.T) {
+	root, _ := url.Parse("gs://")
+	f := newStorageFile(nil, NewStorageFS(), &urlOpts{u: root})
+
+	if _, err := f.Read(make([]byte, 1)); !errors.Is(err, ErrIsDirectory) {
+		t.Errorf("expected ErrIsDirectory from Read, got %v", err)
+	}
+	if _, err := f.Write([]byte("x")); !errors.Is(err, errRootReadOnly) {
+		t.Errorf("expected read-only error from Write, got %v", err)
+	}
+	if err := f.Delete(); !errors.Is(err, errRootReadOnly) {
+		t.Errorf("expected read-only error from Delete, got %v", err)
+	}
+	if err := f.DeleteAll(); !errors.Is(err, errRootReadOnly) {
+		t.Errorf("expected read-only error from DeleteAll, got %v", err)
+	}
+}
+
+func TestBucketRootInfo(t *testing.T) {
+	f := newStorageFile(nil, NewStorageFS(), dirURLOpts("my-bucket", ""))
+	info, err := f.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsDir() || info.Name() != "my-bucket" {
+		t.Errorf("expected directory named after the bucket, got %v", info)
+	}
+
+	root, _ := url.Parse("gs://")
+	info, err = newStorageFile(nil, NewStorageFS(), &urlOpts{u: root}).Info()
+	if err != nil || !info.IsDir() {
+		t.Errorf("expected root to be a directory, got %v, %v", info, err)
+	}
+}
+
+func TestRootAndBucketFiles_RejectObjectOperations(t *testing.T) {
+	root, _ := url.Parse("gs://")
+	files := map[string]*StorageFile{
+		"root":   newStorageFile(nil, NewStorageFS(), &urlOpts{u: root}),
+		"bucket": newStorageFile(nil, NewStorageFS(), dirURLOpts("my-bucket", "")),
+	}
+	for name, f := range files {
+		ops := map[string]func() error{
+			"Read":            func() error { _, err := f.Read(make([]byte, 1)); return err },
+			"Write":           func() error { _, err := f.Write([]byte("x")); return err },
+			"Delete":          func() error { return f.Delete() },
+			"AddProperty":     func() error { return f.AddProperty("k", "v") },
+			"GetProperty":     func() error { _, err := f.GetProperty("k"); return err },
+			"SetProperties":   func() error { return f.SetProperties(map[string]string{"k": "v"}) },
+			"RemoveProperty":  func() error { return f.RemoveProperty("k") },
+			"UpdateMetadata":  func() error { return f.UpdateMetadata(&MetadataUpdate{ContentType: "text/plain"}) },
+			"SetStorageClass": func() error { return f.SetStorageClass("COLDLINE") },
+			"Tags":            func() error { _, err := f.Tags(); return err },
+			"SetTags":         func() error { return f.SetTags(map[string]string{"k": "v"}) },
+			"RemoveTags":      func() error { return f.RemoveTags("k") },
+			"ClearTags":       func() error { return f.ClearTags() },
+			"ACL":             func() error { _, err := f.ACL(); return err },
+			"SetACL":          func() error { return f.SetACL("allUsers", "READER") },
+			"DeleteACL":       func() error { return f.DeleteACL("allUsers") },
+			"StartUpload":     func() error { _, err := f.StartUpload(context.Background(), 1, nil); return err },
+			"UploadFile":      func() error { return f.UploadFile(context.Background(), "missing", nil) },
+			"ResumeUploadURI": func() error { _, err := f.ResumeUploadSession(context.Background(), "uri", 1, nil); return err },
+		}
+		for op, fn := range ops {
+			if err := fn(); !errors.Is(err, ErrIsDirectory) {
+				t.Errorf("%s.%s: expected ErrIsDirectory, got %v", name, op, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package gs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+	"oss.nandlabs.io/golly/ioutils"
+	"oss.nandlabs.io/golly/textutils"
+)
+
+// GCS storage classes accepted by SetStorageClass.
+const (
+	StorageClassStandard = "STANDARD"
+	StorageClassNearline = "NEARLINE"
+	StorageClassColdline = "COLDLINE"
+	StorageClassArchive  = "ARCHIVE"
+)
+
+// defaultTransitionConcurrency is the default number of concurrent rewrites in SetStorageClass.
+const defaultTransitionConcurrency = 8
+
+// StorageClassOptions configures a prefix-wide SetStorageClass. A nil *StorageClassOptions
+// transitions every object under the prefix.
+type StorageClassOptions struct {
+	// MinAge only selects objects created at least this long ago.
+	MinAge time.Duration
+	// Filter is an optional predicate; only objects for which it returns true are selected.
+	Filter func(attrs *storage.ObjectAttrs) bool
+	// DryRun reports the objects that would be transitioned without rewriting them.
+	DryRun bool
+	// Concurrency is the number of concurrent rewrites. Default: 8.
+	Concurrency int
+	// Progress is called after every selected object has been processed. It may be
+	// called from multiple goroutines.
+	Progress func(progress *TransitionProgress)
+}
+
+// TransitionProgress reports the outcome for a single object of a SetStorageClass run.
+type TransitionProgress struct {
+	// Name is the object key.
+	Name string
+	// FromClass is the storage class before the transition.
+	FromClass string
+	// Size is the object size in bytes.
+	Size int64
+	// DryRun is true if the object was not rewritten because of StorageClassOptions.DryRun.
+	DryRun bool
+	// Err is the rewrite error, if the transition failed.
+	Err error
+}
+
+// TransitionReport summarises a prefix-wide SetStorageClass run.
+type TransitionReport struct {
+	// Selected is the number of objects matching the age and filter criteria
+	// that are not already in the target class.
+	Selected int64
+	// Transitioned is the number of objects rewritten (or that would be, for a dry run).
+	Transitioned int64
+	// Bytes is the total size of the transitioned objects.
+	Bytes int64
+	// Failed maps object keys to their rewrite errors.
+	Failed map[string]error
+}
+
+// SetStorageClass changes the storage class of this object by rewriting it in place.
+// The rewrite is conditioned on the current generation, so a concurrent overwrite is
+// never replaced. Rewriting creates a new generation and resets the object creation time.
+// The Timeout of the gcpsvc config bounds the metadata request but not the rewrite.
+func (f *StorageFile) SetStorageClass(class string) error {
+	if class == "" {
+		return errors.New("storage class cannot be empty")
+	}
+	if err := f.checkObject(); err != nil {
+		return err
+	}
+	bucket := bucketHandle(f.client, f.urlOpts)
+	ctx, cancel := operationContext(f.urlOpts)
+	attrs, err := bucket.Object(f.urlOpts.Key).Attrs(ctx)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("failed to get object metadata: %w", err)
+	}
+	if attrs.StorageClass == class {
+		return nil
+	}
+	// A large object takes several rewrite calls, so like the upload on Close the rewrite
+	// is not bounded by the operation timeout
+	return rewriteStorageClass(context.Background(), bucket, attrs, class)
+}
+
+// SetStorageClass changes the storage class of every object under the given prefix that
+// matches the age and filter criteria in options, rewriting objects concurrently. Objects
+// already in the target class and directory markers are skipped.
+//
+// The returned report is non-nil whenever listing succeeded. If any rewrite failed, the
+// failures are recorded in TransitionReport.Failed and an error is returned as well.
+func (fs *StorageFS) SetStorageClass(ctx context.Context, u *url.URL, class string, options *StorageClassOptions) (*TransitionReport, error) {
+	if class == "" {
+		return nil, errors.New("storage class cannot be empty")
+	}
+	if options == nil {
+		options = &StorageClassOptions{}
+	}
+	opts, err := parseURL(u)
+	if err != nil {
+		return nil, err
+	}
+	client, err := getStorageClient(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer ioutils.CloserFunc(client)
+
+	prefix := opts.Key
+	if prefix != "" && !strings.HasSuffix(prefix, textutils.ForwardSlashStr) {
+		prefix = prefix + textutils.ForwardSlashStr
+	}
+	concurrency := options.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultTransitionConcurrency
+	}
+
+	report := &TransitionReport{Failed: make(map[string]error)}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	now := time.Now()
+
+	bucket := bucketHandle(client, opts)
+	it := bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, iterErr := it.Next()
+		if iterErr == iterator.Done {
+			break
+		}
+		if iterErr != nil {
+			err = iterErr
+			break
+		}
+		if !selectForTransition(attrs, class, options, now) {
+			continue
+		}
+
+		mu.Lock()
+		report.Selected++
+		mu.Unlock()
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(attrs *storage.ObjectAttrs) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			progress := &TransitionProgress{
+				Name:      attrs.Name,
+				FromClass: attrs.StorageClass,
+				Size:      attrs.Size,
+				DryRun:    options.DryRun,
+			}
+			if !options.DryRun {
+				progress.Err = rewriteStorageClass(ctx, bucket, attrs, class)
+			}
+
+			mu.Lock()
+			if progress.Err != nil {
+				report.Failed[attrs.Name] = progress.Err
+			} else {
+				report.Transitioned++
+				report.Bytes += attrs.Size
+			}
+			mu.Unlock()
+
+			if options.Progress != nil {
+				options.Progress(progress)
+			}
+		}(attrs)
+	}
+	wg.Wait()
+
+	if err != nil {
+		return nil, err
+	}
+	if len(report.Failed) > 0 {
+		return report, fmt.Errorf("%d of %d storage class transitions under gs://%s/%s failed", len(report.Failed), report.Selected, opts.Bucket, prefix)
+	}
+	if options.DryRun {
+		logger.InfoF("Dry run: %d objects (%d bytes) under gs://%s/%s would move to %s", report.Transitioned, report.Bytes, opts.Bucket, prefix, class)
+	} else {
+		logger.InfoF("Moved %d objects (%d bytes) under gs://%s/%s to %s", report.Transitioned, report.Bytes, opts.Bucket, prefix, class)
+	}
+	return report, nil
+}
+
+// selectForTransition reports whether an object should be moved to class.
+func selectForTransition(attrs *storage.ObjectAttrs, class string, options *StorageClassOptions, now time.Time) bool {
+	if strings.HasSuffix(attrs.Name, textutils.ForwardSlashStr) || attrs.StorageClass == class {
+		return false
+	}
+	if options.MinAge > 0 && now.Sub(attrs.Created) < options.MinAge {
+		return false
+	}
+	return options.Filter == nil || options.Filter(attrs)
+}
+
+// rewriteStorageClass rewrites the object generation described by attrs into class,
+// preserving its content headers and custom metadata.
+func rewriteStorageClass(ctx context.Context, bucket *storage.BucketHandle, attrs *storage.ObjectAttrs, class string) error {
+	obj := bucket.Object(attrs.Name)
+	dst := obj.If(storage.Conditions{GenerationMatch: attrs.Generation})
+	copier := dst.CopierFrom(obj.Generation(attrs.Generation))
+	copier.StorageClass = class
+	copyContentHeaders(copier, attrs)
+	copier.Metadata = attrs.Metadata
+	if _, err := copier.Run(ctx); err != nil {
+		return fmt.Errorf("failed to rewrite gs://%s/%s to %s: %w", attrs.Bucket, attrs.Name, class, err)
+	}
+	return nil
+}
+
+// GetLifecycle returns the lifecycle configuration of the bucket in the given URL.
+func (fs *StorageFS) GetLifecycle(ctx context.Context, u *url.URL) (*storage.Lifecycle, error) {
+	opts, err := parseURL(u)
+	if err != nil {
+		return nil, err
+	}
+	client, err := getStorageClient(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer ioutils.CloserFunc(client)
+
+	attrs, err := bucketHandle(client, opts).Attrs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get bucket metadata: %w", err)
+	}
+	return &attrs.Lifecycle, nil
+}
+
+// SetLifecycle replaces the lifecycle configuration of the bucket in the given URL.
+// An empty lifecycle removes all rules.
+func (fs *StorageFS) SetLifecycle(ctx context.Context, u *url.URL, lifecycle *storage.Lifecycle) error {
+	if lifecycle == nil {
+		lifecycle = &storage.Lifecycle{}
+	}
+	opts, err := parseURL(u)
+	if err != nil {
+		return err
+	}
+	client, err := getStorageClient(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer ioutils.CloserFunc(client)
+
+	if _, err = bucketHandle(client, opts).Update(ctx, storage.BucketAttrsToUpdate{Lifecycle: lifecycle}); err != nil {
+		return fmt.Errorf("failed to update bucket lifecycle: %w", err)
+	}
+	logger.InfoF("Set %d lifecycle rules on gs://%s", len(lifecycle.Rules), opts.Bucket)
+	return nil
+}
+
+// AddLifecycleRule appends a rule to the lifecycle configuration of the bucket in the given
+// URL. The update is conditioned on the bucket metageneration, so concurrent changes to the
+// bucket configuration are not overwritten.
+func (fs *StorageFS) AddLifecycleRule(ctx context.Context, u *url.URL, rule storage.LifecycleRule) error {
+	opts, err := parseURL(u)
+	if err != nil {
+		return err
+	}
+	client, err := getStorageClient(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer ioutils.CloserFunc(client)
+
+	bucket := bucketHandle(client, opts)
+	attrs, err := bucket.Attrs(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get bucket metadata: %w", err)
+	}
+	lifecycle := storage.Lifecycle{Rules: append(attrs.Lifecycle.Rules, rule)}
+	_, err = bucket.If(storage.BucketConditions{MetagenerationMatch: attrs.MetaGeneration}).
+		Update(ctx, storage.BucketAttrsToUpdate{Lifecycle: &lifecycle})
+	if err != nil {
+		return fmt.Errorf("failed to update bucket lifecycle: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package gs
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestSelectForTransition(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-60 * 24 * time.Hour)
+	options := &StorageClassOptions{
+		MinAge: 30 * 24 * time.Hour,
+		Filter: func(attrs *storage.ObjectAttrs) bool {
+			return strings.HasSuffix(attrs.Name, ".log")
+		},
+	}
+
+	cases := []struct {
+		attrs *storage.ObjectAttrs
+		want  bool
+	}{
+		{&storage.ObjectAttrs{Name: "logs/a.log", StorageClass: StorageClassStandard, Created: old}, true},
+		{&storage.ObjectAttrs{Name: "logs/b.log", StorageClass: StorageClassColdline, Created: old}, false},
+		{&storage.ObjectAttrs{Name: "logs/c.log", StorageClass: StorageClassStandard, Created: now}, false},
+		{&storage.ObjectAttrs{Name: "logs/d.txt", StorageClass: StorageClassStandard, Created: old}, false},
+		{&storage.ObjectAttrs{Name: "logs/", StorageClass: StorageClassStandard, Created: old}, false},
+	}
+	for _, c := range cases {
+		if got := selectForTransition(c.attrs, StorageClassColdline, options, now); got != c.want {
+			t.Errorf("%s: expected %t, got %t", c.attrs.Name, c.want, got)
+		}
+	}
+}
+
+func TestSelectForTransition_NoCriteria(t *testing.T) {
+	attrs := &storage.ObjectAttrs{Name: "a.txt", StorageClass: StorageClassStandard, Created: time.Now()}
+	if !selectForTransition(attrs, StorageClassArchive, &StorageClassOptions{}, time.Now()) {
+		t.Error("expected object to be selected without criteria")
+	}
+}
+
+func TestStorageFS_SetStorageClass_EmptyClass(t *testing.T) {
+	fs := &StorageFS{}
+	u, _ := url.Parse("gs://my-bucket/data/")
+	if _, err := fs.SetStorageClass(context.Background(), u, "", nil); err == nil {
+		t.Fatal("expected error for empty storage class")
+	}
+}
+
+func TestStorageFile_SetStorageClass_EmptyClass(t *testing.T) {
+	f := &StorageFile{}
+	if err := f.SetStorageClass(""); err == nil {
+		t.Fatal("expected error for empty storage class")
+	}
+}
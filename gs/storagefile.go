@@ -25,26 +25,65 @@ type StorageFile struct {
 	writeBuffer *bytes.Buffer
 	offset      int64
 	contentType string
+	// transferOptions limits and reports the progress of reads and of the Close flush
+	transferOptions *TransferOptions
+	readTransfer    *transfer
 }
 
-// Read reads from the GCS object.
+// Read reads from the GCS object, through the filesystem cache when one is enabled.
 func (f *StorageFile) Read(b []byte) (n int, err error) {
+	if err := f.checkObject(); err != nil {
+		return 0, err
+	}
 	if f.reader == nil {
-		obj := f.client.Bucket(f.urlOpts.Bucket).Object(f.urlOpts.Key)
-		reader, readErr := obj.NewReader(context.Background())
-		if readErr != nil {
-			return 0, readErr
+		var reader io.ReadCloser
+		size := int64(-1)
+		// The filesystem bandwidth limit and the options of the read
+		limitFS, options := f.fs, f.transferOptions
+		if cache := f.fs.getCache(); cache != nil {
+			// Only the download into the cache is limited, cache hits are read at full speed
+			limits := f.fs.newTransfer(f.urlOpts.u.String(), -1, options.limitsOnly())
+			cached, cachedSize, contentType, readErr := cache.open(context.Background(), f.client, f.urlOpts, limits)
+			if readErr != nil {
+				return 0, readErr
+			}
+			reader = cached
+			size = cachedSize
+			f.contentType = contentType
+			limitFS, options = nil, options.progressOnly()
+		} else {
+			obj := bucketHandle(f.client, f.urlOpts).Object(f.urlOpts.Key)
+			objReader, readErr := obj.NewReader(context.Background())
+			if readErr != nil {
+				return 0, readErr
+			}
+			reader = objReader
+			size = objReader.Attrs.Size
+			f.contentType = objReader.Attrs.ContentType
+		}
+		f.readTransfer = limitFS.newTransfer(f.urlOpts.u.String(), size, options)
+		if f.readTransfer != nil {
+			reader = struct {
+				io.Reader
+				io.Closer
+			}{newTransferReader(context.Background(), reader, f.readTransfer), reader}
 		}
 		f.reader = reader
-		f.contentType = reader.Attrs.ContentType
 	}
 	n, err = f.reader.Read(b)
 	f.offset += int64(n)
+	if err == io.EOF && f.readTransfer != nil {
+		f.readTransfer.finish()
+		f.readTransfer = nil
+	}
 	return
 }
 
 // Write writes data to a buffer. The data is flushed to GCS on Close.
 func (f *StorageFile) Write(b []byte) (n int, err error) {
+	if err := f.checkObject(); err != nil {
+		return 0, err
+	}
 	if f.writeBuffer == nil {
 		f.writeBuffer = &bytes.Buffer{}
 	}
@@ -60,6 +99,7 @@ func (f *StorageFile) Seek(offset int64, whence int) (int64, error) {
 		if f.reader != nil {
 			_ = f.reader.Close()
 			f.reader = nil
+			f.readTransfer = nil
 		}
 		f.offset = 0
 		return 0, nil
@@ -76,16 +116,25 @@ func (f *StorageFile) Close() error {
 		if ct == "" {
 			ct = "application/octet-stream"
 		}
-		obj := f.client.Bucket(f.urlOpts.Bucket).Object(f.urlOpts.Key)
-		writer := obj.NewWriter(context.Background())
+		// The upload is not bounded by the operation timeout: it applies to every chunk.
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		writer := newObjectWriter(ctx, bucketHandle(f.client, f.urlOpts).Object(f.urlOpts.Key), f.urlOpts)
 		writer.ContentType = ct
-		_, writeErr := io.Copy(writer, f.writeBuffer)
+		t := f.fs.newTransfer(f.urlOpts.u.String(), int64(f.writeBuffer.Len()), f.transferOptions)
+		_, writeErr := io.Copy(writer, newTransferReader(ctx, f.writeBuffer, t))
 		if writeErr != nil {
 			_ = writer.Close()
 			return writeErr
 		}
 		err = writer.Close()
+		if err == nil && t != nil {
+			t.finish()
+		}
 		f.writeBuffer = nil
+		if cache := f.fs.getCache(); cache != nil {
+			cache.invalidate(f.urlOpts.Bucket, f.urlOpts.Key)
+		}
 	}
 	// Close reader
 	if f.reader != nil {
@@ -94,12 +143,16 @@ func (f *StorageFile) Close() error {
 			err = closeErr
 		}
 		f.reader = nil
+		f.readTransfer = nil
 	}
 	return err
 }
 
 // ListAll lists all objects under this GCS prefix.
 func (f *StorageFile) ListAll() (files []vfs.VFile, err error) {
+	if f.urlOpts.isRoot() {
+		return f.fs.listBuckets(context.Background(), f.client, f.urlOpts)
+	}
 	prefix := f.urlOpts.Key
 	if prefix != "" && !strings.HasSuffix(prefix, textutils.ForwardSlashStr) {
 		prefix = prefix + textutils.ForwardSlashStr
@@ -109,7 +162,7 @@ func (f *StorageFile) ListAll() (files []vfs.VFile, err error) {
 		Prefix: prefix,
 	}
 
-	it := f.client.Bucket(f.urlOpts.Bucket).Objects(context.Background(), query)
+	it := bucketHandle(f.client, f.urlOpts).Objects(context.Background(), query)
 	for {
 		attrs, iterErr := it.Next()
 		if iterErr == iterator.Done {
@@ -138,6 +191,7 @@ func (f *StorageFile) ListAll() (files []vfs.VFile, err error) {
 			u:      u,
 			Bucket: f.urlOpts.Bucket,
 			Key:    key,
+			retry:  f.urlOpts.retry,
 		})
 		files = append(files, child)
 	}
@@ -146,12 +200,23 @@ func (f *StorageFile) ListAll() (files []vfs.VFile, err error) {
 
 // Delete deletes the GCS object.
 func (f *StorageFile) Delete() error {
-	obj := f.client.Bucket(f.urlOpts.Bucket).Object(f.urlOpts.Key)
-	return obj.Delete(context.Background())
+	if err := f.checkObject(); err != nil {
+		return err
+	}
+	if cache := f.fs.getCache(); cache != nil {
+		cache.invalidate(f.urlOpts.Bucket, f.urlOpts.Key)
+	}
+	ctx, cancel := operationContext(f.urlOpts)
+	defer cancel()
+	obj := bucketHandle(f.client, f.urlOpts).Object(f.urlOpts.Key)
+	return obj.Delete(ctx)
 }
 
 // DeleteAll deletes all objects under this prefix (for directory-like objects).
 func (f *StorageFile) DeleteAll() error {
+	if f.urlOpts.isRoot() {
+		return errRootReadOnly
+	}
 	children, err := f.ListAll()
 	if err != nil {
 		return err
@@ -175,14 +240,26 @@ func (f *StorageFile) DeleteAll() error {
 			}
 		}
 	}
+	// A bucket root has no prefix marker to delete
+	if f.urlOpts.Key == "" {
+		return nil
+	}
 	// Delete the prefix marker itself
 	return f.Delete()
 }
 
 // Info returns the VFileInfo for this GCS object.
 func (f *StorageFile) Info() (vfs.VFileInfo, error) {
+	// The gs:// root and bucket roots are directories named after the bucket
+	if f.urlOpts.Key == "" {
+		return &StorageFileInfo{
+			fs:    f.fs,
+			isDir: true,
+			key:   f.urlOpts.Bucket,
+		}, nil
+	}
 	// Check if this is a "directory" (prefix ending with /)
-	if strings.HasSuffix(f.urlOpts.Key, textutils.ForwardSlashStr) || f.urlOpts.Key == "" {
+	if strings.HasSuffix(f.urlOpts.Key, textutils.ForwardSlashStr) {
 		return &StorageFileInfo{
 			fs:    f.fs,
 			isDir: true,
@@ -190,14 +267,16 @@ func (f *StorageFile) Info() (vfs.VFileInfo, error) {
 		}, nil
 	}
 
-	obj := f.client.Bucket(f.urlOpts.Bucket).Object(f.urlOpts.Key)
-	attrs, err := obj.Attrs(context.Background())
+	ctx, cancel := operationContext(f.urlOpts)
+	defer cancel()
+	obj := bucketHandle(f.client, f.urlOpts).Object(f.urlOpts.Key)
+	attrs, err := obj.Attrs(ctx)
 	if err != nil {
 		// If Attrs fails, check if it's a prefix (directory)
 		query := &storage.Query{
 			Prefix: f.urlOpts.Key + textutils.ForwardSlashStr,
 		}
-		it := f.client.Bucket(f.urlOpts.Bucket).Objects(context.Background(), query)
+		it := bucketHandle(f.client, f.urlOpts).Objects(ctx, query)
 		_, iterErr := it.Next()
 		if iterErr == nil {
 			return &StorageFileInfo{
@@ -221,6 +300,10 @@ func (f *StorageFile) Info() (vfs.VFileInfo, error) {
 
 // Parent returns the parent directory of this file.
 func (f *StorageFile) Parent() (vfs.VFile, error) {
+	// The parent of a bucket is the gs:// root, which is its own parent
+	if f.urlOpts.Key == "" {
+		return f.fs.Open(&url.URL{Scheme: GsScheme, Path: "/"})
+	}
 	key := strings.TrimSuffix(f.urlOpts.Key, textutils.ForwardSlashStr)
 	idx := strings.LastIndex(key, textutils.ForwardSlashStr)
 	parentKey := ""
@@ -248,37 +331,29 @@ func (f *StorageFile) ContentType() string {
 	return "application/octet-stream"
 }
 
-// AddProperty adds metadata to the GCS object.
+// AddProperty adds metadata to the GCS object. The update is conditioned on the
+// metageneration read before it, so it fails instead of overwriting a concurrent
+// metadata change.
 func (f *StorageFile) AddProperty(name, value string) error {
-	ctx := context.Background()
-	obj := f.client.Bucket(f.urlOpts.Bucket).Object(f.urlOpts.Key)
-
-	// Get current metadata
-	attrs, err := obj.Attrs(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to get object metadata: %w", err)
-	}
-
-	metadata := attrs.Metadata
-	if metadata == nil {
-		metadata = make(map[string]string)
+	if err := f.checkObject(); err != nil {
+		return err
 	}
-	metadata[name] = value
-
-	// Update the object metadata
-	_, err = obj.Update(ctx, storage.ObjectAttrsToUpdate{Metadata: metadata})
-	if err != nil {
-		return fmt.Errorf("failed to update object metadata: %w", err)
+	if err := f.updateMetadataIfUnchanged(&MetadataUpdate{Set: map[string]string{name: value}}); err != nil {
+		return err
 	}
-
 	logger.InfoF("Added metadata %q=%q to gs://%s/%s", name, value, f.urlOpts.Bucket, f.urlOpts.Key)
 	return nil
 }
 
 // GetProperty retrieves a metadata value from the GCS object.
 func (f *StorageFile) GetProperty(name string) (string, error) {
-	obj := f.client.Bucket(f.urlOpts.Bucket).Object(f.urlOpts.Key)
-	attrs, err := obj.Attrs(context.Background())
+	if err := f.checkObject(); err != nil {
+		return "", err
+	}
+	ctx, cancel := operationContext(f.urlOpts)
+	defer cancel()
+	obj := bucketHandle(f.client, f.urlOpts).Object(f.urlOpts.Key)
+	attrs, err := obj.Attrs(ctx)
 	if err != nil {
 		return "", fmt.Errorf("failed to get object metadata: %w", err)
 	}
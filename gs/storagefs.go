@@ -5,8 +5,12 @@ import (
 	"fmt"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"cloud.google.com/go/storage"
+	"golang.org/x/time/rate"
 	"google.golang.org/api/iterator"
 	"oss.nandlabs.io/golly/textutils"
 	"oss.nandlabs.io/golly/vfs"
@@ -17,6 +21,18 @@ var fsSchemes = []string{GsScheme}
 // StorageFS implements the vfs.VFileSystem interface for Google Cloud Storage.
 type StorageFS struct {
 	*vfs.BaseVFS
+	cache      atomic.Pointer[objectCache]
+	dirMarkers atomic.Int32
+	bandwidth  atomic.Pointer[rate.Limiter]
+	// rawServices holds the JSON API client of each gcpsvc config, see rawService.
+	rawServices sync.Map
+}
+
+// NewStorageFS creates a new StorageFS ready to be used directly or registered with the VFS manager.
+func NewStorageFS() *StorageFS {
+	storageFs := &StorageFS{}
+	storageFs.BaseVFS = &vfs.BaseVFS{VFileSystem: storageFs}
+	return storageFs
 }
 
 // Schemes returns the URL schemes supported by this filesystem.
@@ -24,89 +40,76 @@ func (fs *StorageFS) Schemes() []string {
 	return fsSchemes
 }
 
-// Create creates a new empty object at the given GCS URL.
-func (fs *StorageFS) Create(u *url.URL) (vfs.VFile, error) {
-	opts, err := parseURL(u)
-	if err != nil {
-		return nil, err
-	}
-
-	client, err := getStorageClient(opts)
-	if err != nil {
-		return nil, err
-	}
-
-	bucket := client.Bucket(opts.Bucket)
-	object := bucket.Object(opts.Key)
-
-	// Check if object already exists
-	_, attrErr := object.Attrs(context.Background())
-	if attrErr == nil {
-		return nil, fmt.Errorf("file gs://%s/%s already exists", opts.Bucket, opts.Key)
+// SetCache enables a disk-backed read-through cache for objects opened through this
+// filesystem. Passing nil disables the cache. The content of a replaced cache is removed.
+func (fs *StorageFS) SetCache(options *CacheOptions) error {
+	var cache *objectCache
+	if options != nil {
+		var err error
+		if cache, err = newObjectCache(options); err != nil {
+			return err
+		}
 	}
-
-	// Create empty object
-	writer := object.NewWriter(context.Background())
-	if err = writer.Close(); err != nil {
-		return nil, err
+	if previous := fs.cache.Swap(cache); previous != nil {
+		previous.close()
 	}
-
-	return newStorageFile(client, fs, opts), nil
+	return nil
 }
 
-// Mkdir creates a directory marker (key ending with /) in GCS.
-func (fs *StorageFS) Mkdir(u *url.URL) (vfs.VFile, error) {
-	return fs.MkdirAll(u)
+// getCache returns the active object cache, or nil if caching is disabled.
+func (fs *StorageFS) getCache() *objectCache {
+	if fs == nil {
+		return nil
+	}
+	return fs.cache.Load()
 }
 
-// MkdirAll creates a directory marker in GCS. Since GCS has no real directories,
-// this creates a zero-byte object with a trailing slash.
-func (fs *StorageFS) MkdirAll(u *url.URL) (vfs.VFile, error) {
+// Create creates a new empty object at the given GCS URL.
+func (fs *StorageFS) Create(u *url.URL) (vfs.VFile, error) {
 	opts, err := parseURL(u)
 	if err != nil {
 		return nil, err
 	}
 
-	client, err := getStorageClient(opts)
+	client, err := getStorageClient(context.Background(), opts)
 	if err != nil {
 		return nil, err
 	}
 
-	key := opts.Key
-	if !strings.HasSuffix(key, textutils.ForwardSlashStr) {
-		key = key + textutils.ForwardSlashStr
-	}
-
-	bucket := client.Bucket(opts.Bucket)
-	object := bucket.Object(key)
+	ctx, cancel := operationContext(opts)
+	defer cancel()
 
-	writer := object.NewWriter(context.Background())
-	if err = writer.Close(); err != nil {
+	// Check if the path already exists as a file or directory
+	d := fs.newDirOps(client, opts)
+	defer d.close()
+	kind, err := d.kind(ctx, strings.TrimSuffix(opts.Key, textutils.ForwardSlashStr))
+	if err != nil {
 		return nil, err
 	}
+	switch kind {
+	case pathFile:
+		return nil, fmt.Errorf("file gs://%s/%s already exists", opts.Bucket, opts.Key)
+	case pathDir:
+		return nil, fmt.Errorf("create gs://%s/%s: %w", opts.Bucket, opts.Key, ErrIsDirectory)
+	}
 
-	// Update opts with directory key
-	dirOpts := &urlOpts{
-		u: &url.URL{
-			Scheme: GsScheme,
-			Host:   opts.Bucket,
-			Path:   "/" + key,
-		},
-		Bucket: opts.Bucket,
-		Key:    key,
+	// Create empty object
+	writer := d.bucket.Object(opts.Key).NewWriter(ctx)
+	if err = writer.Close(); err != nil {
+		return nil, err
 	}
 
-	return newStorageFile(client, fs, dirOpts), nil
+	return newStorageFile(client, fs, opts), nil
 }
 
 // Open opens a GCS object at the given URL. It does not validate existence.
 func (fs *StorageFS) Open(u *url.URL) (vfs.VFile, error) {
-	opts, err := parseURL(u)
+	opts, err := parseLocation(u)
 	if err != nil {
 		return nil, err
 	}
 
-	client, err := getStorageClient(opts)
+	client, err := getStorageClient(context.Background(), opts)
 	if err != nil {
 		return nil, err
 	}
@@ -127,6 +130,13 @@ func newStorageFile(client *storage.Client, fs *StorageFS, opts *urlOpts) *Stora
 
 // Copy copies a GCS object from src to dst. If src is a directory, copies all children recursively.
 func (fs *StorageFS) Copy(src, dst *url.URL) error {
+	return fs.CopyWithOptions(context.Background(), src, dst, nil)
+}
+
+// CopyWithOptions copies like Copy and reports the progress of every copied object to
+// options. Copies are performed server-side and do not use the client's bandwidth, so
+// rate limits do not apply to them.
+func (fs *StorageFS) CopyWithOptions(ctx context.Context, src, dst *url.URL, options *TransferOptions) error {
 	srcOpts, err := parseURL(src)
 	if err != nil {
 		return err
@@ -137,7 +147,7 @@ func (fs *StorageFS) Copy(src, dst *url.URL) error {
 		return err
 	}
 
-	client, err := getStorageClient(srcOpts)
+	client, err := getStorageClient(ctx, srcOpts)
 	if err != nil {
 		return err
 	}
@@ -147,11 +157,11 @@ func (fs *StorageFS) Copy(src, dst *url.URL) error {
 	srcInfo, err := srcFile.Info()
 	if err != nil {
 		// Not a directory, copy single object
-		return fs.copySingleObject(client, srcOpts, dstOpts)
+		return fs.copySingleObject(ctx, client, srcOpts, dstOpts, options)
 	}
 
 	if !srcInfo.IsDir() {
-		return fs.copySingleObject(client, srcOpts, dstOpts)
+		return fs.copySingleObject(ctx, client, srcOpts, dstOpts, options)
 	}
 
 	// Copy all children
@@ -176,13 +186,13 @@ func (fs *StorageFS) Copy(src, dst *url.URL) error {
 		}
 
 		if childInfo.IsDir() {
-			if copyErr := fs.Copy(child.Url(), childDstURL); copyErr != nil {
+			if copyErr := fs.CopyWithOptions(ctx, child.Url(), childDstURL, options); copyErr != nil {
 				return copyErr
 			}
 		} else {
 			childSrcOpts := &urlOpts{u: child.Url(), Bucket: srcOpts.Bucket, Key: childKey}
 			childDstOpts := &urlOpts{u: childDstURL, Bucket: dstOpts.Bucket, Key: dstKey}
-			if copyErr := fs.copySingleObject(client, childSrcOpts, childDstOpts); copyErr != nil {
+			if copyErr := fs.copySingleObject(ctx, client, childSrcOpts, childDstOpts, options); copyErr != nil {
 				return copyErr
 			}
 		}
@@ -192,11 +202,26 @@ func (fs *StorageFS) Copy(src, dst *url.URL) error {
 }
 
 // copySingleObject copies a single GCS object using server-side copy.
-func (fs *StorageFS) copySingleObject(client *storage.Client, src, dst *urlOpts) error {
-	srcObj := client.Bucket(src.Bucket).Object(src.Key)
-	dstObj := client.Bucket(dst.Bucket).Object(dst.Key)
-
-	_, err := dstObj.CopierFrom(srcObj).Run(context.Background())
+func (fs *StorageFS) copySingleObject(ctx context.Context, client *storage.Client, src, dst *urlOpts, options *TransferOptions) error {
+	srcObj := bucketHandle(client, src).Object(src.Key)
+	dstObj := bucketHandle(client, dst).Object(dst.Key)
+
+	ctx, cancel := timeoutContext(ctx, dst)
+	defer cancel()
+	copier := dstObj.CopierFrom(srcObj)
+	// Server-side copies are only reported, never throttled.
+	var t *transfer
+	if options != nil && (options.Progress != nil || options.ProgressChan != nil) {
+		t = &transfer{name: dst.u.String(), total: -1, options: options, start: time.Now()}
+		copier.ProgressFunc = func(copied, total uint64) {
+			t.update(int64(copied), int64(total))
+		}
+	}
+	attrs, err := copier.Run(ctx)
+	if err == nil && t != nil {
+		t.update(attrs.Size, attrs.Size)
+		t.finish()
+	}
 	return err
 }
 
@@ -207,7 +232,7 @@ func (fs *StorageFS) Delete(src *url.URL) error {
 		return err
 	}
 
-	client, err := getStorageClient(srcOpts)
+	client, err := getStorageClient(context.Background(), srcOpts)
 	if err != nil {
 		return err
 	}
@@ -224,15 +249,18 @@ func (fs *StorageFS) Delete(src *url.URL) error {
 
 // List lists all direct children of the given GCS prefix.
 func (fs *StorageFS) List(u *url.URL) ([]vfs.VFile, error) {
-	opts, err := parseURL(u)
+	opts, err := parseLocation(u)
 	if err != nil {
 		return nil, err
 	}
 
-	client, err := getStorageClient(opts)
+	client, err := getStorageClient(context.Background(), opts)
 	if err != nil {
 		return nil, err
 	}
+	if opts.isRoot() {
+		return fs.listBuckets(context.Background(), client, opts)
+	}
 
 	prefix := opts.Key
 	if prefix != "" && !strings.HasSuffix(prefix, textutils.ForwardSlashStr) {
@@ -245,7 +273,7 @@ func (fs *StorageFS) List(u *url.URL) ([]vfs.VFile, error) {
 	}
 
 	var files []vfs.VFile
-	it := client.Bucket(opts.Bucket).Objects(context.Background(), query)
+	it := bucketHandle(client, opts).Objects(context.Background(), query)
 	for {
 		attrs, iterErr := it.Next()
 		if iterErr == iterator.Done {
@@ -282,12 +310,15 @@ func (fs *StorageFS) List(u *url.URL) ([]vfs.VFile, error) {
 
 // Walk traverses the GCS prefix tree recursively, calling fn for each file.
 func (fs *StorageFS) Walk(u *url.URL, fn vfs.WalkFn) error {
-	opts, err := parseURL(u)
+	opts, err := parseLocation(u)
 	if err != nil {
 		return err
 	}
+	if opts.isRoot() {
+		return fs.walkRoot(opts, fn)
+	}
 
-	client, err := getStorageClient(opts)
+	client, err := getStorageClient(context.Background(), opts)
 	if err != nil {
 		return err
 	}
@@ -301,7 +332,7 @@ func (fs *StorageFS) Walk(u *url.URL, fn vfs.WalkFn) error {
 		Prefix: prefix,
 	}
 
-	it := client.Bucket(opts.Bucket).Objects(context.Background(), query)
+	it := bucketHandle(client, opts).Objects(context.Background(), query)
 	for {
 		attrs, iterErr := it.Next()
 		if iterErr == iterator.Done {
@@ -334,12 +365,10 @@ func (fs *StorageFS) Walk(u *url.URL, fn vfs.WalkFn) error {
 	return nil
 }
 
-// Move moves a GCS object from src to dst (copy + delete).
+// Move moves a GCS object or prefix from src to dst, atomically per object within a bucket.
+// See MoveWithOptions.
 func (fs *StorageFS) Move(src, dst *url.URL) error {
-	if err := fs.Copy(src, dst); err != nil {
-		return err
-	}
-	return fs.Delete(src)
+	return fs.MoveWithOptions(context.Background(), src, dst, nil)
 }
 
 // Find finds files under the given location that match the filter.
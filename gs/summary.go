@@ -0,0 +1,378 @@
+package gs
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+	"oss.nandlabs.io/golly/ioutils"
+	"oss.nandlabs.io/golly/textutils"
+)
+
+// InventoryFormat identifies the file format of an inventory exported by Summarize.
+type InventoryFormat int
+
+const (
+	// InventoryAuto detects the format from the inventory object key extension.
+	InventoryAuto InventoryFormat = iota
+	// InventoryCSV writes a CSV file with a header row.
+	InventoryCSV
+	// InventoryJSON writes newline-delimited JSON, one object per line.
+	InventoryJSON
+)
+
+// defaultSummarizeConcurrency is the default number of sub-prefixes listed in parallel.
+const defaultSummarizeConcurrency = 8
+
+// inventoryColumns are the columns of an exported inventory.
+var inventoryColumns = []string{"bucket", "name", "size", "storage_class", "content_type", "created", "updated", "generation"}
+
+// UsageStats aggregates the object count and total size of a group of objects.
+type UsageStats struct {
+	Objects int64 `json:"objects"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// ObjectSummary identifies a single object in a Summary.
+type ObjectSummary struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+}
+
+// Summary reports the disk usage and composition of a GCS prefix.
+type Summary struct {
+	Bucket string `json:"bucket"`
+	Prefix string `json:"prefix"`
+	UsageStats
+	// ByStorageClass breaks the totals down by storage class.
+	ByStorageClass map[string]UsageStats `json:"byStorageClass"`
+	// BySubPrefix breaks the totals down by direct sub-prefix (e.g. "logs/").
+	// Objects stored directly under the prefix are reported under the empty key.
+	BySubPrefix map[string]UsageStats `json:"bySubPrefix"`
+	// Oldest and Newest are the objects with the earliest and latest creation time.
+	// Both are nil for an empty prefix.
+	Oldest *ObjectSummary `json:"oldest,omitempty"`
+	Newest *ObjectSummary `json:"newest,omitempty"`
+}
+
+// SummarizeOptions configures Summarize. A nil *SummarizeOptions uses the defaults.
+type SummarizeOptions struct {
+	// Concurrency is the number of sub-prefixes listed in parallel. Default: 8.
+	Concurrency int
+	// Inventory is an optional gs:// URL where a listing of every object is exported.
+	Inventory *url.URL
+	// InventoryFormat of the exported inventory. Defaults to detection from the
+	// Inventory key extension (.csv, .json, .jsonl, .ndjson).
+	InventoryFormat InventoryFormat
+}
+
+// Summarize computes the total size and object count of the given GCS prefix with breakdowns
+// by storage class and direct sub-prefix, and the oldest and newest objects. Sub-prefixes are
+// listed in parallel. Directory markers are not counted.
+//
+// If options.Inventory is set, a CSV or JSON listing of every counted object is streamed to
+// that object. Inventory rows are written in listing completion order, not sorted.
+func (fs *StorageFS) Summarize(ctx context.Context, u *url.URL, options *SummarizeOptions) (*Summary, error) {
+	if options == nil {
+		options = &SummarizeOptions{}
+	}
+	opts, err := parseURL(u)
+	if err != nil {
+		return nil, err
+	}
+
+	var invOpts *urlOpts
+	format := options.InventoryFormat
+	if options.Inventory != nil {
+		if invOpts, err = parseURL(options.Inventory); err != nil {
+			return nil, err
+		}
+		if format, err = resolveInventoryFormat(format, invOpts.Key); err != nil {
+			return nil, err
+		}
+	}
+
+	client, err := getStorageClient(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer ioutils.CloserFunc(client)
+
+	prefix := opts.Key
+	if prefix != "" && !strings.HasSuffix(prefix, textutils.ForwardSlashStr) {
+		prefix = prefix + textutils.ForwardSlashStr
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	s := &summarizer{
+		ctx:    ctx,
+		cancel: cancel,
+		bucket: bucketHandle(client, opts),
+		summary: &Summary{
+			Bucket:         opts.Bucket,
+			Prefix:         prefix,
+			ByStorageClass: make(map[string]UsageStats),
+			BySubPrefix:    make(map[string]UsageStats),
+		},
+	}
+
+	var invDone chan error
+	var invWriter *storage.Writer
+	if invOpts != nil {
+		invWriter = newObjectWriter(ctx, bucketHandle(client, invOpts).Object(invOpts.Key), invOpts)
+		if format == InventoryCSV {
+			invWriter.ContentType = "text/csv"
+		} else {
+			invWriter.ContentType = "application/x-ndjson"
+		}
+		s.rows = make(chan *storage.ObjectAttrs, 256)
+		invDone = make(chan error, 1)
+		go func() {
+			invDone <- writeInventory(invWriter, format, s.rows)
+		}()
+	}
+
+	concurrency := options.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultSummarizeConcurrency
+	}
+	err = s.run(prefix, concurrency)
+
+	if invOpts != nil {
+		close(s.rows)
+		invErr := <-invDone
+		if err == nil {
+			err = invErr
+		}
+		if err != nil {
+			cancel()
+			_ = invWriter.Close()
+		} else if err = invWriter.Close(); err != nil {
+			err = fmt.Errorf("failed to write inventory: %w", err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.summary, nil
+}
+
+// summarizer accumulates a Summary from concurrent listings.
+type summarizer struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	bucket  *storage.BucketHandle
+	rows    chan *storage.ObjectAttrs
+	mu      sync.Mutex
+	summary *Summary
+	err     error
+}
+
+// run lists the direct children of prefix and then every sub-prefix in parallel.
+func (s *summarizer) run(prefix string, concurrency int) error {
+	query := &storage.Query{Prefix: prefix, Delimiter: textutils.ForwardSlashStr}
+	var subPrefixes []string
+	err := s.list(query, func(attrs *storage.ObjectAttrs) {
+		if attrs.Prefix != "" {
+			subPrefixes = append(subPrefixes, attrs.Prefix)
+			return
+		}
+		s.add("", attrs)
+	})
+	if err != nil {
+		return err
+	}
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, sub := range subPrefixes {
+		select {
+		case sem <- struct{}{}:
+		case <-s.ctx.Done():
+		}
+		if s.ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(sub string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			name := strings.TrimPrefix(sub, prefix)
+			if listErr := s.list(&storage.Query{Prefix: sub}, func(attrs *storage.ObjectAttrs) {
+				s.add(name, attrs)
+			}); listErr != nil {
+				s.fail(listErr)
+			}
+		}(sub)
+	}
+	wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil && s.ctx.Err() != nil {
+		s.err = s.ctx.Err()
+	}
+	return s.err
+}
+
+// list iterates over query results, calling fn for every entry.
+func (s *summarizer) list(query *storage.Query, fn func(attrs *storage.ObjectAttrs)) error {
+	if err := query.SetAttrSelection([]string{"Bucket", "Name", "Size", "StorageClass", "ContentType", "Created", "Updated", "Generation"}); err != nil {
+		return err
+	}
+	it := s.bucket.Objects(s.ctx, query)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fn(attrs)
+	}
+}
+
+// add counts an object towards the summary and forwards it to the inventory, if any.
+func (s *summarizer) add(subPrefix string, attrs *storage.ObjectAttrs) {
+	if strings.HasSuffix(attrs.Name, textutils.ForwardSlashStr) {
+		return
+	}
+
+	s.mu.Lock()
+	sum := s.summary
+	sum.Objects++
+	sum.Bytes += attrs.Size
+	sum.ByStorageClass[attrs.StorageClass] = sum.ByStorageClass[attrs.StorageClass].add(attrs.Size)
+	sum.BySubPrefix[subPrefix] = sum.BySubPrefix[subPrefix].add(attrs.Size)
+	if sum.Oldest == nil || attrs.Created.Before(sum.Oldest.Created) {
+		sum.Oldest = &ObjectSummary{Name: attrs.Name, Size: attrs.Size, Created: attrs.Created}
+	}
+	if sum.Newest == nil || attrs.Created.After(sum.Newest.Created) {
+		sum.Newest = &ObjectSummary{Name: attrs.Name, Size: attrs.Size, Created: attrs.Created}
+	}
+	s.mu.Unlock()
+
+	if s.rows != nil {
+		select {
+		case s.rows <- attrs:
+		case <-s.ctx.Done():
+		}
+	}
+}
+
+// fail records the first error and stops the remaining listings.
+func (s *summarizer) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+		s.cancel()
+	}
+}
+
+// add returns the stats with one more object of the given size.
+func (u UsageStats) add(size int64) UsageStats {
+	u.Objects++
+	u.Bytes += size
+	return u
+}
+
+// resolveInventoryFormat returns format, or the format matching the key extension for InventoryAuto.
+func resolveInventoryFormat(format InventoryFormat, key string) (InventoryFormat, error) {
+	if format != InventoryAuto {
+		return format, nil
+	}
+	lower := strings.ToLower(key)
+	switch {
+	case strings.HasSuffix(lower, ".csv"):
+		return InventoryCSV, nil
+	case strings.HasSuffix(lower, ".json"), strings.HasSuffix(lower, ".jsonl"), strings.HasSuffix(lower, ".ndjson"):
+		return InventoryJSON, nil
+	}
+	return InventoryAuto, fmt.Errorf("cannot detect inventory format of %q", key)
+}
+
+// inventoryRow is a single object in an exported inventory.
+type inventoryRow struct {
+	Bucket       string    `json:"bucket"`
+	Name         string    `json:"name"`
+	Size         int64     `json:"size"`
+	StorageClass string    `json:"storage_class"`
+	ContentType  string    `json:"content_type"`
+	Created      time.Time `json:"created"`
+	Updated      time.Time `json:"updated"`
+	Generation   int64     `json:"generation"`
+}
+
+// newInventoryRow returns the inventory row of an object.
+func newInventoryRow(attrs *storage.ObjectAttrs) *inventoryRow {
+	return &inventoryRow{
+		Bucket:       attrs.Bucket,
+		Name:         attrs.Name,
+		Size:         attrs.Size,
+		StorageClass: attrs.StorageClass,
+		ContentType:  attrs.ContentType,
+		Created:      attrs.Created.UTC(),
+		Updated:      attrs.Updated.UTC(),
+		Generation:   attrs.Generation,
+	}
+}
+
+// record returns the row as CSV fields in inventoryColumns order.
+func (r *inventoryRow) record() []string {
+	return []string{
+		r.Bucket,
+		r.Name,
+		strconv.FormatInt(r.Size, 10),
+		r.StorageClass,
+		r.ContentType,
+		r.Created.Format(time.RFC3339),
+		r.Updated.Format(time.RFC3339),
+		strconv.FormatInt(r.Generation, 10),
+	}
+}
+
+// writeInventory writes every received object as a CSV row or JSON line. It keeps draining
+// rows after a write error so that producers are never blocked.
+func writeInventory(w io.Writer, format InventoryFormat, rows <-chan *storage.ObjectAttrs) error {
+	var err error
+	var cw *csv.Writer
+	var enc *json.Encoder
+	if format == InventoryCSV {
+		cw = csv.NewWriter(w)
+		err = cw.Write(inventoryColumns)
+	} else {
+		enc = json.NewEncoder(w)
+	}
+
+	for attrs := range rows {
+		if err != nil {
+			continue
+		}
+		row := newInventoryRow(attrs)
+		if cw != nil {
+			err = cw.Write(row.record())
+		} else {
+			err = enc.Encode(row)
+		}
+	}
+
+	if cw != nil && err == nil {
+		cw.Flush()
+		err = cw.Error()
+	}
+	return err
+}
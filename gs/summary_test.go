@@ -0,0 +1,110 @@
+package gs
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+func newTestSummarizer() *summarizer {
+	return &summarizer{
+		summary: &Summary{
+			ByStorageClass: make(map[string]UsageStats),
+			BySubPrefix:    make(map[string]UsageStats),
+		},
+	}
+}
+
+func TestSummarizer_Add(t *testing.T) {
+	s := newTestSummarizer()
+	now := time.Now()
+	s.add("", &storage.ObjectAttrs{Name: "data/a.txt", Size: 10, StorageClass: "STANDARD", Created: now})
+	s.add("logs/", &storage.ObjectAttrs{Name: "data/logs/b.log", Size: 20, StorageClass: "NEARLINE", Created: now.Add(-time.Hour)})
+	s.add("logs/", &storage.ObjectAttrs{Name: "data/logs/c.log", Size: 30, StorageClass: "NEARLINE", Created: now.Add(time.Hour)})
+	s.add("logs/", &storage.ObjectAttrs{Name: "data/logs/", StorageClass: "STANDARD", Created: now})
+
+	sum := s.summary
+	if sum.Objects != 3 || sum.Bytes != 60 {
+		t.Errorf("expected 3 objects / 60 bytes, got %d / %d", sum.Objects, sum.Bytes)
+	}
+	if got := sum.ByStorageClass["NEARLINE"]; got.Objects != 2 || got.Bytes != 50 {
+		t.Errorf("unexpected NEARLINE stats: %+v", got)
+	}
+	if got := sum.BySubPrefix[""]; got.Objects != 1 || got.Bytes != 10 {
+		t.Errorf("unexpected direct object stats: %+v", got)
+	}
+	if got := sum.BySubPrefix["logs/"]; got.Objects != 2 || got.Bytes != 50 {
+		t.Errorf("unexpected logs/ stats: %+v", got)
+	}
+	if sum.Oldest == nil || sum.Oldest.Name != "data/logs/b.log" {
+		t.Errorf("unexpected oldest object: %+v", sum.Oldest)
+	}
+	if sum.Newest == nil || sum.Newest.Name != "data/logs/c.log" {
+		t.Errorf("unexpected newest object: %+v", sum.Newest)
+	}
+}
+
+func TestResolveInventoryFormat(t *testing.T) {
+	cases := map[string]InventoryFormat{
+		"inventory.csv":    InventoryCSV,
+		"inventory.json":   InventoryJSON,
+		"inventory.NDJSON": InventoryJSON,
+	}
+	for key, want := range cases {
+		if got, err := resolveInventoryFormat(InventoryAuto, key); err != nil || got != want {
+			t.Errorf("%s: expected %d, got %d (%v)", key, want, got, err)
+		}
+	}
+	if _, err := resolveInventoryFormat(InventoryAuto, "inventory.txt"); err == nil {
+		t.Error("expected error for unknown extension")
+	}
+}
+
+func TestWriteInventory_CSV(t *testing.T) {
+	rows := make(chan *storage.ObjectAttrs, 1)
+	rows <- &storage.ObjectAttrs{Bucket: "b", Name: "a.txt", Size: 5, StorageClass: "STANDARD"}
+	close(rows)
+
+	var buf bytes.Buffer
+	if err := writeInventory(&buf, InventoryCSV, rows); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(records) != 2 || len(records[1]) != len(inventoryColumns) {
+		t.Fatalf("expected header and one row, got %v", records)
+	}
+	if records[1][1] != "a.txt" || records[1][2] != "5" {
+		t.Errorf("unexpected row: %v", records[1])
+	}
+}
+
+func TestWriteInventory_JSON(t *testing.T) {
+	rows := make(chan *storage.ObjectAttrs, 2)
+	rows <- &storage.ObjectAttrs{Bucket: "b", Name: "a.txt", Size: 5}
+	rows <- &storage.ObjectAttrs{Bucket: "b", Name: "b.txt", Size: 7}
+	close(rows)
+
+	var buf bytes.Buffer
+	if err := writeInventory(&buf, InventoryJSON, rows); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	dec := json.NewDecoder(&buf)
+	count := 0
+	for dec.More() {
+		row := &inventoryRow{}
+		if err := dec.Decode(row); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		count++
+	}
+	if count != 2 {
+		t.Errorf("expected 2 JSON lines, got %d", count)
+	}
+}
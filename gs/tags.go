@@ -0,0 +1,270 @@
+package gs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"oss.nandlabs.io/golly/ioutils"
+	"oss.nandlabs.io/golly/textutils"
+	"oss.nandlabs.io/golly/vfs"
+)
+
+// ObjectTag is a structured key/value context attached to an object. Unlike custom
+// metadata, object contexts can be filtered on when listing a bucket.
+type ObjectTag struct {
+	// Key is the context key.
+	Key string
+	// Value is the context value.
+	Value string
+	// CreateTime is when the context was first set. Set by the server.
+	CreateTime time.Time
+	// UpdateTime is when the context value last changed. Set by the server.
+	UpdateTime time.Time
+}
+
+// TagFilter selects objects by their tags. All conditions must hold. The equality and
+// presence conditions are evaluated by GCS where possible, and always verified client-side.
+type TagFilter struct {
+	// Equals requires each key to be set to the given value.
+	Equals map[string]string
+	// NotEquals requires each key to be unset or set to a different value.
+	NotEquals map[string]string
+	// Exists requires each key to be set.
+	Exists []string
+	// NotExists requires each key to be unset.
+	NotExists []string
+	// Match is an optional client-side predicate over the tag values of an object.
+	Match func(tags map[string]string) bool
+}
+
+// Tags returns the tags of the object, keyed by tag key.
+func (f *StorageFile) Tags() (map[string]ObjectTag, error) {
+	if err := f.checkObject(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := operationContext(f.urlOpts)
+	defer cancel()
+	attrs, err := bucketHandle(f.client, f.urlOpts).Object(f.urlOpts.Key).Attrs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object tags: %w", err)
+	}
+	tags := make(map[string]ObjectTag)
+	if attrs.Contexts != nil {
+		for k, payload := range attrs.Contexts.Custom {
+			tags[k] = ObjectTag{Key: k, Value: payload.Value, CreateTime: payload.CreateTime, UpdateTime: payload.UpdateTime}
+		}
+	}
+	return tags, nil
+}
+
+// GetTag returns the value of a tag of the object.
+func (f *StorageFile) GetTag(key string) (string, error) {
+	tags, err := f.Tags()
+	if err != nil {
+		return "", err
+	}
+	if tag, ok := tags[key]; ok {
+		return tag.Value, nil
+	}
+	return "", fmt.Errorf("tag %q not found", key)
+}
+
+// SetTags adds or replaces tags of the object. Tags not named in tags are kept.
+func (f *StorageFile) SetTags(tags map[string]string) error {
+	if err := f.checkObject(); err != nil {
+		return err
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	custom := make(map[string]storage.ObjectCustomContextPayload, len(tags))
+	for k, v := range tags {
+		if k == "" {
+			return errors.New("tag key cannot be empty")
+		}
+		custom[k] = storage.ObjectCustomContextPayload{Value: v}
+	}
+	return f.updateTags(custom)
+}
+
+// RemoveTags removes tags from the object. Removing a tag that is not set is not an error.
+func (f *StorageFile) RemoveTags(keys ...string) error {
+	if err := f.checkObject(); err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	custom := make(map[string]storage.ObjectCustomContextPayload, len(keys))
+	for _, k := range keys {
+		custom[k] = storage.ObjectCustomContextPayload{Delete: true}
+	}
+	return f.updateTags(custom)
+}
+
+// ClearTags removes all tags from the object.
+func (f *StorageFile) ClearTags() error {
+	if err := f.checkObject(); err != nil {
+		return err
+	}
+	return f.updateTags(map[string]storage.ObjectCustomContextPayload{})
+}
+
+// updateTags applies a contexts update to the object.
+func (f *StorageFile) updateTags(custom map[string]storage.ObjectCustomContextPayload) error {
+	ctx, cancel := operationContext(f.urlOpts)
+	defer cancel()
+	obj := bucketHandle(f.client, f.urlOpts).Object(f.urlOpts.Key)
+	if _, err := obj.Update(ctx, storage.ObjectAttrsToUpdate{Contexts: &storage.ObjectContexts{Custom: custom}}); err != nil {
+		return fmt.Errorf("failed to update tags of gs://%s/%s: %w", f.urlOpts.Bucket, f.urlOpts.Key, err)
+	}
+	if cache := f.fs.getCache(); cache != nil {
+		cache.invalidate(f.urlOpts.Bucket, f.urlOpts.Key)
+	}
+	return nil
+}
+
+// FindByTags returns the objects under the given prefix whose tags match filter. One
+// condition of the filter is sent to GCS as a list filter so that only candidate objects are
+// listed; if the bucket or endpoint does not support context filters, every object is listed
+// and matched client-side. Directory markers are skipped.
+func (fs *StorageFS) FindByTags(ctx context.Context, u *url.URL, filter *TagFilter) ([]vfs.VFile, error) {
+	if filter == nil {
+		filter = &TagFilter{}
+	}
+	opts, err := parseURL(u)
+	if err != nil {
+		return nil, err
+	}
+	client, err := getStorageClient(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer ioutils.CloserFunc(client)
+
+	prefix := opts.Key
+	if prefix != "" && !strings.HasSuffix(prefix, textutils.ForwardSlashStr) {
+		prefix = prefix + textutils.ForwardSlashStr
+	}
+	serverFilter := filter.serverFilter()
+	files, err := fs.findByTags(ctx, client, opts, prefix, serverFilter, filter)
+	if err != nil && serverFilter != "" && isUnsupportedFilter(err) {
+		logger.WarnF("Context filters are not supported for gs://%s, matching tags client-side", opts.Bucket)
+		files, err = fs.findByTags(ctx, client, opts, prefix, "", filter)
+	}
+	return files, err
+}
+
+// findByTags lists the objects under prefix with the given server-side filter and returns
+// those matching filter.
+func (fs *StorageFS) findByTags(ctx context.Context, client *storage.Client, opts *urlOpts, prefix, serverFilter string, filter *TagFilter) ([]vfs.VFile, error) {
+	var files []vfs.VFile
+	it := bucketHandle(client, opts).Objects(ctx, &storage.Query{Prefix: prefix, Filter: serverFilter})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasSuffix(attrs.Name, textutils.ForwardSlashStr) {
+			continue
+		}
+		if !filter.matches(tagValues(attrs.Contexts)) {
+			continue
+		}
+		files = append(files, newStorageFile(client, fs, objectURLOpts(opts.Bucket, attrs.Name)))
+	}
+	return files, nil
+}
+
+// matches reports whether an object with the given tag values satisfies the filter.
+func (t *TagFilter) matches(tags map[string]string) bool {
+	for k, v := range t.Equals {
+		if current, ok := tags[k]; !ok || current != v {
+			return false
+		}
+	}
+	for k, v := range t.NotEquals {
+		if current, ok := tags[k]; ok && current == v {
+			return false
+		}
+	}
+	for _, k := range t.Exists {
+		if _, ok := tags[k]; !ok {
+			return false
+		}
+	}
+	for _, k := range t.NotExists {
+		if _, ok := tags[k]; ok {
+			return false
+		}
+	}
+	return t.Match == nil || t.Match(tags)
+}
+
+// serverFilter returns a single list filter condition implied by the filter, preferring
+// the most selective kind, or "" if the filter has none. GCS accepts one condition per list
+// request, so the remaining conditions are applied client-side.
+func (t *TagFilter) serverFilter() string {
+	if key, ok := firstKey(t.Equals); ok {
+		return "contexts." + strconv.Quote(key) + "=" + strconv.Quote(t.Equals[key])
+	}
+	if len(t.Exists) > 0 {
+		return "contexts." + strconv.Quote(t.Exists[0]) + ":*"
+	}
+	if key, ok := firstKey(t.NotEquals); ok {
+		return "-contexts." + strconv.Quote(key) + "=" + strconv.Quote(t.NotEquals[key])
+	}
+	if len(t.NotExists) > 0 {
+		return "-contexts." + strconv.Quote(t.NotExists[0]) + ":*"
+	}
+	return ""
+}
+
+// firstKey returns the smallest key of m, so the chosen server-side condition is stable.
+func firstKey(m map[string]string) (string, bool) {
+	if len(m) == 0 {
+		return "", false
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys[0], true
+}
+
+// tagValues returns the tag values of object contexts.
+func tagValues(contexts *storage.ObjectContexts) map[string]string {
+	tags := make(map[string]string)
+	if contexts != nil {
+		for k, payload := range contexts.Custom {
+			tags[k] = payload.Value
+		}
+	}
+	return tags
+}
+
+// isUnsupportedFilter reports whether err means the list filter was rejected.
+func isUnsupportedFilter(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == http.StatusBadRequest || apiErr.Code == http.StatusNotImplemented
+	}
+	code := status.Code(err)
+	return code == codes.InvalidArgument || code == codes.Unimplemented
+}
@@ -0,0 +1,89 @@
+package gs
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestTagFilter_Matches(t *testing.T) {
+	tags := map[string]string{"owner": "data-eng", "pii": "high"}
+	tests := []struct {
+		name   string
+		filter TagFilter
+		want   bool
+	}{
+		{"empty", TagFilter{}, true},
+		{"equals", TagFilter{Equals: map[string]string{"owner": "data-eng"}}, true},
+		{"equals mismatch", TagFilter{Equals: map[string]string{"owner": "web"}}, false},
+		{"equals missing", TagFilter{Equals: map[string]string{"dataset": "sales"}}, false},
+		{"not equals", TagFilter{NotEquals: map[string]string{"pii": "low"}}, true},
+		{"not equals hit", TagFilter{NotEquals: map[string]string{"pii": "high"}}, false},
+		{"exists", TagFilter{Exists: []string{"pii"}}, true},
+		{"exists missing", TagFilter{Exists: []string{"dataset"}}, false},
+		{"not exists", TagFilter{NotExists: []string{"dataset"}}, true},
+		{"not exists hit", TagFilter{NotExists: []string{"owner"}}, false},
+		{"match", TagFilter{Match: func(tags map[string]string) bool { return tags["pii"] != "none" }}, true},
+		{"match rejects", TagFilter{Exists: []string{"pii"}, Match: func(map[string]string) bool { return false }}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.matches(tags); got != tt.want {
+				t.Errorf("matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTagFilter_ServerFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter TagFilter
+		want   string
+	}{
+		{"empty", TagFilter{}, ""},
+		{"match only", TagFilter{Match: func(map[string]string) bool { return true }}, ""},
+		{"equals", TagFilter{Equals: map[string]string{"pii": "high", "owner": "eng"}, Exists: []string{"x"}}, `contexts."owner"="eng"`},
+		{"exists", TagFilter{Exists: []string{"pii"}, NotExists: []string{"x"}}, `contexts."pii":*`},
+		{"not equals", TagFilter{NotEquals: map[string]string{"pii": "high"}}, `-contexts."pii"="high"`},
+		{"not exists", TagFilter{NotExists: []string{"pii"}}, `-contexts."pii":*`},
+		{"quoted", TagFilter{Equals: map[string]string{`a"b`: "v"}}, `contexts."a\"b"="v"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.serverFilter(); got != tt.want {
+				t.Errorf("serverFilter() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTagValues(t *testing.T) {
+	if got := tagValues(nil); len(got) != 0 {
+		t.Errorf("expected no tags, got %v", got)
+	}
+	got := tagValues(&storage.ObjectContexts{Custom: map[string]storage.ObjectCustomContextPayload{"owner": {Value: "eng"}}})
+	if len(got) != 1 || got["owner"] != "eng" {
+		t.Errorf("unexpected tags %v", got)
+	}
+}
+
+func TestIsUnsupportedFilter(t *testing.T) {
+	if !isUnsupportedFilter(&googleapi.Error{Code: http.StatusBadRequest}) {
+		t.Error("expected 400 to be unsupported")
+	}
+	if !isUnsupportedFilter(status.Error(codes.InvalidArgument, "bad filter")) {
+		t.Error("expected InvalidArgument to be unsupported")
+	}
+	if isUnsupportedFilter(&googleapi.Error{Code: http.StatusForbidden}) {
+		t.Error("expected 403 not to be unsupported")
+	}
+	if isUnsupportedFilter(errors.New("network")) {
+		t.Error("expected plain error not to be unsupported")
+	}
+}
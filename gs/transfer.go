@@ -0,0 +1,269 @@
+package gs
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// progressInterval is the minimum time between two progress reports of a transfer.
+const progressInterval = 200 * time.Millisecond
+
+// TransferOptions configures rate limiting and progress reporting of a single transfer.
+// A nil *TransferOptions applies only the StorageFS bandwidth limit.
+type TransferOptions struct {
+	// RateLimit caps the transfer at this many bytes per second, in addition to the
+	// StorageFS bandwidth limit. Zero means unlimited.
+	RateLimit int64
+	// Progress is called at most every 200ms while data is transferred and once when the
+	// transfer completes.
+	Progress func(progress TransferProgress)
+	// ProgressChan receives the same reports as Progress. Reports are dropped while the
+	// channel is full, so a buffered channel is recommended; the channel is not closed.
+	ProgressChan chan<- TransferProgress
+}
+
+// TransferProgress reports the state of a transfer.
+type TransferProgress struct {
+	// Name is the URL of the object being transferred.
+	Name string
+	// Transferred is the number of bytes transferred so far.
+	Transferred int64
+	// Total is the size of the transfer, or -1 if it is not known.
+	Total int64
+	// Rate is the average transfer rate in bytes per second.
+	Rate float64
+	// ETA is the estimated time remaining, or zero if it cannot be estimated.
+	ETA time.Duration
+	// Done is true for the final report of a completed transfer.
+	Done bool
+}
+
+// SetBandwidthLimit caps the combined rate of all Read, Write and resumable upload
+// transfers of this filesystem at bytesPerSecond. Zero or a negative value removes the limit.
+func (fs *StorageFS) SetBandwidthLimit(bytesPerSecond int64) {
+	if bytesPerSecond <= 0 {
+		fs.bandwidth.Store(nil)
+		return
+	}
+	fs.bandwidth.Store(newRateLimiter(bytesPerSecond))
+}
+
+// GetBandwidthLimit returns the filesystem bandwidth limit in bytes per second, or zero if
+// transfers are not limited.
+func (fs *StorageFS) GetBandwidthLimit() int64 {
+	if limiter := fs.bandwidth.Load(); limiter != nil {
+		return int64(limiter.Limit())
+	}
+	return 0
+}
+
+// SetTransferOptions sets the rate limit and progress reporting of subsequent reads of this
+// file and of the write flushed by Close.
+func (f *StorageFile) SetTransferOptions(options *TransferOptions) {
+	f.transferOptions = options
+}
+
+// limitsOnly returns a copy of o without progress reporting, for the network side of a
+// transfer whose progress is reported elsewhere.
+func (o *TransferOptions) limitsOnly() *TransferOptions {
+	if o == nil {
+		return nil
+	}
+	limits := *o
+	limits.Progress, limits.ProgressChan = nil, nil
+	return &limits
+}
+
+// progressOnly returns a copy of o without its rate limit, for the progress of a transfer
+// whose limits are applied elsewhere.
+func (o *TransferOptions) progressOnly() *TransferOptions {
+	if o == nil {
+		return nil
+	}
+	progress := *o
+	progress.RateLimit = 0
+	return &progress
+}
+
+// newRateLimiter returns a limiter for bytesPerSecond that allows a burst of one second.
+func newRateLimiter(bytesPerSecond int64) *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), int(min(bytesPerSecond, int64(1<<30))))
+}
+
+// transfer tracks the limits and progress of a single transfer.
+type transfer struct {
+	name     string
+	total    int64
+	limiters []*rate.Limiter
+	options  *TransferOptions
+
+	mu          sync.Mutex
+	transferred int64
+	// resumed is the number of bytes transferred before the tracker started, which do not
+	// count towards the rate.
+	resumed    int64
+	start      time.Time
+	lastReport time.Time
+}
+
+// newTransfer returns the tracker of a transfer of total bytes, or nil if neither a rate
+// limit nor progress reporting applies.
+func (fs *StorageFS) newTransfer(name string, total int64, options *TransferOptions) *transfer {
+	t := &transfer{name: name, total: total, options: options, start: time.Now()}
+	if fs != nil {
+		if limiter := fs.bandwidth.Load(); limiter != nil {
+			t.limiters = append(t.limiters, limiter)
+		}
+	}
+	if options != nil && options.RateLimit > 0 {
+		t.limiters = append(t.limiters, newRateLimiter(options.RateLimit))
+	}
+	if len(t.limiters) == 0 && (options == nil || (options.Progress == nil && options.ProgressChan == nil)) {
+		return nil
+	}
+	return t
+}
+
+// maxChunk returns the largest number of bytes that can be waited for at once.
+func (t *transfer) maxChunk(n int) int {
+	for _, limiter := range t.limiters {
+		n = min(n, limiter.Burst())
+	}
+	return n
+}
+
+// wait blocks until n bytes may be transferred under every limiter.
+func (t *transfer) wait(ctx context.Context, n int) error {
+	for n > 0 {
+		chunk := t.maxChunk(n)
+		for _, limiter := range t.limiters {
+			if err := limiter.WaitN(ctx, chunk); err != nil {
+				return err
+			}
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// add records n transferred bytes and reports progress if the report interval has passed.
+func (t *transfer) add(n int64) {
+	t.mu.Lock()
+	t.transferred += n
+	t.reportLocked()
+}
+
+// resume records n bytes transferred before the tracker started, such as the committed
+// offset of a resumed upload.
+func (t *transfer) resume(n int64) {
+	t.mu.Lock()
+	t.transferred = n
+	t.resumed = n
+	t.mu.Unlock()
+}
+
+// update records the transferred and total bytes reported by a server-side operation.
+func (t *transfer) update(transferred, total int64) {
+	t.mu.Lock()
+	t.transferred = transferred
+	t.total = total
+	t.reportLocked()
+}
+
+// reportLocked reports progress if the report interval has passed and releases t.mu.
+func (t *transfer) reportLocked() {
+	now := time.Now()
+	if now.Sub(t.lastReport) < progressInterval {
+		t.mu.Unlock()
+		return
+	}
+	t.lastReport = now
+	progress := t.progress(now, false)
+	t.mu.Unlock()
+	t.report(progress)
+}
+
+// finish reports the completed transfer. A known total is raised to the bytes transferred.
+func (t *transfer) finish() {
+	t.mu.Lock()
+	if t.total >= 0 && t.transferred > t.total {
+		t.total = t.transferred
+	}
+	progress := t.progress(time.Now(), true)
+	t.mu.Unlock()
+	t.report(progress)
+}
+
+// progress returns the current progress report. t.mu must be held.
+func (t *transfer) progress(now time.Time, done bool) TransferProgress {
+	progress := TransferProgress{
+		Name:        t.name,
+		Transferred: t.transferred,
+		Total:       t.total,
+		Done:        done,
+	}
+	if elapsed := now.Sub(t.start).Seconds(); elapsed > 0 {
+		progress.Rate = float64(t.transferred-t.resumed) / elapsed
+	}
+	progress.ETA = estimateETA(progress.Transferred, progress.Total, progress.Rate)
+	return progress
+}
+
+// report delivers a progress report to the callback and channel of the transfer.
+func (t *transfer) report(progress TransferProgress) {
+	if t.options == nil {
+		return
+	}
+	if t.options.Progress != nil {
+		t.options.Progress(progress)
+	}
+	if t.options.ProgressChan != nil {
+		select {
+		case t.options.ProgressChan <- progress:
+		default:
+		}
+	}
+}
+
+// estimateETA returns the time needed for the remaining bytes at rate, or zero if the total
+// or rate is unknown.
+func estimateETA(transferred, total int64, rate float64) time.Duration {
+	if total < 0 || rate <= 0 || transferred >= total {
+		return 0
+	}
+	return time.Duration(float64(total-transferred) / rate * float64(time.Second))
+}
+
+// transferReader applies the limits of a transfer to reads from r and reports progress.
+type transferReader struct {
+	ctx context.Context
+	r   io.Reader
+	t   *transfer
+}
+
+// newTransferReader wraps r in the transfer t; it returns r itself when t is nil.
+func newTransferReader(ctx context.Context, r io.Reader, t *transfer) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &transferReader{ctx: ctx, r: r, t: t}
+}
+
+// Read reads at most one burst of the tightest limiter, then waits until it may proceed.
+func (tr *transferReader) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return tr.r.Read(b)
+	}
+	n, err := tr.r.Read(b[:tr.t.maxChunk(len(b))])
+	if n > 0 {
+		if waitErr := tr.t.wait(tr.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+		tr.t.add(int64(n))
+	}
+	return n, err
+}
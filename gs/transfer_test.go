@@ -0,0 +1,135 @@
+package gs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestEstimateETA(t *testing.T) {
+	tests := []struct {
+		transferred, total int64
+		rate               float64
+		want               time.Duration
+	}{
+		{50, 100, 10, 5 * time.Second},
+		{0, -1, 10, 0},
+		{50, 100, 0, 0},
+		{100, 100, 10, 0},
+	}
+	for _, tt := range tests {
+		if got := estimateETA(tt.transferred, tt.total, tt.rate); got != tt.want {
+			t.Errorf("estimateETA(%d, %d, %v) = %v, want %v", tt.transferred, tt.total, tt.rate, got, tt.want)
+		}
+	}
+}
+
+func TestSetBandwidthLimit(t *testing.T) {
+	fs := NewStorageFS()
+	if got := fs.GetBandwidthLimit(); got != 0 {
+		t.Errorf("expected no limit, got %d", got)
+	}
+	fs.SetBandwidthLimit(1 << 20)
+	if got := fs.GetBandwidthLimit(); got != 1<<20 {
+		t.Errorf("expected 1 MiB/s, got %d", got)
+	}
+	fs.SetBandwidthLimit(0)
+	if got := fs.GetBandwidthLimit(); got != 0 {
+		t.Errorf("expected limit removed, got %d", got)
+	}
+}
+
+func TestNewTransfer_Unlimited(t *testing.T) {
+	fs := NewStorageFS()
+	if tr := fs.newTransfer("gs://b/k", 10, nil); tr != nil {
+		t.Error("expected no transfer without limits or progress")
+	}
+	if tr := fs.newTransfer("gs://b/k", 10, &TransferOptions{}); tr != nil {
+		t.Error("expected no transfer for empty options")
+	}
+	r := bytes.NewReader(nil)
+	if got := newTransferReader(context.Background(), r, nil); got != io.Reader(r) {
+		t.Error("expected the reader to be returned unwrapped")
+	}
+}
+
+func TestNewTransfer_Limiters(t *testing.T) {
+	fs := NewStorageFS()
+	fs.SetBandwidthLimit(1000)
+	tr := fs.newTransfer("gs://b/k", 10, &TransferOptions{RateLimit: 500})
+	if tr == nil || len(tr.limiters) != 2 {
+		t.Fatalf("expected filesystem and transfer limiters, got %+v", tr)
+	}
+	if got := tr.maxChunk(4096); got != 500 {
+		t.Errorf("expected chunk capped at the tightest burst, got %d", got)
+	}
+}
+
+func TestTransferReader_Progress(t *testing.T) {
+	var reports []TransferProgress
+	ch := make(chan TransferProgress, 10)
+	tr := NewStorageFS().newTransfer("gs://b/k", 5, &TransferOptions{
+		Progress:     func(p TransferProgress) { reports = append(reports, p) },
+		ProgressChan: ch,
+	})
+	data, err := io.ReadAll(newTransferReader(context.Background(), bytes.NewReader([]byte("hello")), tr))
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("unexpected read %q, %v", data, err)
+	}
+	tr.finish()
+
+	if len(reports) == 0 {
+		t.Fatal("expected progress reports")
+	}
+	last := reports[len(reports)-1]
+	if !last.Done || last.Transferred != 5 || last.Total != 5 || last.ETA != 0 {
+		t.Errorf("unexpected final report %+v", last)
+	}
+	if len(ch) != len(reports) {
+		t.Errorf("expected %d channel reports, got %d", len(reports), len(ch))
+	}
+}
+
+func TestTransferReader_RateLimit(t *testing.T) {
+	tr := NewStorageFS().newTransfer("gs://b/k", 300, &TransferOptions{RateLimit: 100})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	// The first second's burst passes immediately, the next read must wait past the deadline.
+	_, err := io.ReadAll(newTransferReader(ctx, bytes.NewReader(make([]byte, 300)), tr))
+	if err == nil {
+		t.Fatal("expected the rate limit to block past the context deadline")
+	}
+}
+
+func TestTransfer_ResumedBytesExcludedFromRate(t *testing.T) {
+	var last TransferProgress
+	tr := NewStorageFS().newTransfer("gs://b/k", 1000, &TransferOptions{Progress: func(p TransferProgress) { last = p }})
+	tr.resume(900)
+	tr.start = time.Now().Add(-time.Second)
+	tr.update(1000, 1000)
+	if last.Transferred != 1000 {
+		t.Fatalf("got %d transferred, want 1000", last.Transferred)
+	}
+	if last.Rate < 90 || last.Rate > 110 {
+		t.Errorf("got rate %.1f, want about 100 bytes/s", last.Rate)
+	}
+}
+
+func TestTransferOptions_Split(t *testing.T) {
+	var nilOptions *TransferOptions
+	if nilOptions.limitsOnly() != nil || nilOptions.progressOnly() != nil {
+		t.Error("expected nil options to stay nil")
+	}
+	options := &TransferOptions{RateLimit: 10, Progress: func(TransferProgress) {}, ProgressChan: make(chan TransferProgress)}
+	if limits := options.limitsOnly(); limits.RateLimit != 10 || limits.Progress != nil || limits.ProgressChan != nil {
+		t.Errorf("expected only the rate limit, got %+v", limits)
+	}
+	if progress := options.progressOnly(); progress.RateLimit != 0 || progress.Progress == nil || progress.ProgressChan == nil {
+		t.Errorf("expected only the progress reporting, got %+v", progress)
+	}
+	if options.RateLimit != 10 || options.Progress == nil {
+		t.Error("expected the options to be left unchanged")
+	}
+}
@@ -0,0 +1,558 @@
+package gs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	raw "google.golang.org/api/storage/v1"
+	htransport "google.golang.org/api/transport/http"
+	"oss.nandlabs.io/golly-gcp/gcpsvc"
+	"oss.nandlabs.io/golly/ioutils"
+)
+
+const (
+	// uploadChunkAlign is the granularity GCS requires for every chunk but the last.
+	uploadChunkAlign = 256 * 1024
+	// defaultUploadChunkSize is the default size of a resumable upload chunk.
+	defaultUploadChunkSize = 16 * 1024 * 1024
+)
+
+// storageEndpoint is the default JSON API endpoint, from which the upload endpoint is
+// derived unless the gcpsvc config sets another one with option.WithEndpoint.
+const storageEndpoint = "https://storage.googleapis.com/storage/v1/"
+
+// ErrUploadSessionExpired is returned when a resumable upload session no longer exists.
+// Sessions expire one week after they are started; the upload must be restarted.
+var ErrUploadSessionExpired = errors.New("resumable upload session expired")
+
+// UploadOptions configures a resumable upload. A nil *UploadOptions uses 16 MiB chunks and
+// keeps no checkpoint.
+type UploadOptions struct {
+	// ChunkSize is the number of bytes sent per request, rounded up to a multiple of
+	// 256 KiB. Default: 16 MiB.
+	ChunkSize int
+	// ContentType of the object. Default: application/octet-stream.
+	ContentType string
+	// Metadata is custom metadata set on the object.
+	Metadata map[string]string
+	// Checkpoint is a local file the upload progress is persisted to after every committed
+	// chunk. It is removed once the upload completes.
+	Checkpoint string
+	// Progress is called at most every 200ms while data is sent and once when the upload
+	// completes. Transferred is the committed offset after every chunk.
+	Progress func(progress TransferProgress)
+	// ProgressChan receives the same reports as Progress. Reports are dropped while the
+	// channel is full; the channel is not closed.
+	ProgressChan chan<- TransferProgress
+	// RateLimit caps the upload at this many bytes per second, in addition to the
+	// StorageFS bandwidth limit. Zero means unlimited.
+	RateLimit int64
+}
+
+// UploadCheckpoint is the upload state persisted to UploadOptions.Checkpoint.
+type UploadCheckpoint struct {
+	// SessionURI is the resumable upload session.
+	SessionURI string `json:"sessionUri"`
+	// Bucket and Key identify the object being uploaded.
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	// Size is the total object size.
+	Size int64 `json:"size"`
+	// Committed is the number of bytes GCS has persisted.
+	Committed int64 `json:"committed"`
+}
+
+// ResumableUpload is a resumable upload session for a single object. The session survives
+// process restarts: it can be resumed from its session URI or checkpoint by another
+// process, which continues from the last committed offset.
+type ResumableUpload struct {
+	fs         *StorageFS
+	httpClient *http.Client
+	state      UploadCheckpoint
+	chunkSize  int
+	checkpoint string
+	// transferOptions holds the rate limit and progress reporting of the upload.
+	transferOptions *TransferOptions
+	// retry is the retry policy of the requests of the upload; nil uses the defaults.
+	retry *gcpsvc.RetryPolicy
+	// stale is set when a request failed, so the committed offset must be queried again.
+	stale bool
+	done  bool
+}
+
+// SessionURI returns the resumable upload session URI. It carries the authorization for the
+// upload and should be kept private.
+func (r *ResumableUpload) SessionURI() string {
+	return r.state.SessionURI
+}
+
+// Committed returns the number of bytes GCS has persisted.
+func (r *ResumableUpload) Committed() int64 {
+	return r.state.Committed
+}
+
+// Size returns the total size of the upload.
+func (r *ResumableUpload) Size() int64 {
+	return r.state.Size
+}
+
+// Done reports whether the upload has completed.
+func (r *ResumableUpload) Done() bool {
+	return r.done
+}
+
+// StartUpload starts a resumable upload session of size bytes for this object. The session
+// is written to options.Checkpoint, if set, before any data is sent.
+func (f *StorageFile) StartUpload(ctx context.Context, size int64, options *UploadOptions) (*ResumableUpload, error) {
+	if err := f.checkObject(); err != nil {
+		return nil, err
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("invalid upload size %d", size)
+	}
+	if options == nil {
+		options = &UploadOptions{}
+	}
+	httpClient, uploadBase, err := getUploadClient(f.urlOpts)
+	if err != nil {
+		return nil, err
+	}
+	contentType := options.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	body, err := json.Marshal(&raw.Object{
+		Name:        f.urlOpts.Key,
+		ContentType: contentType,
+		Metadata:    options.Metadata,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{"uploadType": {"resumable"}, "name": {f.urlOpts.Key}}
+	if userProject := resolveUserProject(f.urlOpts); userProject != "" {
+		query.Set("userProject", userProject)
+	}
+	endpoint := uploadBase + "b/" + url.PathEscape(f.urlOpts.Bucket) + "/o?" + query.Encode()
+	// Starting a session is not idempotent: a retry may leave an unused session behind.
+	retry := retryPolicy(ctx, f.urlOpts)
+	var sessionURI string
+	err = retryCall(ctx, retry, false, func() error {
+		req, reqErr := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+		if reqErr != nil {
+			return reqErr
+		}
+		req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+		req.Header.Set("X-Upload-Content-Type", contentType)
+		req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+		resp, reqErr := httpClient.Do(req)
+		if reqErr != nil {
+			return reqErr
+		}
+		defer ioutils.CloserFunc(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			return responseError(resp)
+		}
+		sessionURI = resp.Header.Get("Location")
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to start upload of gs://%s/%s: %w", f.urlOpts.Bucket, f.urlOpts.Key, err)
+	}
+	if sessionURI == "" {
+		return nil, fmt.Errorf("failed to start upload of gs://%s/%s: no session URI returned", f.urlOpts.Bucket, f.urlOpts.Key)
+	}
+
+	upload := f.newResumableUpload(httpClient, sessionURI, size, options)
+	upload.retry = retry
+	if err = upload.saveCheckpoint(); err != nil {
+		return nil, err
+	}
+	logger.InfoF("Started resumable upload of gs://%s/%s (%d bytes)", f.urlOpts.Bucket, f.urlOpts.Key, size)
+	return upload, nil
+}
+
+// ResumeUploadSession resumes an upload session of size bytes started by StartUpload,
+// possibly in another process. The committed offset is queried from GCS; options.Metadata
+// and options.ContentType are ignored since they were fixed when the session started.
+func (f *StorageFile) ResumeUploadSession(ctx context.Context, sessionURI string, size int64, options *UploadOptions) (*ResumableUpload, error) {
+	if err := f.checkObject(); err != nil {
+		return nil, err
+	}
+	if options == nil {
+		options = &UploadOptions{}
+	}
+	httpClient, _, err := getUploadClient(f.urlOpts)
+	if err != nil {
+		return nil, err
+	}
+	upload := f.newResumableUpload(httpClient, sessionURI, size, options)
+	upload.retry = retryPolicy(ctx, f.urlOpts)
+	if err = upload.query(ctx); err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+// ResumeUpload resumes the upload recorded in the checkpoint file at path. The checkpoint
+// must belong to this object. Progress continues to be persisted to the same file.
+func (f *StorageFile) ResumeUpload(ctx context.Context, path string, options *UploadOptions) (*ResumableUpload, error) {
+	checkpoint, err := readUploadCheckpoint(path)
+	if err != nil {
+		return nil, err
+	}
+	if checkpoint.Bucket != f.urlOpts.Bucket || checkpoint.Key != f.urlOpts.Key {
+		return nil, fmt.Errorf("upload checkpoint %s belongs to gs://%s/%s, not gs://%s/%s",
+			path, checkpoint.Bucket, checkpoint.Key, f.urlOpts.Bucket, f.urlOpts.Key)
+	}
+	resumed := UploadOptions{}
+	if options != nil {
+		resumed = *options
+	}
+	resumed.Checkpoint = path
+	return f.ResumeUploadSession(ctx, checkpoint.SessionURI, checkpoint.Size, &resumed)
+}
+
+// UploadFile uploads the local file at localPath to this object with a resumable upload.
+// If options.Checkpoint names an existing checkpoint for this object and file size, the
+// upload resumes from its committed offset; otherwise a new session is started.
+func (f *StorageFile) UploadFile(ctx context.Context, localPath string, options *UploadOptions) error {
+	if err := f.checkObject(); err != nil {
+		return err
+	}
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer ioutils.CloserFunc(file)
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	var upload *ResumableUpload
+	if options != nil && options.Checkpoint != "" {
+		checkpoint, readErr := readUploadCheckpoint(options.Checkpoint)
+		switch {
+		case readErr == nil && checkpoint.Bucket == f.urlOpts.Bucket && checkpoint.Key == f.urlOpts.Key && checkpoint.Size == info.Size():
+			upload, err = f.ResumeUploadSession(ctx, checkpoint.SessionURI, checkpoint.Size, options)
+			if errors.Is(err, ErrUploadSessionExpired) {
+				logger.WarnF("Upload session for gs://%s/%s expired, restarting the upload", f.urlOpts.Bucket, f.urlOpts.Key)
+				upload, err = nil, nil
+			}
+			if err != nil {
+				return err
+			}
+		case readErr == nil:
+			logger.WarnF("Ignoring upload checkpoint %s, it does not match gs://%s/%s", options.Checkpoint, f.urlOpts.Bucket, f.urlOpts.Key)
+		case !errors.Is(readErr, os.ErrNotExist):
+			return readErr
+		}
+	}
+	if upload == nil {
+		if upload, err = f.StartUpload(ctx, info.Size(), options); err != nil {
+			return err
+		}
+	}
+	return upload.Upload(ctx, file)
+}
+
+// Upload sends the data of r from the committed offset until the upload completes. r must
+// hold the complete object; it is positioned at the committed offset before every chunk.
+//
+// A chunk that fails with a transient error is retried under the retry policy in effect
+// when the session was started or resumed: the committed offset is queried from GCS and
+// the upload continues from there. Chunk requests are idempotent, so the default policy
+// retries them. After a failure, Upload can be called again to continue from the last
+// committed chunk.
+//
+// Chunk data is sent through the bandwidth limits as it is written to the connection, so
+// the rate stays smooth instead of bursting once per chunk.
+func (r *ResumableUpload) Upload(ctx context.Context, data io.ReadSeeker) error {
+	t := r.fs.newTransfer(r.name(), r.state.Size, r.transferOptions)
+	if t != nil {
+		t.resume(r.state.Committed)
+	}
+	buf := make([]byte, min(int64(r.chunkSize), max(r.state.Size, 1)))
+	for !r.done {
+		offset := r.state.Committed
+		if _, err := data.Seek(offset, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to seek upload data to %d: %w", offset, err)
+		}
+		n, err := io.ReadFull(data, buf[:min(int64(len(buf)), r.state.Size-offset)])
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read upload data at %d: %w", offset, err)
+		}
+		if err = r.sendChunk(ctx, buf[:n], offset, t); err != nil {
+			return err
+		}
+		if !r.done {
+			if err = r.saveCheckpoint(); err != nil {
+				return err
+			}
+		}
+		if t != nil {
+			t.update(r.state.Committed, r.state.Size)
+		}
+	}
+	if t != nil {
+		t.finish()
+	}
+	if cache := r.fs.getCache(); cache != nil {
+		cache.invalidate(r.state.Bucket, r.state.Key)
+	}
+	if r.checkpoint != "" {
+		if err := os.Remove(r.checkpoint); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.WarnF("Failed to remove upload checkpoint %s: %v", r.checkpoint, err)
+		}
+	}
+	logger.InfoF("Completed resumable upload of gs://%s/%s (%d bytes)", r.state.Bucket, r.state.Key, r.state.Size)
+	return nil
+}
+
+// Cancel terminates the upload session and removes its checkpoint. Data committed so far
+// is discarded.
+func (r *ResumableUpload) Cancel(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, r.state.SessionURI, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to cancel upload of gs://%s/%s: %w", r.state.Bucket, r.state.Key, err)
+	}
+	defer ioutils.CloserFunc(resp.Body)
+	// GCS answers a cancelled session with the non-standard status 499.
+	if resp.StatusCode != 499 && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("failed to cancel upload of gs://%s/%s: %w", r.state.Bucket, r.state.Key, responseError(resp))
+	}
+	r.done = true
+	if r.checkpoint != "" {
+		if err = os.Remove(r.checkpoint); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// newResumableUpload returns the upload state for a session of this object.
+func (f *StorageFile) newResumableUpload(httpClient *http.Client, sessionURI string, size int64, options *UploadOptions) *ResumableUpload {
+	return &ResumableUpload{
+		fs:         f.fs,
+		httpClient: httpClient,
+		state: UploadCheckpoint{
+			SessionURI: sessionURI,
+			Bucket:     f.urlOpts.Bucket,
+			Key:        f.urlOpts.Key,
+			Size:       size,
+		},
+		chunkSize:  uploadChunkSize(options.ChunkSize),
+		checkpoint: options.Checkpoint,
+		transferOptions: &TransferOptions{
+			RateLimit:    options.RateLimit,
+			Progress:     options.Progress,
+			ProgressChan: options.ProgressChan,
+		},
+	}
+}
+
+// name returns the URL of the object being uploaded, as reported in progress.
+func (r *ResumableUpload) name() string {
+	return (&url.URL{Scheme: GsScheme, Host: r.state.Bucket, Path: "/" + r.state.Key}).String()
+}
+
+// sendChunk sends the chunk at offset through the transfer t, retrying transient failures.
+// Before a retry, the committed offset is queried; if it moved past offset, sendChunk
+// returns so that the caller continues from the new offset.
+func (r *ResumableUpload) sendChunk(ctx context.Context, chunk []byte, offset int64, t *transfer) error {
+	return retryCall(ctx, r.retry, true, func() error {
+		if r.stale {
+			if err := r.put(ctx, nil, contentRange(0, 0, r.state.Size), nil); err != nil {
+				return err
+			}
+			r.stale = false
+			if r.done || r.state.Committed != offset {
+				return nil
+			}
+		}
+		if err := r.put(ctx, chunk, contentRange(offset, int64(len(chunk)), r.state.Size), t); err != nil {
+			r.stale = true
+			return err
+		}
+		return nil
+	})
+}
+
+// query refreshes the committed offset from GCS, retrying transient failures.
+func (r *ResumableUpload) query(ctx context.Context) error {
+	err := retryCall(ctx, r.retry, true, func() error {
+		return r.put(ctx, nil, contentRange(0, 0, r.state.Size), nil)
+	})
+	if err != nil {
+		return err
+	}
+	r.stale = false
+	return r.saveCheckpoint()
+}
+
+// put sends a chunk, or a status query when chunk is empty, and records the committed
+// offset. The chunk is read through the limits of t as the request is written.
+func (r *ResumableUpload) put(ctx context.Context, chunk []byte, byteRange string, t *transfer) error {
+	var body io.Reader = bytes.NewReader(chunk)
+	if len(chunk) > 0 {
+		body = newTransferReader(ctx, body, t)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, r.state.SessionURI, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = int64(len(chunk))
+	req.Header.Set("Content-Range", byteRange)
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload gs://%s/%s: %w", r.state.Bucket, r.state.Key, err)
+	}
+	defer ioutils.CloserFunc(resp.Body)
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		r.state.Committed = r.state.Size
+		r.done = true
+		return nil
+	case http.StatusPermanentRedirect:
+		committed, parseErr := committedOffset(resp.Header.Get("Range"))
+		if parseErr != nil {
+			return parseErr
+		}
+		r.state.Committed = committed
+		return nil
+	case http.StatusNotFound, http.StatusGone:
+		return fmt.Errorf("failed to upload gs://%s/%s: %w", r.state.Bucket, r.state.Key, ErrUploadSessionExpired)
+	}
+	return fmt.Errorf("failed to upload gs://%s/%s: %w", r.state.Bucket, r.state.Key, responseError(resp))
+}
+
+// saveCheckpoint atomically writes the upload state to the checkpoint file, if one is set.
+func (r *ResumableUpload) saveCheckpoint() error {
+	if r.checkpoint == "" {
+		return nil
+	}
+	data, err := json.Marshal(&r.state)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(r.checkpoint), filepath.Base(r.checkpoint)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write upload checkpoint: %w", err)
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), r.checkpoint)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write upload checkpoint: %w", err)
+	}
+	return nil
+}
+
+// readUploadCheckpoint loads the upload state from a checkpoint file.
+func readUploadCheckpoint(path string) (*UploadCheckpoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	checkpoint := &UploadCheckpoint{}
+	if err = json.Unmarshal(data, checkpoint); err != nil {
+		return nil, fmt.Errorf("invalid upload checkpoint %s: %w", path, err)
+	}
+	if checkpoint.SessionURI == "" {
+		return nil, fmt.Errorf("invalid upload checkpoint %s: no session URI", path)
+	}
+	return checkpoint, nil
+}
+
+// uploadChunkSize rounds size up to the chunk granularity, defaulting to 16 MiB.
+func uploadChunkSize(size int) int {
+	if size <= 0 {
+		return defaultUploadChunkSize
+	}
+	return (size + uploadChunkAlign - 1) / uploadChunkAlign * uploadChunkAlign
+}
+
+// contentRange returns the Content-Range header of a chunk of n bytes at offset.
+func contentRange(offset, n, size int64) string {
+	if n == 0 {
+		return "bytes */" + strconv.FormatInt(size, 10)
+	}
+	return fmt.Sprintf("bytes %d-%d/%d", offset, offset+n-1, size)
+}
+
+// committedOffset parses the Range header of an incomplete upload ("bytes=0-N") into the
+// number of committed bytes. A missing header means nothing was committed.
+func committedOffset(header string) (int64, error) {
+	if header == "" {
+		return 0, nil
+	}
+	last, ok := strings.CutPrefix(header, "bytes=0-")
+	if !ok {
+		return 0, fmt.Errorf("unexpected upload range %q", header)
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected upload range %q", header)
+	}
+	return end + 1, nil
+}
+
+// responseError returns the error of a failed request with a bounded prefix of the body of
+// resp, as a *googleapi.Error so that the retry policy can classify it.
+func responseError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return &googleapi.Error{Code: resp.StatusCode, Message: strings.TrimSpace(string(body)), Header: resp.Header}
+}
+
+// getUploadClient creates an authenticated HTTP client and the upload endpoint from the
+// gcpsvc config resolved for opts. The endpoint follows option.WithEndpoint of the config
+// and defaults to the googleapis.com endpoint; other universes must set WithEndpoint.
+func getUploadClient(opts *urlOpts) (*http.Client, string, error) {
+	clientOpts := []option.ClientOption{option.WithScopes(raw.DevstorageReadWriteScope)}
+	if cfg := gcpsvc.GetConfig(opts.u, GsScheme); cfg != nil {
+		clientOpts = append(clientOpts, cfg.Options...)
+	}
+	httpClient, endpoint, err := htransport.NewClient(context.Background(), clientOpts...)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create storage upload client: %w", err)
+	}
+	if endpoint == "" {
+		endpoint = storageEndpoint
+	}
+	return httpClient, uploadBasePath(endpoint), nil
+}
+
+// uploadBasePath returns the media upload endpoint matching a JSON API base path.
+func uploadBasePath(basePath string) string {
+	if !strings.HasSuffix(basePath, "/") {
+		basePath += "/"
+	}
+	if idx := strings.LastIndex(basePath, "/storage/v1/"); idx >= 0 {
+		return basePath[:idx] + "/upload" + basePath[idx:]
+	}
+	return basePath + "upload/"
+}
@@ -0,0 +1,249 @@
+package gs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/option"
+	"oss.nandlabs.io/golly-gcp/gcpsvc"
+)
+
+func TestUploadChunkSize(t *testing.T) {
+	tests := []struct {
+		in, want int
+	}{
+		{0, defaultUploadChunkSize},
+		{-1, defaultUploadChunkSize},
+		{1, uploadChunkAlign},
+		{uploadChunkAlign, uploadChunkAlign},
+		{uploadChunkAlign + 1, 2 * uploadChunkAlign},
+	}
+	for _, tt := range tests {
+		if got := uploadChunkSize(tt.in); got != tt.want {
+			t.Errorf("uploadChunkSize(%d) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestContentRange(t *testing.T) {
+	if got := contentRange(0, 10, 100); got != "bytes 0-9/100" {
+		t.Errorf("got %q", got)
+	}
+	if got := contentRange(90, 10, 100); got != "bytes 90-99/100" {
+		t.Errorf("got %q", got)
+	}
+	if got := contentRange(0, 0, 0); got != "bytes */0" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestCommittedOffset(t *testing.T) {
+	tests := []struct {
+		header  string
+		want    int64
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"bytes=0-262143", 262144, false},
+		{"bytes=10-20", 0, true},
+		{"bytes=0-x", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := committedOffset(tt.header)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("committedOffset(%q) = %d, %v; want %d, err %v", tt.header, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestUploadBasePath(t *testing.T) {
+	tests := map[string]string{
+		"https://storage.googleapis.com/storage/v1/": "https://storage.googleapis.com/upload/storage/v1/",
+		"http://localhost:4443/storage/v1":           "http://localhost:4443/upload/storage/v1/",
+		"http://localhost:4443/":                     "http://localhost:4443/upload/",
+	}
+	for in, want := range tests {
+		if got := uploadBasePath(in); got != want {
+			t.Errorf("uploadBasePath(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestUploadCheckpoint_RoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "upload.json")
+	upload := &ResumableUpload{
+		state: UploadCheckpoint{
+			SessionURI: "https://storage.googleapis.com/upload/storage/v1/b/b/o?upload_id=x",
+			Bucket:     "b",
+			Key:        "big.bin",
+			Size:       1 << 30,
+			Committed:  1 << 24,
+		},
+		checkpoint: path,
+	}
+	if err := upload.saveCheckpoint(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readUploadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != upload.state {
+		t.Errorf("got %+v, want %+v", *got, upload.state)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("expected only the checkpoint file, got %d entries", len(entries))
+	}
+}
+
+func TestReadUploadCheckpoint_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := readUploadCheckpoint(filepath.Join(dir, "missing.json")); !os.IsNotExist(err) {
+		t.Errorf("expected not-exist error, got %v", err)
+	}
+	path := filepath.Join(dir, "bad.json")
+	if err := os.WriteFile(path, []byte(`{"bucket":"b"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readUploadCheckpoint(path); err == nil {
+		t.Error("expected error for checkpoint without session URI")
+	}
+}
+
+func TestGetUploadClient_Endpoint(t *testing.T) {
+	tests := map[string]struct {
+		options []option.ClientOption
+		want    string
+	}{
+		"default-endpoint-bucket": {nil, "https://storage.googleapis.com/upload/storage/v1/"},
+		"custom-endpoint-bucket":  {[]option.ClientOption{option.WithEndpoint("http://localhost:4443/storage/v1/")}, "http://localhost:4443/upload/storage/v1/"},
+	}
+	for bucket, tt := range tests {
+		gcpsvc.Manager.Register(bucket, &gcpsvc.Config{Options: append([]option.ClientOption{option.WithoutAuthentication()}, tt.options...)})
+		opts, _ := parseURL(&url.URL{Scheme: GsScheme, Host: bucket, Path: "/key"})
+		_, endpoint, err := getUploadClient(opts)
+		gcpsvc.Manager.Unregister(bucket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if endpoint != tt.want {
+			t.Errorf("%s: got endpoint %q, want %q", bucket, endpoint, tt.want)
+		}
+	}
+}
+
+func TestResumableUpload_RetriesFromCommittedOffset(t *testing.T) {
+	data := []byte("0123456789")
+	var mu sync.Mutex
+	var received bytes.Buffer
+	failed := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := io.ReadAll(r.Body)
+		if strings.HasPrefix(r.Header.Get("Content-Range"), "bytes */") {
+			w.Header().Set("Range", "bytes=0-"+strconv.Itoa(received.Len()-1))
+			w.WriteHeader(http.StatusPermanentRedirect)
+			return
+		}
+		if !failed {
+			// Commit part of the chunk, then fail as if the connection broke.
+			failed = true
+			received.Write(body[:4])
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received.Write(body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	upload := &ResumableUpload{
+		httpClient: server.Client(),
+		state:      UploadCheckpoint{SessionURI: server.URL, Bucket: "b", Key: "k", Size: int64(len(data))},
+		chunkSize:  uploadChunkAlign,
+		retry:      &gcpsvc.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond},
+	}
+	if err := upload.Upload(context.Background(), bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if !upload.Done() || !bytes.Equal(received.Bytes(), data) {
+		t.Errorf("got done=%v content %q, want %q", upload.Done(), received.Bytes(), data)
+	}
+}
+
+func TestResumableUpload_NoRetryUnderRetryNever(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	upload := &ResumableUpload{
+		httpClient: server.Client(),
+		state:      UploadCheckpoint{SessionURI: server.URL, Bucket: "b", Key: "k", Size: 3},
+		chunkSize:  uploadChunkAlign,
+		retry:      &gcpsvc.RetryPolicy{Idempotency: gcpsvc.RetryNever},
+	}
+	if err := upload.Upload(context.Background(), bytes.NewReader([]byte("abc"))); err == nil {
+		t.Fatal("expected the upload to fail")
+	}
+	if calls != 1 || !upload.stale {
+		t.Errorf("got %d requests, stale=%v; want 1 request and a stale upload", calls, upload.stale)
+	}
+}
+
+func TestResumableUpload_ReportsProgress(t *testing.T) {
+	data := make([]byte, 2*uploadChunkAlign+10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		var end, size int64
+		if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%d", new(int64), &end, &size); err != nil || end+1 < size {
+			w.Header().Set("Range", "bytes=0-"+strconv.FormatInt(end, 10))
+			w.WriteHeader(http.StatusPermanentRedirect)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	var reports []TransferProgress
+	upload := &ResumableUpload{
+		httpClient: server.Client(),
+		state: UploadCheckpoint{
+			SessionURI: server.URL,
+			Bucket:     "b",
+			Key:        "k",
+			Size:       int64(len(data)),
+			Committed:  uploadChunkAlign,
+		},
+		chunkSize: uploadChunkAlign,
+		transferOptions: &TransferOptions{Progress: func(p TransferProgress) {
+			reports = append(reports, p)
+		}},
+	}
+	if err := upload.Upload(context.Background(), bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) == 0 {
+		t.Fatal("expected progress reports")
+	}
+	last := reports[len(reports)-1]
+	if !last.Done || last.Name != "gs://b/k" || last.Transferred != int64(len(data)) || last.Total != int64(len(data)) {
+		t.Errorf("unexpected final report %+v", last)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"errors"
 	"net/url"
 	"strings"
+
+	"oss.nandlabs.io/golly-gcp/gcpsvc"
 )
 
 const (
@@ -16,6 +18,8 @@ type urlOpts struct {
 	u      *url.URL
 	Bucket string
 	Key    string
+	// retry overrides the retry policy of the client for requests on this location.
+	retry *gcpsvc.RetryPolicy
 }
 
 // parseURL parses a GCS URL into its bucket and key components.
@@ -0,0 +1,382 @@
+package gs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+	"oss.nandlabs.io/golly/ioutils"
+	"oss.nandlabs.io/golly/textutils"
+	"oss.nandlabs.io/golly/vfs"
+)
+
+// WatchEventType identifies the kind of change reported by Watch.
+type WatchEventType int
+
+const (
+	// WatchCreated is reported for an object that was not seen in the previous poll.
+	WatchCreated WatchEventType = iota
+	// WatchUpdated is reported for an object whose generation changed since the previous poll.
+	WatchUpdated
+	// WatchDeleted is reported for an object that is no longer listed under the prefix.
+	WatchDeleted
+)
+
+// String returns a readable name for the event type.
+func (t WatchEventType) String() string {
+	switch t {
+	case WatchCreated:
+		return "created"
+	case WatchUpdated:
+		return "updated"
+	case WatchDeleted:
+		return "deleted"
+	default:
+		return fmt.Sprintf("WatchEventType(%d)", int(t))
+	}
+}
+
+// WatchEvent describes a single change detected by Watch.
+type WatchEvent struct {
+	// Type is the kind of change.
+	Type WatchEventType
+	// File is the changed object. For deleted objects it points to the removed URL.
+	File vfs.VFile
+	// Generation is the current object generation (the last known one for deleted objects).
+	Generation int64
+	// Size is the object size in bytes.
+	Size int64
+	// Updated is the last modification time reported by GCS.
+	Updated time.Time
+}
+
+// WatchHandler is invoked for every change detected by Watch.
+// Returning an error stops the watch and the error is returned from Watch.
+type WatchHandler func(event *WatchEvent) error
+
+// WatchOptions configures a Watch call. A nil *WatchOptions uses the defaults.
+type WatchOptions struct {
+	// Checkpoint is an optional gs:// URL where the known object state is persisted
+	// as JSON after every poll that produced changes. When set, a restarted watch
+	// resumes from the stored state and reports changes made while it was stopped.
+	Checkpoint *url.URL
+	// EmitExisting reports every object found by the first poll as WatchCreated
+	// when no checkpoint state is available. By default the first poll only
+	// establishes the baseline.
+	EmitExisting bool
+}
+
+// watchCheckpointTimeout bounds a checkpoint save. Saves are detached from the cancellation
+// of the Watch context so that the state of the last poll is kept when the watch stops.
+const watchCheckpointTimeout = 30 * time.Second
+
+// watchEntry is the state tracked for a single object between polls.
+type watchEntry struct {
+	Generation int64     `json:"generation"`
+	Size       int64     `json:"size"`
+	Updated    time.Time `json:"updated"`
+}
+
+// watchChange is a single difference between two watch states.
+type watchChange struct {
+	eventType WatchEventType
+	key       string
+	entry     watchEntry
+}
+
+// watchCheckpoint is the JSON document persisted to the checkpoint object.
+type watchCheckpoint struct {
+	Bucket  string                `json:"bucket"`
+	Prefix  string                `json:"prefix"`
+	Objects map[string]watchEntry `json:"objects"`
+}
+
+// Watch polls the given GCS prefix every interval and calls handler for each object
+// that was created, updated (new generation) or deleted since the previous poll.
+// It is a fallback for buckets where Pub/Sub notifications cannot be configured.
+//
+// Watch blocks until ctx is done, in which case it returns nil. Listing errors on the
+// first poll and handler errors are returned; listing errors on later polls are logged
+// and retried on the next interval. The files of the events share the client of the watch,
+// which is closed when Watch returns; reopen them with Open to use them afterwards.
+func (fs *StorageFS) Watch(ctx context.Context, u *url.URL, interval time.Duration, handler WatchHandler, options *WatchOptions) error {
+	if handler == nil {
+		return errors.New("watch handler cannot be nil")
+	}
+	if interval <= 0 {
+		return fmt.Errorf("invalid watch interval %v", interval)
+	}
+	if options == nil {
+		options = &WatchOptions{}
+	}
+
+	opts, err := parseURL(u)
+	if err != nil {
+		return err
+	}
+
+	var cpOpts *urlOpts
+	if options.Checkpoint != nil {
+		if cpOpts, err = parseURL(options.Checkpoint); err != nil {
+			return err
+		}
+	}
+
+	client, err := getStorageClient(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer ioutils.CloserFunc(client)
+
+	prefix := opts.Key
+	if prefix != "" && !strings.HasSuffix(prefix, textutils.ForwardSlashStr) {
+		prefix = prefix + textutils.ForwardSlashStr
+	}
+
+	w := &watcher{
+		fs:      fs,
+		client:  client,
+		handle:  bucketHandle(client, opts),
+		bucket:  opts.Bucket,
+		prefix:  prefix,
+		handler: handler,
+		cpOpts:  cpOpts,
+	}
+
+	known, restored, err := w.loadCheckpoint(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+
+	current, err := w.scan(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	if !restored && !options.EmitExisting {
+		known = current
+		if err = w.saveCheckpoint(ctx, known); err != nil {
+			return err
+		}
+	} else if known, err = w.apply(ctx, known, current); err != nil {
+		return err
+	}
+
+	logger.InfoF("Watching gs://%s/%s every %v", opts.Bucket, prefix, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			logger.InfoF("Stopped watching gs://%s/%s", opts.Bucket, prefix)
+			return nil
+		case <-ticker.C:
+		}
+
+		current, err = w.scan(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				continue
+			}
+			logger.WarnF("Watch listing of gs://%s/%s failed: %v", opts.Bucket, prefix, err)
+			continue
+		}
+		if known, err = w.apply(ctx, known, current); err != nil {
+			return err
+		}
+	}
+}
+
+// watcher holds the per-call state of a Watch.
+type watcher struct {
+	fs      *StorageFS
+	client  *storage.Client
+	handle  *storage.BucketHandle
+	bucket  string
+	prefix  string
+	handler WatchHandler
+	cpOpts  *urlOpts
+}
+
+// scan lists every object under the watched prefix, skipping directory markers
+// and the checkpoint object itself.
+func (w *watcher) scan(ctx context.Context) (map[string]watchEntry, error) {
+	query := &storage.Query{Prefix: w.prefix}
+	if err := query.SetAttrSelection([]string{"Name", "Generation", "Size", "Updated"}); err != nil {
+		return nil, err
+	}
+
+	state := make(map[string]watchEntry)
+	it := w.handle.Objects(ctx, query)
+	for {
+		attrs, iterErr := it.Next()
+		if iterErr == iterator.Done {
+			break
+		}
+		if iterErr != nil {
+			return nil, iterErr
+		}
+		if strings.HasSuffix(attrs.Name, textutils.ForwardSlashStr) {
+			continue
+		}
+		if w.cpOpts != nil && w.cpOpts.Bucket == w.bucket && w.cpOpts.Key == attrs.Name {
+			continue
+		}
+		state[attrs.Name] = watchEntry{
+			Generation: attrs.Generation,
+			Size:       attrs.Size,
+			Updated:    attrs.Updated,
+		}
+	}
+	return state, nil
+}
+
+// apply reports the differences between known and current to the handler.
+// The known state only advances past changes the handler accepted, so a failed
+// change is reported again after a restart from the checkpoint.
+func (w *watcher) apply(ctx context.Context, known, current map[string]watchEntry) (map[string]watchEntry, error) {
+	changes := diffWatchState(known, current)
+	if len(changes) == 0 {
+		return known, nil
+	}
+
+	var handlerErr error
+	for _, change := range changes {
+		event := &WatchEvent{
+			Type:       change.eventType,
+			File:       w.file(change.key),
+			Generation: change.entry.Generation,
+			Size:       change.entry.Size,
+			Updated:    change.entry.Updated,
+		}
+		if handlerErr = w.handler(event); handlerErr != nil {
+			break
+		}
+		if change.eventType == WatchDeleted {
+			delete(known, change.key)
+		} else {
+			known[change.key] = change.entry
+		}
+	}
+
+	if err := w.saveCheckpoint(ctx, known); err != nil {
+		if handlerErr != nil {
+			return known, handlerErr
+		}
+		return known, err
+	}
+	return known, handlerErr
+}
+
+// file returns a StorageFile for the given key in the watched bucket.
+func (w *watcher) file(key string) *StorageFile {
+	return newStorageFile(w.client, w.fs, &urlOpts{
+		u: &url.URL{
+			Scheme: GsScheme,
+			Host:   w.bucket,
+			Path:   "/" + key,
+		},
+		Bucket: w.bucket,
+		Key:    key,
+	})
+}
+
+// loadCheckpoint reads the persisted state. restored is false when no checkpoint
+// is configured or the checkpoint object does not exist yet.
+func (w *watcher) loadCheckpoint(ctx context.Context) (state map[string]watchEntry, restored bool, err error) {
+	state = make(map[string]watchEntry)
+	if w.cpOpts == nil {
+		return
+	}
+
+	reader, err := bucketHandle(w.client, w.cpOpts).Object(w.cpOpts.Key).NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return state, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read watch checkpoint: %w", err)
+	}
+	defer ioutils.CloserFunc(reader)
+
+	cp := &watchCheckpoint{}
+	if err = json.NewDecoder(reader).Decode(cp); err != nil {
+		return nil, false, fmt.Errorf("failed to decode watch checkpoint: %w", err)
+	}
+	if cp.Bucket != w.bucket || cp.Prefix != w.prefix {
+		return nil, false, fmt.Errorf("watch checkpoint is for gs://%s/%s, not gs://%s/%s", cp.Bucket, cp.Prefix, w.bucket, w.prefix)
+	}
+	if cp.Objects != nil {
+		state = cp.Objects
+	}
+	return state, true, nil
+}
+
+// saveCheckpoint persists the known state, if a checkpoint is configured. The save is not
+// cancelled with ctx, so the final state is persisted when the watch is stopped mid-poll.
+func (w *watcher) saveCheckpoint(ctx context.Context, state map[string]watchEntry) error {
+	if w.cpOpts == nil {
+		return nil
+	}
+	ctx, cancel := checkpointContext(ctx)
+	defer cancel()
+	data, err := json.Marshal(&watchCheckpoint{
+		Bucket:  w.bucket,
+		Prefix:  w.prefix,
+		Objects: state,
+	})
+	if err != nil {
+		return err
+	}
+
+	writer := bucketHandle(w.client, w.cpOpts).Object(w.cpOpts.Key).NewWriter(ctx)
+	writer.ContentType = "application/json"
+	if _, err = writer.Write(data); err != nil {
+		_ = writer.Close()
+		return fmt.Errorf("failed to write watch checkpoint: %w", err)
+	}
+	if err = writer.Close(); err != nil {
+		return fmt.Errorf("failed to write watch checkpoint: %w", err)
+	}
+	return nil
+}
+
+// checkpointContext returns a context for a checkpoint save that keeps the values of ctx
+// but not its cancellation, bounded by watchCheckpointTimeout.
+func checkpointContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), watchCheckpointTimeout)
+}
+
+// diffWatchState returns the changes between two watch states, ordered by key.
+func diffWatchState(known, current map[string]watchEntry) []watchChange {
+	var changes []watchChange
+	for key, entry := range current {
+		prev, ok := known[key]
+		switch {
+		case !ok:
+			changes = append(changes, watchChange{eventType: WatchCreated, key: key, entry: entry})
+		case prev.Generation != entry.Generation:
+			changes = append(changes, watchChange{eventType: WatchUpdated, key: key, entry: entry})
+		}
+	}
+	for key, entry := range known {
+		if _, ok := current[key]; !ok {
+			changes = append(changes, watchChange{eventType: WatchDeleted, key: key, entry: entry})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].key < changes[j].key
+	})
+	return changes
+}
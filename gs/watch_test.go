@@ -0,0 +1,90 @@
+package gs
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestDiffWatchState(t *testing.T) {
+	known := map[string]watchEntry{
+		"data/a.txt": {Generation: 1},
+		"data/b.txt": {Generation: 1},
+		"data/c.txt": {Generation: 1},
+	}
+	current := map[string]watchEntry{
+		"data/a.txt": {Generation: 1},
+		"data/b.txt": {Generation: 2},
+		"data/d.txt": {Generation: 1},
+	}
+
+	changes := diffWatchState(known, current)
+	expected := []struct {
+		key       string
+		eventType WatchEventType
+	}{
+		{"data/b.txt", WatchUpdated},
+		{"data/c.txt", WatchDeleted},
+		{"data/d.txt", WatchCreated},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("expected %d changes, got %d: %+v", len(expected), len(changes), changes)
+	}
+	for i, want := range expected {
+		if changes[i].key != want.key || changes[i].eventType != want.eventType {
+			t.Errorf("change %d: expected %s %s, got %s %s", i, want.eventType, want.key, changes[i].eventType, changes[i].key)
+		}
+	}
+}
+
+func TestDiffWatchState_NoChanges(t *testing.T) {
+	state := map[string]watchEntry{"a": {Generation: 3}}
+	if changes := diffWatchState(state, map[string]watchEntry{"a": {Generation: 3}}); len(changes) != 0 {
+		t.Errorf("expected no changes, got %+v", changes)
+	}
+}
+
+func TestWatchEventType_String(t *testing.T) {
+	cases := map[WatchEventType]string{
+		WatchCreated:      "created",
+		WatchUpdated:      "updated",
+		WatchDeleted:      "deleted",
+		WatchEventType(9): "WatchEventType(9)",
+	}
+	for eventType, want := range cases {
+		if got := eventType.String(); got != want {
+			t.Errorf("expected %q, got %q", want, got)
+		}
+	}
+}
+
+func TestStorageFS_Watch_InvalidArgs(t *testing.T) {
+	fs := &StorageFS{}
+	u, _ := url.Parse("gs://my-bucket/data/")
+	handler := func(event *WatchEvent) error { return nil }
+
+	if err := fs.Watch(context.Background(), u, time.Second, nil, nil); err == nil {
+		t.Error("expected error for nil handler")
+	}
+	if err := fs.Watch(context.Background(), u, 0, handler, nil); err == nil {
+		t.Error("expected error for zero interval")
+	}
+	if err := fs.Watch(context.Background(), &url.URL{Scheme: "gs"}, time.Second, handler, nil); err == nil {
+		t.Error("expected error for missing bucket")
+	}
+}
+
+func TestCheckpointContext_Detached(t *testing.T) {
+	parent, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	ctx, done := checkpointContext(parent)
+	defer done()
+	if ctx.Err() != nil {
+		t.Fatalf("expected the checkpoint context to survive cancellation, got %v", ctx.Err())
+	}
+	if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > watchCheckpointTimeout {
+		t.Errorf("expected a deadline within %v, got %v", watchCheckpointTimeout, deadline)
+	}
+}
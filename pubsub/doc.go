@@ -18,4 +18,7 @@
 //	msg.SetBodyStr("hello world")
 //	u, _ := url.Parse("pubsub://my-topic")
 //	mgr.Send(u, msg)
+//
+// The message header named by HeaderOrderingKey ("golly.pubsub.orderingKey") is reserved:
+// it carries the ordering key of an outbound message and is not published as an attribute.
 package pubsub
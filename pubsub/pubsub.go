@@ -2,14 +2,12 @@ package pubsub
 
 import (
 	"context"
-	"fmt"
 	"net/url"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	gpubsub "cloud.google.com/go/pubsub/v2"
-	"oss.nandlabs.io/golly/ioutils"
+	"oss.nandlabs.io/golly-gcp/gcpsvc"
 	"oss.nandlabs.io/golly/messaging"
 )
 
@@ -19,7 +17,8 @@ const (
 	OptTimeout = "Timeout"
 	// OptBatchSize is the maximum number of messages for ReceiveBatch. Default: 10.
 	OptBatchSize = "BatchSize"
-	// OptOrderingKey is the ordering key for messages in ordered delivery topics.
+	// OptOrderingKey is the ordering key for messages in ordered delivery topics. The key set
+	// on a message with SetOrderingKey or the HeaderOrderingKey header takes precedence.
 	OptOrderingKey = "OrderingKey"
 	// OptMaxExtension is the maximum duration (in seconds) that the message's ack deadline
 	// will be extended. Applies to subscription receive settings.
@@ -27,15 +26,26 @@ const (
 	// OptMaxOutstandingMessages is the maximum number of unprocessed messages the subscriber
 	// will pull from the server before pausing.
 	OptMaxOutstandingMessages = "MaxOutstandingMessages"
+	// OptPublishBatchCount publishes a batch once it holds this many messages.
+	// Default: 100.
+	OptPublishBatchCount = "PublishBatchCount"
+	// OptPublishBatchBytes publishes a batch once its size reaches this many bytes.
+	// Default: 1000000.
+	OptPublishBatchBytes = "PublishBatchBytes"
+	// OptPublishBatchDelay publishes a non-empty batch after this many milliseconds.
+	// Default: 10.
+	OptPublishBatchDelay = "PublishBatchDelay"
 )
 
 var pubsubSchemes = []string{PubSubScheme}
 
 // Provider implements the messaging.Provider interface for Google Cloud Pub/Sub.
+// Clients are cached per resolved gcpsvc.Config and publishers per topic, and shared by
+// all calls until Close.
 type Provider struct {
-	closed  atomic.Bool
 	mu      sync.Mutex
 	stopFns []context.CancelFunc // cancel functions for active listeners
+	clients map[*gcpsvc.Config]*clientEntry
 }
 
 // Id returns the provider id.
@@ -66,47 +76,23 @@ func (p *Provider) NewMessage(scheme string, options ...messaging.Option) (messa
 	}, nil
 }
 
-// Send publishes a single message to a Pub/Sub topic.
+// Send publishes a single message to a Pub/Sub topic and waits for the result.
 // URL format: pubsub://topic-name
-// Supported options: OrderingKey.
+// Supported options: OrderingKey, ResumeAfterError, PublishBatchCount, PublishBatchBytes,
+// PublishBatchDelay.
 func (p *Provider) Send(u *url.URL, msg messaging.Message, options ...messaging.Option) error {
-	client, err := getPubSubClient(u)
+	msgs := []messaging.Message{msg}
+	optResolver := messaging.NewOptionsResolver(options...)
+	publisher, err := p.publisher(u, optResolver, ordered(msgs, optResolver))
 	if err != nil {
 		return err
 	}
-	defer ioutils.CloserFunc(client)
 
-	publisher, err := resolvePublisher(client, u)
+	// The message ID is stored on the message if it's a MessagePubSub
+	id, err := publishAll(publisher, msgs, optResolver)[0].Get(context.Background())
 	if err != nil {
 		return err
 	}
-	defer publisher.Stop()
-
-	message := &gpubsub.Message{
-		Data: msg.ReadBytes(),
-	}
-
-	// Apply ordering key if provided
-	optResolver := messaging.NewOptionsResolver(options...)
-	if v, ok := optResolver.Get(OptOrderingKey); ok {
-		publisher.EnableMessageOrdering = true
-		message.OrderingKey = v.(string)
-	}
-
-	// Apply attributes from message string headers
-	message.Attributes = buildAttributes(msg)
-
-	ctx := context.Background()
-	result := publisher.Publish(ctx, message)
-	id, err := result.Get(ctx)
-	if err != nil {
-		return fmt.Errorf("pubsub: publish failed: %w", err)
-	}
-
-	// Store the message ID on the message if it's a MessagePubSub
-	if psMsg, ok := msg.(*MessagePubSub); ok {
-		psMsg.messageId = id
-	}
 
 	logger.InfoF("Pub/Sub message published, MessageId: %s", id)
 	return nil
@@ -115,60 +101,24 @@ func (p *Provider) Send(u *url.URL, msg messaging.Message, options ...messaging.
 // SendBatch publishes a batch of messages to a Pub/Sub topic.
 // Pub/Sub batches messages automatically via the client library.
 // All messages are published asynchronously and then we wait for all results.
+// If any message fails, a *BatchError mapping each failed index to its error is returned.
+// Each message is published with its own ordering key if set, or else the OrderingKey option.
+// Supported options: OrderingKey, ResumeAfterError, PublishBatchCount, PublishBatchBytes,
+// PublishBatchDelay.
 func (p *Provider) SendBatch(u *url.URL, msgs []messaging.Message, options ...messaging.Option) error {
 	if len(msgs) == 0 {
 		return nil
 	}
 
-	client, err := getPubSubClient(u)
+	optResolver := messaging.NewOptionsResolver(options...)
+	publisher, err := p.publisher(u, optResolver, ordered(msgs, optResolver))
 	if err != nil {
 		return err
 	}
-	defer ioutils.CloserFunc(client)
 
-	publisher, err := resolvePublisher(client, u)
-	if err != nil {
+	if err = WaitBatch(context.Background(), publishAll(publisher, msgs, optResolver)); err != nil {
 		return err
 	}
-	defer publisher.Stop()
-
-	optResolver := messaging.NewOptionsResolver(options...)
-	if v, ok := optResolver.Get(OptOrderingKey); ok {
-		publisher.EnableMessageOrdering = true
-		_ = v // ordering key set per-message below
-	}
-
-	ctx := context.Background()
-	results := make([]*gpubsub.PublishResult, len(msgs))
-	for i, msg := range msgs {
-		message := &gpubsub.Message{
-			Data:       msg.ReadBytes(),
-			Attributes: buildAttributes(msg),
-		}
-		if v, ok := optResolver.Get(OptOrderingKey); ok {
-			message.OrderingKey = v.(string)
-		}
-		results[i] = publisher.Publish(ctx, message)
-	}
-
-	// Wait for all publishes to complete
-	var firstErr error
-	for i, result := range results {
-		id, err := result.Get(ctx)
-		if err != nil {
-			if firstErr == nil {
-				firstErr = fmt.Errorf("pubsub: batch publish failed at index %d: %w", i, err)
-			}
-			continue
-		}
-		if psMsg, ok := msgs[i].(*MessagePubSub); ok {
-			psMsg.messageId = id
-		}
-	}
-
-	if firstErr != nil {
-		return firstErr
-	}
 
 	logger.InfoF("Pub/Sub batch sent %d messages to topic %s", len(msgs), u.Host)
 	return nil
@@ -176,20 +126,10 @@ func (p *Provider) SendBatch(u *url.URL, msgs []messaging.Message, options ...me
 
 // Receive receives a single message from a Pub/Sub subscription.
 // URL format: pubsub://subscription-name
-// Supported options: Timeout (seconds, required).
+// Supported options: Timeout (seconds, default 30).
+// The message is fetched with a unary Pull, so no other message is leased.
 // The message is NOT auto-acknowledged. Call msg.Rsvp(true) to ack or msg.Rsvp(false) to nack.
 func (p *Provider) Receive(u *url.URL, options ...messaging.Option) (messaging.Message, error) {
-	client, err := getPubSubClient(u)
-	if err != nil {
-		return nil, err
-	}
-	defer ioutils.CloserFunc(client)
-
-	sub, err := resolveSubscriber(client, u)
-	if err != nil {
-		return nil, err
-	}
-
 	optResolver := messaging.NewOptionsResolver(options...)
 
 	// Determine timeout
@@ -198,51 +138,20 @@ func (p *Provider) Receive(u *url.URL, options ...messaging.Option) (messaging.M
 		timeout = time.Duration(v.(int)) * time.Second
 	}
 
-	// We only want one message, so limit concurrency
-	sub.ReceiveSettings.MaxOutstandingMessages = 1
-
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-
-	msgChan := make(chan *gpubsub.Message, 1)
-	errChan := make(chan error, 1)
-
-	go func() {
-		err := sub.Receive(ctx, func(_ context.Context, m *gpubsub.Message) {
-			msgChan <- m
-			cancel() // stop receiving after first message
-		})
-		if err != nil {
-			errChan <- err
-		}
-	}()
-
-	select {
-	case m := <-msgChan:
-		return p.toMessage(m), nil
-	case err := <-errChan:
-		return nil, fmt.Errorf("pubsub: receive failed: %w", err)
-	case <-ctx.Done():
-		return nil, fmt.Errorf("pubsub: no messages available within timeout")
+	msgs, err := p.pull(u, 1, timeout)
+	if err != nil {
+		return nil, err
 	}
+	return msgs[0], nil
 }
 
 // ReceiveBatch receives a batch of messages from a Pub/Sub subscription.
 // URL format: pubsub://subscription-name
 // Supported options: BatchSize (default 10), Timeout (seconds, default 30).
+// The messages are fetched with a unary Pull, which returns as soon as messages are
+// available, so the batch may hold fewer than BatchSize messages.
 // Messages are NOT auto-acknowledged. Call msg.Rsvp(true) to ack each message.
 func (p *Provider) ReceiveBatch(u *url.URL, options ...messaging.Option) ([]messaging.Message, error) {
-	client, err := getPubSubClient(u)
-	if err != nil {
-		return nil, err
-	}
-	defer ioutils.CloserFunc(client)
-
-	sub, err := resolveSubscriber(client, u)
-	if err != nil {
-		return nil, err
-	}
-
 	optResolver := messaging.NewOptionsResolver(options...)
 
 	batchSize := 10
@@ -258,105 +167,45 @@ func (p *Provider) ReceiveBatch(u *url.URL, options ...messaging.Option) ([]mess
 		timeout = time.Duration(v.(int)) * time.Second
 	}
 
-	sub.ReceiveSettings.MaxOutstandingMessages = batchSize
-
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-
-	var (
-		mu   sync.Mutex
-		msgs []messaging.Message
-	)
-
-	err = sub.Receive(ctx, func(_ context.Context, m *gpubsub.Message) {
-		mu.Lock()
-		msgs = append(msgs, p.toMessage(m))
-		if len(msgs) >= batchSize {
-			cancel()
-		}
-		mu.Unlock()
-	})
-	if err != nil && ctx.Err() == nil {
-		return nil, fmt.Errorf("pubsub: receive batch failed: %w", err)
+	pulled, err := p.pull(u, batchSize, timeout)
+	if err != nil {
+		return nil, err
 	}
-
-	if len(msgs) == 0 {
-		return nil, fmt.Errorf("pubsub: no messages available within timeout")
+	msgs := make([]messaging.Message, len(pulled))
+	for i, msg := range pulled {
+		msgs[i] = msg
 	}
-
 	return msgs, nil
 }
 
 // AddListener registers a listener that continuously receives messages from a Pub/Sub subscription.
 // The listener runs in a goroutine and can be stopped by calling Close on the provider.
+// Use Listen for a handle to stop a single listener and observe its state.
 // URL format: pubsub://subscription-name
 // Supported options: Timeout (total listener duration in seconds, 0 = indefinite),
-// MaxOutstandingMessages, MaxExtension.
+// MaxOutstandingMessages, MaxExtension, DeadLetterTopic, MaxDeliveryAttempts, Handler,
+// HandlerRetry.
 // Messages are NOT auto-acknowledged. The listener callback must call msg.Rsvp(true) to ack.
+// With the Handler option, the handler is called instead and messages are acked or nacked
+// by its result.
 func (p *Provider) AddListener(u *url.URL, listener func(msg messaging.Message), options ...messaging.Option) error {
-	client, err := getPubSubClient(u)
-	if err != nil {
-		return err
-	}
-
-	sub, err := resolveSubscriber(client, u)
-	if err != nil {
-		ioutils.CloserFunc(client)
-		return err
-	}
-
-	optResolver := messaging.NewOptionsResolver(options...)
-
-	// Configure subscriber receive settings
-	if v, ok := optResolver.Get(OptMaxOutstandingMessages); ok {
-		sub.ReceiveSettings.MaxOutstandingMessages = v.(int)
-	}
-	if v, ok := optResolver.Get(OptMaxExtension); ok {
-		sub.ReceiveSettings.MaxExtension = time.Duration(v.(int)) * time.Second
-	}
-
-	ctx, cancel := context.WithCancel(context.Background())
-	if v, ok := optResolver.Get(OptTimeout); ok {
-		timeout := time.Duration(v.(int)) * time.Second
-		ctx, cancel = context.WithTimeout(context.Background(), timeout)
-	}
-
-	p.mu.Lock()
-	p.stopFns = append(p.stopFns, cancel)
-	p.mu.Unlock()
-
-	go func() {
-		defer cancel()
-		defer ioutils.CloserFunc(client)
-		logger.InfoF("Pub/Sub listener started for subscription %s", u.Host)
-
-		err := sub.Receive(ctx, func(_ context.Context, m *gpubsub.Message) {
-			if p.closed.Load() {
-				m.Nack()
-				return
-			}
-			listener(p.toMessage(m))
-		})
-		if err != nil && ctx.Err() == nil {
-			logger.ErrorF("Pub/Sub listener error: %v", err)
-		}
-
-		logger.InfoF("Pub/Sub listener stopped for subscription %s", u.Host)
-	}()
-
-	return nil
+	_, err := p.Listen(u, listener, options...)
+	return err
 }
 
-// Close stops all active listeners and releases resources.
+// Close stops all active listeners, publishes pending messages of the cached publishers
+// and closes the cached clients. It blocks until pending messages have been sent. The
+// provider stays usable: the next call creates new clients and publishers.
 func (p *Provider) Close() error {
-	p.closed.Store(true)
 	p.mu.Lock()
-	defer p.mu.Unlock()
 	for _, cancel := range p.stopFns {
 		cancel()
 	}
 	p.stopFns = nil
-	return nil
+	clients := p.clients
+	p.clients = nil
+	p.mu.Unlock()
+	return closeClients(clients)
 }
 
 // toMessage converts a Pub/Sub message to a MessagePubSub.
@@ -376,17 +225,28 @@ func (p *Provider) toMessage(m *gpubsub.Message) *MessagePubSub {
 		BaseMessage:   baseMsg,
 		pubsubMessage: m,
 		messageId:     m.ID,
+		orderingKey:   m.OrderingKey,
 		provider:      p,
 		stringHeaders: stringHeaders,
 	}
 }
 
 // buildAttributes converts message headers to Pub/Sub message attributes.
-// Returns the tracked string headers from MessagePubSub, or nil if the message
-// is not a *MessagePubSub.
+// Returns the tracked string headers from MessagePubSub without the reserved
+// HeaderOrderingKey, or nil if the message is not a *MessagePubSub.
 func buildAttributes(msg messaging.Message) map[string]string {
-	if psMsg, ok := msg.(*MessagePubSub); ok {
+	psMsg, ok := msg.(*MessagePubSub)
+	if !ok {
+		return nil
+	}
+	if _, reserved := psMsg.stringHeaders[HeaderOrderingKey]; !reserved {
 		return psMsg.stringHeaders
 	}
-	return nil
+	attrs := make(map[string]string, len(psMsg.stringHeaders)-1)
+	for k, v := range psMsg.stringHeaders {
+		if k != HeaderOrderingKey {
+			attrs[k] = v
+		}
+	}
+	return attrs
 }
@@ -0,0 +1,203 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	gpubsub "cloud.google.com/go/pubsub/v2"
+)
+
+// OptAckTimeout is the number of seconds Rsvp waits for the result of an ack or nack on a
+// subscription with exactly-once delivery. Default: 30.
+const OptAckTimeout = "AckTimeout"
+
+// OptNackDelay is the number of seconds after which a message nacked with Rsvp(false) is
+// redelivered. Default: 0, redelivered immediately.
+const OptNackDelay = "NackDelay"
+
+// defaultAckTimeout is the default of OptAckTimeout.
+const defaultAckTimeout = 30 * time.Second
+
+// maxAckDeadline is the longest ack deadline accepted by Pub/Sub.
+const maxAckDeadline = 600 * time.Second
+
+// Errors returned by Rsvp when an ack or nack fails on a subscription with exactly-once
+// delivery. Use errors.Is to test for them, or errors.As with *AckError for the details.
+var (
+	// ErrInvalidAckID means the ack ID is not valid, usually because the ack deadline of the
+	// message expired and it may be redelivered.
+	ErrInvalidAckID = errors.New("pubsub: invalid ack ID or expired ack deadline")
+	// ErrAckPermissionDenied means the caller may not acknowledge messages of the subscription.
+	ErrAckPermissionDenied = errors.New("pubsub: permission denied to acknowledge message")
+	// ErrAckFailedPrecondition means the subscription is in a state that prevents the ack,
+	// such as being detached.
+	ErrAckFailedPrecondition = errors.New("pubsub: ack failed precondition")
+	// ErrAckTimeout means the ack result was not known within the AckTimeout. The ack may
+	// still succeed.
+	ErrAckTimeout = errors.New("pubsub: timed out waiting for ack result")
+	// ErrAckFailed means the ack failed for another reason.
+	ErrAckFailed = errors.New("pubsub: ack failed")
+)
+
+// AckError describes a failed ack or nack of a message.
+type AckError struct {
+	// MessageId is the ID of the message.
+	MessageId string
+	// Accept is true for an ack and false for a nack.
+	Accept bool
+	// Status is the acknowledge status reported by Pub/Sub.
+	Status gpubsub.AcknowledgeStatus
+	// Err is the error reported by the client library.
+	Err error
+	// kind is the sentinel error matching Status.
+	kind error
+}
+
+// Error describes the failure.
+func (e *AckError) Error() string {
+	op := "ack"
+	if !e.Accept {
+		op = "nack"
+	}
+	if e.Err == nil {
+		return fmt.Sprintf("%v: %s of message %s", e.kind, op, e.MessageId)
+	}
+	return fmt.Sprintf("%v: %s of message %s: %v", e.kind, op, e.MessageId, e.Err)
+}
+
+// Unwrap returns the sentinel error matching the status and the underlying error.
+func (e *AckError) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.kind}
+	}
+	return []error{e.kind, e.Err}
+}
+
+// ack acks or nacks the message and waits up to timeout for the result.
+func (m *MessagePubSub) ack(accept bool, timeout time.Duration) error {
+	if m.pulled != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if accept {
+			return pulledAckError(m.messageId, accept, m.pulled.ack(ctx))
+		}
+		return pulledAckError(m.messageId, accept, m.pulled.modify(ctx, 0))
+	}
+	var result *gpubsub.AckResult
+	if accept {
+		result = m.pubsubMessage.AckWithResult()
+	} else {
+		result = m.pubsubMessage.NackWithResult()
+	}
+	return waitAck(result, m.messageId, accept, timeout)
+}
+
+// waitAck waits for the result of an ack or nack and converts a failure to an *AckError.
+// On subscriptions without exactly-once delivery the result is immediately successful.
+func waitAck(result *gpubsub.AckResult, messageId string, accept bool, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	status, err := result.Get(ctx)
+	if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+		return &AckError{MessageId: messageId, Accept: accept, Status: gpubsub.AcknowledgeStatusOther, Err: err, kind: ErrAckTimeout}
+	}
+	return ackStatusError(messageId, accept, status, err)
+}
+
+// ackStatusError returns the *AckError for an acknowledge status, or nil on success.
+func ackStatusError(messageId string, accept bool, status gpubsub.AcknowledgeStatus, err error) error {
+	var kind error
+	switch status {
+	case gpubsub.AcknowledgeStatusSuccess:
+		if err == nil {
+			return nil
+		}
+		kind = ErrAckFailed
+	case gpubsub.AcknowledgeStatusInvalidAckID:
+		kind = ErrInvalidAckID
+	case gpubsub.AcknowledgeStatusPermissionDenied:
+		kind = ErrAckPermissionDenied
+	case gpubsub.AcknowledgeStatusFailedPrecondition:
+		kind = ErrAckFailedPrecondition
+	default:
+		kind = ErrAckFailed
+	}
+	return &AckError{MessageId: messageId, Accept: accept, Status: status, Err: err, kind: kind}
+}
+
+// ModifyAckDeadline sets the time the handler has left to acknowledge the message, counted
+// from now. Once it passes without an Rsvp the message is nacked and redelivered; a deadline
+// of 0 nacks it immediately. Each call replaces the previous deadline, so handlers can extend
+// the deadline while working or shorten it to release the message early. d must be at most
+// 10 minutes.
+//
+// For messages returned by Receive or ReceiveBatch the deadline is set on the subscription.
+// For messages of AddListener it is only enforced by this process: a timer nacks the message
+// when the deadline passes, while the client library keeps the message leased up to the
+// listener's MaxExtension (default 60 minutes). The deadline is not sent to Pub/Sub, so it
+// does not survive the process; if the process exits first, the message is redelivered once
+// its lease expires. When the listener stops or the provider is closed, pending deadlines
+// are cancelled and their messages nacked at once, and further calls fail. For outbound
+// messages, this is a no-op.
+func (m *MessagePubSub) ModifyAckDeadline(d time.Duration) error {
+	if m.pubsubMessage == nil {
+		return nil
+	}
+	if d < 0 || d > maxAckDeadline {
+		return fmt.Errorf("pubsub: ack deadline must be between 0 and %v, got %v", maxAckDeadline, d)
+	}
+	if d == 0 {
+		return m.Rsvp(false)
+	}
+
+	m.deadlineMu.Lock()
+	defer m.deadlineMu.Unlock()
+	if m.settled {
+		return fmt.Errorf("pubsub: message %s was already acked or nacked", m.messageId)
+	}
+	if m.pulled != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultAckTimeout)
+		defer cancel()
+		return pulledAckError(m.messageId, false, m.pulled.modify(ctx, d))
+	}
+	if m.listener != nil && !m.listener.watchDeadline(m) {
+		return fmt.Errorf("pubsub: listener for %s stopped, cannot set the ack deadline of message %s", m.listener.subscription, m.messageId)
+	}
+	if m.deadline != nil {
+		m.deadline.Stop()
+	}
+	m.deadline = time.AfterFunc(d, func() {
+		if m.settle() {
+			m.pubsubMessage.Nack()
+		}
+	})
+	return nil
+}
+
+// settle marks the message as acked or nacked and cancels its deadline. It returns false if
+// the message was already settled.
+func (m *MessagePubSub) settle() bool {
+	m.deadlineMu.Lock()
+	defer m.deadlineMu.Unlock()
+	if m.settled {
+		return false
+	}
+	m.settled = true
+	if m.deadline != nil {
+		m.deadline.Stop()
+		m.deadline = nil
+		if m.listener != nil {
+			m.listener.unwatchDeadline(m)
+		}
+	}
+	return true
+}
+
+// isSettled reports whether the message has been acked or nacked.
+func (m *MessagePubSub) isSettled() bool {
+	m.deadlineMu.Lock()
+	defer m.deadlineMu.Unlock()
+	return m.settled
+}
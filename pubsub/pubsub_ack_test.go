@@ -0,0 +1,165 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	gpubsub "cloud.google.com/go/pubsub/v2"
+	"oss.nandlabs.io/golly/messaging"
+)
+
+func TestAckStatusError(t *testing.T) {
+	if err := ackStatusError("m1", true, gpubsub.AcknowledgeStatusSuccess, nil); err != nil {
+		t.Errorf("expected nil on success, got %v", err)
+	}
+
+	cause := errors.New("rpc error")
+	tests := []struct {
+		status gpubsub.AcknowledgeStatus
+		want   error
+	}{
+		{gpubsub.AcknowledgeStatusInvalidAckID, ErrInvalidAckID},
+		{gpubsub.AcknowledgeStatusPermissionDenied, ErrAckPermissionDenied},
+		{gpubsub.AcknowledgeStatusFailedPrecondition, ErrAckFailedPrecondition},
+		{gpubsub.AcknowledgeStatusOther, ErrAckFailed},
+		{gpubsub.AcknowledgeStatusSuccess, ErrAckFailed},
+	}
+	for _, tt := range tests {
+		err := ackStatusError("m1", false, tt.status, cause)
+		if !errors.Is(err, tt.want) || !errors.Is(err, cause) {
+			t.Errorf("status %v: expected %v wrapping the cause, got %v", tt.status, tt.want, err)
+		}
+		var ackErr *AckError
+		if !errors.As(err, &ackErr) || ackErr.MessageId != "m1" || ackErr.Accept || ackErr.Status != tt.status {
+			t.Errorf("status %v: unexpected AckError %+v", tt.status, ackErr)
+		}
+	}
+}
+
+func TestAckError_Error(t *testing.T) {
+	err := &AckError{MessageId: "m1", Accept: true, kind: ErrInvalidAckID}
+	if msg := err.Error(); !strings.Contains(msg, "ack of message m1") || !strings.HasPrefix(msg, "pubsub: ") {
+		t.Errorf("unexpected message %q", msg)
+	}
+	err = &AckError{MessageId: "m1", kind: ErrAckFailed, Err: errors.New("boom")}
+	if msg := err.Error(); !strings.Contains(msg, "nack of message m1: boom") {
+		t.Errorf("unexpected message %q", msg)
+	}
+}
+
+func TestRsvp_Received(t *testing.T) {
+	p := &Provider{}
+	options := messaging.NewOptionsBuilder().Add(OptAckTimeout, 1).Build()
+	for _, accept := range []bool{true, false} {
+		msg := p.toMessage(&gpubsub.Message{ID: "m1"})
+		acked := 0
+		msg.onAck = func() { acked++ }
+		if err := msg.Rsvp(accept, options...); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		// A second Rsvp is ignored
+		if err := msg.Rsvp(true, options...); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if want := map[bool]int{true: 1, false: 0}[accept]; acked != want {
+			t.Errorf("accept=%v: expected onAck to be called %d times, got %d", accept, want, acked)
+		}
+	}
+}
+
+func TestModifyAckDeadline(t *testing.T) {
+	p := &Provider{}
+	outbound, _ := p.NewMessage(PubSubScheme)
+	if err := outbound.(*MessagePubSub).ModifyAckDeadline(time.Minute); err != nil {
+		t.Errorf("expected a no-op for outbound messages, got %v", err)
+	}
+
+	msg := p.toMessage(&gpubsub.Message{ID: "m1"})
+	for _, d := range []time.Duration{-time.Second, 11 * time.Minute} {
+		if err := msg.ModifyAckDeadline(d); err == nil {
+			t.Errorf("expected an error for deadline %v", d)
+		}
+	}
+	if err := msg.ModifyAckDeadline(time.Minute); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := msg.ModifyAckDeadline(10 * time.Millisecond); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	msg.deadlineMu.Lock()
+	settled := msg.settled
+	msg.deadlineMu.Unlock()
+	if !settled {
+		t.Fatal("expected the message to be nacked when the deadline passed")
+	}
+	if err := msg.ModifyAckDeadline(time.Minute); err == nil {
+		t.Error("expected an error for a settled message")
+	}
+}
+
+func TestModifyAckDeadline_ReleasedWhenListenerStops(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	l := newListener("orders-sub", cancel)
+	context.AfterFunc(ctx, l.releaseDeadlines)
+
+	msg := (&Provider{}).toMessage(&gpubsub.Message{ID: "m1"})
+	msg.listener = l
+	if err := msg.ModifyAckDeadline(time.Minute); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	settledMsg := (&Provider{}).toMessage(&gpubsub.Message{ID: "m2"})
+	settledMsg.listener = l
+	if err := settledMsg.ModifyAckDeadline(time.Minute); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = settledMsg.Rsvp(true)
+	l.mu.Lock()
+	watched := len(l.deadlines)
+	l.mu.Unlock()
+	if watched != 1 {
+		t.Fatalf("expected only the unsettled message to be watched, got %d", watched)
+	}
+
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for !msg.isSettled() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	msg.deadlineMu.Lock()
+	released := msg.settled && msg.deadline == nil
+	msg.deadlineMu.Unlock()
+	if !released {
+		t.Fatal("expected the pending deadline to be cancelled and the message nacked")
+	}
+
+	late := (&Provider{}).toMessage(&gpubsub.Message{ID: "m3"})
+	late.listener = l
+	if err := late.ModifyAckDeadline(time.Minute); err == nil {
+		t.Error("expected an error once the listener stopped")
+	}
+}
+
+func TestRsvp_NackDelay(t *testing.T) {
+	msg := (&Provider{}).toMessage(&gpubsub.Message{ID: "m1"})
+	options := messaging.NewOptionsBuilder().Add(OptNackDelay, 30).Build()
+	if err := msg.Rsvp(false, options...); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	msg.deadlineMu.Lock()
+	pending := msg.deadline != nil && !msg.settled
+	msg.deadlineMu.Unlock()
+	if !pending {
+		t.Fatal("expected the nack to be deferred")
+	}
+	// An ack before the delay passes wins
+	if err := msg.Rsvp(true); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if msg.deadline != nil {
+		t.Error("expected the deferred nack to be canceled")
+	}
+}
@@ -0,0 +1,560 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/url"
+	"strings"
+	"time"
+
+	gpubsub "cloud.google.com/go/pubsub/v2"
+	"cloud.google.com/go/pubsub/v2/apiv1/pubsubpb"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"oss.nandlabs.io/golly-gcp/gcpsvc"
+)
+
+// TopicConfig describes a Pub/Sub topic.
+type TopicConfig struct {
+	// Name is the topic ID. Set from the URL host when creating or updating a topic.
+	Name string
+	// Labels are the topic labels. Nil leaves the labels unchanged on update.
+	Labels map[string]string
+	// MessageRetention is how long published messages are retained by the topic. Zero
+	// leaves the retention unchanged on update.
+	MessageRetention time.Duration
+	// KMSKeyName is the Cloud KMS key protecting the messages. Empty leaves the key
+	// unchanged on update.
+	KMSKeyName string
+}
+
+// SubscriptionConfig describes a Pub/Sub subscription. When updating a subscription,
+// zero durations and nil labels and policies leave the current setting unchanged, while
+// RetainAckedMessages and EnableExactlyOnceDelivery are always applied.
+type SubscriptionConfig struct {
+	// Name is the subscription ID. Set from the URL host when creating or updating.
+	Name string
+	// Topic is the ID of the topic, or its full name if it belongs to another project.
+	// Required to create a subscription; cannot be changed.
+	Topic string
+	// AckDeadline is how long a message may stay unacknowledged before redelivery.
+	AckDeadline time.Duration
+	// RetainAckedMessages keeps acknowledged messages for MessageRetention.
+	RetainAckedMessages bool
+	// MessageRetention is how long unacknowledged messages are retained.
+	MessageRetention time.Duration
+	// Labels are the subscription labels.
+	Labels map[string]string
+	// Filter selects the messages delivered to the subscription. Cannot be changed.
+	Filter string
+	// EnableMessageOrdering delivers messages with the same ordering key in order. Cannot
+	// be changed.
+	EnableMessageOrdering bool
+	// EnableExactlyOnceDelivery enables exactly-once delivery.
+	EnableExactlyOnceDelivery bool
+	// DeadLetterPolicy forwards messages that could not be delivered to a dead-letter topic.
+	DeadLetterPolicy *DeadLetterPolicy
+	// RetryPolicy delays the redelivery of nacked or expired messages.
+	RetryPolicy *RetryPolicy
+}
+
+// DeadLetterPolicy forwards undeliverable messages to a dead-letter topic.
+type DeadLetterPolicy struct {
+	// Topic is the ID or full name of the dead-letter topic.
+	Topic string
+	// MaxDeliveryAttempts is the number of delivery attempts before a message is forwarded,
+	// between 5 and 100.
+	MaxDeliveryAttempts int
+}
+
+// RetryPolicy bounds the exponential backoff applied before redelivering a message.
+type RetryPolicy struct {
+	// MinimumBackoff is the delay before the first redelivery.
+	MinimumBackoff time.Duration
+	// MaximumBackoff is the largest delay between redeliveries.
+	MaximumBackoff time.Duration
+}
+
+// adminClient returns the cached client and the project ID of the gcpsvc config resolved
+// for u.
+func (p *Provider) adminClient(u *url.URL) (*gpubsub.Client, string, error) {
+	entry, err := p.client(u)
+	if err != nil {
+		return nil, "", err
+	}
+	return entry.client, gcpsvc.GetConfig(u, PubSubScheme).ProjectId, nil
+}
+
+// CreateTopic creates the topic named by the URL host.
+// URL format: pubsub://topic-name
+func (p *Provider) CreateTopic(ctx context.Context, u *url.URL, config *TopicConfig) (*TopicConfig, error) {
+	client, project, err := p.adminClient(u)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("pubsub: topic name (URL host) is required")
+	}
+	topic, err := client.TopicAdminClient.CreateTopic(ctx, topicToProto(project, u.Host, config))
+	if err != nil {
+		return nil, fmt.Errorf("pubsub: failed to create topic %s: %w", u.Host, err)
+	}
+	return topicFromProto(project, topic), nil
+}
+
+// GetTopic returns the configuration of the topic named by the URL host.
+// URL format: pubsub://topic-name
+func (p *Provider) GetTopic(ctx context.Context, u *url.URL) (*TopicConfig, error) {
+	client, project, err := p.adminClient(u)
+	if err != nil {
+		return nil, err
+	}
+	return getTopic(ctx, client, project, u.Host)
+}
+
+// UpdateTopic updates the settings of the topic named by the URL host to those set in
+// config. Nothing is sent if the topic already has them.
+// URL format: pubsub://topic-name
+func (p *Provider) UpdateTopic(ctx context.Context, u *url.URL, config *TopicConfig) (*TopicConfig, error) {
+	client, project, err := p.adminClient(u)
+	if err != nil {
+		return nil, err
+	}
+	current, err := getTopic(ctx, client, project, u.Host)
+	if err != nil {
+		return nil, err
+	}
+	return updateTopic(ctx, client, project, current, config)
+}
+
+// DeleteTopic deletes the topic named by the URL host. Subscriptions of the topic are not
+// deleted.
+// URL format: pubsub://topic-name
+func (p *Provider) DeleteTopic(ctx context.Context, u *url.URL) error {
+	client, project, err := p.adminClient(u)
+	if err != nil {
+		return err
+	}
+	if u.Host == "" {
+		return fmt.Errorf("pubsub: topic name (URL host) is required")
+	}
+	err = client.TopicAdminClient.DeleteTopic(ctx, &pubsubpb.DeleteTopicRequest{Topic: topicPath(project, u.Host)})
+	if err != nil {
+		return fmt.Errorf("pubsub: failed to delete topic %s: %w", u.Host, err)
+	}
+	return nil
+}
+
+// ListTopics returns the topics of the project of the gcpsvc config resolved for u.
+// URL format: pubsub:// or pubsub://any-name to select a per-name config
+func (p *Provider) ListTopics(ctx context.Context, u *url.URL) ([]*TopicConfig, error) {
+	client, project, err := p.adminClient(u)
+	if err != nil {
+		return nil, err
+	}
+	var topics []*TopicConfig
+	it := client.TopicAdminClient.ListTopics(ctx, &pubsubpb.ListTopicsRequest{Project: "projects/" + project})
+	for {
+		topic, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("pubsub: failed to list topics of project %s: %w", project, err)
+		}
+		topics = append(topics, topicFromProto(project, topic))
+	}
+	return topics, nil
+}
+
+// EnsureTopic makes sure the topic named by the URL host exists with the settings set in
+// config, creating or updating it as needed, and returns its configuration. It is safe to
+// call concurrently from several instances at startup.
+// URL format: pubsub://topic-name
+func (p *Provider) EnsureTopic(ctx context.Context, u *url.URL, config *TopicConfig) (*TopicConfig, error) {
+	client, project, err := p.adminClient(u)
+	if err != nil {
+		return nil, err
+	}
+	current, err := getTopic(ctx, client, project, u.Host)
+	if isNotFound(err) {
+		var created *TopicConfig
+		created, err = p.CreateTopic(ctx, u, config)
+		if !isAlreadyExists(err) {
+			return created, err
+		}
+		// Created concurrently by someone else
+		current, err = getTopic(ctx, client, project, u.Host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return updateTopic(ctx, client, project, current, config)
+}
+
+// CreateSubscription creates the subscription named by the URL host.
+// URL format: pubsub://subscription-name
+func (p *Provider) CreateSubscription(ctx context.Context, u *url.URL, config *SubscriptionConfig) (*SubscriptionConfig, error) {
+	client, project, err := p.adminClient(u)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("pubsub: subscription name (URL host) is required")
+	}
+	if config == nil || config.Topic == "" {
+		return nil, fmt.Errorf("pubsub: a topic is required to create subscription %s", u.Host)
+	}
+	sub, err := client.SubscriptionAdminClient.CreateSubscription(ctx, subscriptionToProto(project, u.Host, config))
+	if err != nil {
+		return nil, fmt.Errorf("pubsub: failed to create subscription %s: %w", u.Host, err)
+	}
+	return subscriptionFromProto(project, sub), nil
+}
+
+// GetSubscription returns the configuration of the subscription named by the URL host.
+// URL format: pubsub://subscription-name
+func (p *Provider) GetSubscription(ctx context.Context, u *url.URL) (*SubscriptionConfig, error) {
+	client, project, err := p.adminClient(u)
+	if err != nil {
+		return nil, err
+	}
+	return getSubscription(ctx, client, project, u.Host)
+}
+
+// UpdateSubscription updates the settings of the subscription named by the URL host to
+// those set in config. It fails if config differs from the subscription in a setting that
+// cannot be changed. Nothing is sent if the subscription already has the settings.
+// URL format: pubsub://subscription-name
+func (p *Provider) UpdateSubscription(ctx context.Context, u *url.URL, config *SubscriptionConfig) (*SubscriptionConfig, error) {
+	client, project, err := p.adminClient(u)
+	if err != nil {
+		return nil, err
+	}
+	current, err := getSubscription(ctx, client, project, u.Host)
+	if err != nil {
+		return nil, err
+	}
+	return updateSubscription(ctx, client, project, current, config)
+}
+
+// DeleteSubscription deletes the subscription named by the URL host.
+// URL format: pubsub://subscription-name
+func (p *Provider) DeleteSubscription(ctx context.Context, u *url.URL) error {
+	client, project, err := p.adminClient(u)
+	if err != nil {
+		return err
+	}
+	if u.Host == "" {
+		return fmt.Errorf("pubsub: subscription name (URL host) is required")
+	}
+	err = client.SubscriptionAdminClient.DeleteSubscription(ctx,
+		&pubsubpb.DeleteSubscriptionRequest{Subscription: subscriptionPath(project, u.Host)})
+	if err != nil {
+		return fmt.Errorf("pubsub: failed to delete subscription %s: %w", u.Host, err)
+	}
+	return nil
+}
+
+// ListSubscriptions returns the subscriptions of the project of the gcpsvc config resolved
+// for u.
+// URL format: pubsub:// or pubsub://any-name to select a per-name config
+func (p *Provider) ListSubscriptions(ctx context.Context, u *url.URL) ([]*SubscriptionConfig, error) {
+	client, project, err := p.adminClient(u)
+	if err != nil {
+		return nil, err
+	}
+	var subs []*SubscriptionConfig
+	it := client.SubscriptionAdminClient.ListSubscriptions(ctx,
+		&pubsubpb.ListSubscriptionsRequest{Project: "projects/" + project})
+	for {
+		sub, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("pubsub: failed to list subscriptions of project %s: %w", project, err)
+		}
+		subs = append(subs, subscriptionFromProto(project, sub))
+	}
+	return subs, nil
+}
+
+// EnsureSubscription makes sure the subscription named by the URL host exists with the
+// settings set in config, creating or updating it as needed, and returns its configuration.
+// It fails if an existing subscription differs in a setting that cannot be changed. It is
+// safe to call concurrently from several instances at startup.
+// URL format: pubsub://subscription-name
+func (p *Provider) EnsureSubscription(ctx context.Context, u *url.URL, config *SubscriptionConfig) (*SubscriptionConfig, error) {
+	client, project, err := p.adminClient(u)
+	if err != nil {
+		return nil, err
+	}
+	current, err := getSubscription(ctx, client, project, u.Host)
+	if isNotFound(err) {
+		var created *SubscriptionConfig
+		created, err = p.CreateSubscription(ctx, u, config)
+		if !isAlreadyExists(err) {
+			return created, err
+		}
+		// Created concurrently by someone else
+		current, err = getSubscription(ctx, client, project, u.Host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return updateSubscription(ctx, client, project, current, config)
+}
+
+// getTopic fetches a topic by ID.
+func getTopic(ctx context.Context, client *gpubsub.Client, project, name string) (*TopicConfig, error) {
+	if name == "" {
+		return nil, fmt.Errorf("pubsub: topic name (URL host) is required")
+	}
+	topic, err := client.TopicAdminClient.GetTopic(ctx, &pubsubpb.GetTopicRequest{Topic: topicPath(project, name)})
+	if err != nil {
+		return nil, fmt.Errorf("pubsub: failed to get topic %s: %w", name, err)
+	}
+	return topicFromProto(project, topic), nil
+}
+
+// updateTopic applies the settings of desired that differ from current.
+func updateTopic(ctx context.Context, client *gpubsub.Client, project string, current, desired *TopicConfig) (*TopicConfig, error) {
+	paths := topicUpdatePaths(current, desired)
+	if len(paths) == 0 {
+		return current, nil
+	}
+	topic, err := client.TopicAdminClient.UpdateTopic(ctx, &pubsubpb.UpdateTopicRequest{
+		Topic:      topicToProto(project, current.Name, desired),
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: paths},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("pubsub: failed to update topic %s: %w", current.Name, err)
+	}
+	return topicFromProto(project, topic), nil
+}
+
+// getSubscription fetches a subscription by ID.
+func getSubscription(ctx context.Context, client *gpubsub.Client, project, name string) (*SubscriptionConfig, error) {
+	if name == "" {
+		return nil, fmt.Errorf("pubsub: subscription name (URL host) is required")
+	}
+	sub, err := client.SubscriptionAdminClient.GetSubscription(ctx,
+		&pubsubpb.GetSubscriptionRequest{Subscription: subscriptionPath(project, name)})
+	if err != nil {
+		return nil, fmt.Errorf("pubsub: failed to get subscription %s: %w", name, err)
+	}
+	return subscriptionFromProto(project, sub), nil
+}
+
+// updateSubscription applies the settings of desired that differ from current.
+func updateSubscription(ctx context.Context, client *gpubsub.Client, project string, current, desired *SubscriptionConfig) (*SubscriptionConfig, error) {
+	paths, err := subscriptionUpdatePaths(project, current, desired)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return current, nil
+	}
+	sub, err := client.SubscriptionAdminClient.UpdateSubscription(ctx, &pubsubpb.UpdateSubscriptionRequest{
+		Subscription: subscriptionToProto(project, current.Name, desired),
+		UpdateMask:   &fieldmaskpb.FieldMask{Paths: paths},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("pubsub: failed to update subscription %s: %w", current.Name, err)
+	}
+	return subscriptionFromProto(project, sub), nil
+}
+
+// topicUpdatePaths returns the update mask paths of the settings of desired that differ
+// from current.
+func topicUpdatePaths(current, desired *TopicConfig) []string {
+	if desired == nil {
+		return nil
+	}
+	var paths []string
+	if desired.Labels != nil && !maps.Equal(desired.Labels, current.Labels) {
+		paths = append(paths, "labels")
+	}
+	if desired.MessageRetention != 0 && desired.MessageRetention != current.MessageRetention {
+		paths = append(paths, "message_retention_duration")
+	}
+	if desired.KMSKeyName != "" && desired.KMSKeyName != current.KMSKeyName {
+		paths = append(paths, "kms_key_name")
+	}
+	return paths
+}
+
+// subscriptionUpdatePaths returns the update mask paths of the settings of desired that
+// differ from current, or an error if they differ in a setting that cannot be changed.
+func subscriptionUpdatePaths(project string, current, desired *SubscriptionConfig) ([]string, error) {
+	if desired == nil {
+		return nil, nil
+	}
+	if desired.Topic != "" && topicPath(project, desired.Topic) != topicPath(project, current.Topic) {
+		return nil, fmt.Errorf("pubsub: subscription %s is attached to topic %s, not %s", current.Name, current.Topic, desired.Topic)
+	}
+	if desired.Filter != current.Filter {
+		return nil, fmt.Errorf("pubsub: subscription %s has filter %q, which cannot be changed to %q", current.Name, current.Filter, desired.Filter)
+	}
+	if desired.EnableMessageOrdering != current.EnableMessageOrdering {
+		return nil, fmt.Errorf("pubsub: message ordering of subscription %s cannot be changed", current.Name)
+	}
+
+	var paths []string
+	if desired.AckDeadline != 0 && desired.AckDeadline != current.AckDeadline {
+		paths = append(paths, "ack_deadline_seconds")
+	}
+	if desired.RetainAckedMessages != current.RetainAckedMessages {
+		paths = append(paths, "retain_acked_messages")
+	}
+	if desired.MessageRetention != 0 && desired.MessageRetention != current.MessageRetention {
+		paths = append(paths, "message_retention_duration")
+	}
+	if desired.Labels != nil && !maps.Equal(desired.Labels, current.Labels) {
+		paths = append(paths, "labels")
+	}
+	if desired.EnableExactlyOnceDelivery != current.EnableExactlyOnceDelivery {
+		paths = append(paths, "enable_exactly_once_delivery")
+	}
+	if desired.DeadLetterPolicy != nil && !sameDeadLetterPolicy(project, desired.DeadLetterPolicy, current.DeadLetterPolicy) {
+		paths = append(paths, "dead_letter_policy")
+	}
+	if desired.RetryPolicy != nil && (current.RetryPolicy == nil || *desired.RetryPolicy != *current.RetryPolicy) {
+		paths = append(paths, "retry_policy")
+	}
+	return paths, nil
+}
+
+// sameDeadLetterPolicy reports whether two dead-letter policies are equivalent.
+func sameDeadLetterPolicy(project string, a, b *DeadLetterPolicy) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return topicPath(project, a.Topic) == topicPath(project, b.Topic) && a.MaxDeliveryAttempts == b.MaxDeliveryAttempts
+}
+
+// topicToProto converts a topic configuration to its API representation.
+func topicToProto(project, name string, config *TopicConfig) *pubsubpb.Topic {
+	topic := &pubsubpb.Topic{Name: topicPath(project, name)}
+	if config == nil {
+		return topic
+	}
+	topic.Labels = config.Labels
+	topic.KmsKeyName = config.KMSKeyName
+	if config.MessageRetention > 0 {
+		topic.MessageRetentionDuration = durationpb.New(config.MessageRetention)
+	}
+	return topic
+}
+
+// topicFromProto converts an API topic to its configuration.
+func topicFromProto(project string, topic *pubsubpb.Topic) *TopicConfig {
+	return &TopicConfig{
+		Name:             shortName(project, "topics", topic.GetName()),
+		Labels:           topic.GetLabels(),
+		MessageRetention: topic.GetMessageRetentionDuration().AsDuration(),
+		KMSKeyName:       topic.GetKmsKeyName(),
+	}
+}
+
+// subscriptionToProto converts a subscription configuration to its API representation.
+func subscriptionToProto(project, name string, config *SubscriptionConfig) *pubsubpb.Subscription {
+	sub := &pubsubpb.Subscription{Name: subscriptionPath(project, name)}
+	if config == nil {
+		return sub
+	}
+	if config.Topic != "" {
+		sub.Topic = topicPath(project, config.Topic)
+	}
+	sub.AckDeadlineSeconds = int32(config.AckDeadline / time.Second)
+	sub.RetainAckedMessages = config.RetainAckedMessages
+	if config.MessageRetention > 0 {
+		sub.MessageRetentionDuration = durationpb.New(config.MessageRetention)
+	}
+	sub.Labels = config.Labels
+	sub.Filter = config.Filter
+	sub.EnableMessageOrdering = config.EnableMessageOrdering
+	sub.EnableExactlyOnceDelivery = config.EnableExactlyOnceDelivery
+	if dlp := config.DeadLetterPolicy; dlp != nil {
+		sub.DeadLetterPolicy = &pubsubpb.DeadLetterPolicy{
+			DeadLetterTopic:     topicPath(project, dlp.Topic),
+			MaxDeliveryAttempts: int32(dlp.MaxDeliveryAttempts),
+		}
+	}
+	if rp := config.RetryPolicy; rp != nil {
+		sub.RetryPolicy = &pubsubpb.RetryPolicy{
+			MinimumBackoff: durationpb.New(rp.MinimumBackoff),
+			MaximumBackoff: durationpb.New(rp.MaximumBackoff),
+		}
+	}
+	return sub
+}
+
+// subscriptionFromProto converts an API subscription to its configuration.
+func subscriptionFromProto(project string, sub *pubsubpb.Subscription) *SubscriptionConfig {
+	config := &SubscriptionConfig{
+		Name:                      shortName(project, "subscriptions", sub.GetName()),
+		Topic:                     shortName(project, "topics", sub.GetTopic()),
+		AckDeadline:               time.Duration(sub.GetAckDeadlineSeconds()) * time.Second,
+		RetainAckedMessages:       sub.GetRetainAckedMessages(),
+		MessageRetention:          sub.GetMessageRetentionDuration().AsDuration(),
+		Labels:                    sub.GetLabels(),
+		Filter:                    sub.GetFilter(),
+		EnableMessageOrdering:     sub.GetEnableMessageOrdering(),
+		EnableExactlyOnceDelivery: sub.GetEnableExactlyOnceDelivery(),
+	}
+	if dlp := sub.GetDeadLetterPolicy(); dlp != nil {
+		config.DeadLetterPolicy = &DeadLetterPolicy{
+			Topic:               shortName(project, "topics", dlp.GetDeadLetterTopic()),
+			MaxDeliveryAttempts: int(dlp.GetMaxDeliveryAttempts()),
+		}
+	}
+	if rp := sub.GetRetryPolicy(); rp != nil {
+		config.RetryPolicy = &RetryPolicy{
+			MinimumBackoff: rp.GetMinimumBackoff().AsDuration(),
+			MaximumBackoff: rp.GetMaximumBackoff().AsDuration(),
+		}
+	}
+	return config
+}
+
+// topicPath returns the full name of a topic. Full names are returned unchanged.
+func topicPath(project, name string) string {
+	return resourcePath(project, "topics", name)
+}
+
+// subscriptionPath returns the full name of a subscription. Full names are returned
+// unchanged.
+func subscriptionPath(project, name string) string {
+	return resourcePath(project, "subscriptions", name)
+}
+
+// resourcePath returns projects/<project>/<collection>/<name> unless name is already a
+// full resource name.
+func resourcePath(project, collection, name string) string {
+	if strings.HasPrefix(name, "projects/") {
+		return name
+	}
+	return "projects/" + project + "/" + collection + "/" + name
+}
+
+// shortName returns the ID of a resource of the given project, or the full name of a
+// resource of another project.
+func shortName(project, collection, name string) string {
+	return strings.TrimPrefix(name, "projects/"+project+"/"+collection+"/")
+}
+
+// isNotFound reports whether err means the resource does not exist.
+func isNotFound(err error) bool {
+	return status.Code(err) == codes.NotFound
+}
+
+// isAlreadyExists reports whether err means the resource already exists.
+func isAlreadyExists(err error) bool {
+	return status.Code(err) == codes.AlreadyExists
+}
@@ -0,0 +1,135 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestResourcePaths(t *testing.T) {
+	if got := topicPath("proj", "orders"); got != "projects/proj/topics/orders" {
+		t.Errorf("unexpected topic path %q", got)
+	}
+	if got := topicPath("proj", "projects/other/topics/orders"); got != "projects/other/topics/orders" {
+		t.Errorf("expected full names to be kept, got %q", got)
+	}
+	if got := subscriptionPath("proj", "orders-sub"); got != "projects/proj/subscriptions/orders-sub" {
+		t.Errorf("unexpected subscription path %q", got)
+	}
+	if got := shortName("proj", "topics", "projects/proj/topics/orders"); got != "orders" {
+		t.Errorf("expected topic ID, got %q", got)
+	}
+	if got := shortName("proj", "topics", "projects/other/topics/orders"); got != "projects/other/topics/orders" {
+		t.Errorf("expected full name for another project, got %q", got)
+	}
+}
+
+func TestTopicUpdatePaths(t *testing.T) {
+	current := &TopicConfig{Name: "orders", Labels: map[string]string{"team": "a"}, MessageRetention: time.Hour}
+	if paths := topicUpdatePaths(current, &TopicConfig{}); len(paths) != 0 {
+		t.Errorf("expected no paths for an empty config, got %v", paths)
+	}
+	if paths := topicUpdatePaths(current, nil); len(paths) != 0 {
+		t.Errorf("expected no paths for a nil config, got %v", paths)
+	}
+	desired := &TopicConfig{Labels: map[string]string{"team": "b"}, MessageRetention: time.Hour, KMSKeyName: "key"}
+	want := []string{"labels", "kms_key_name"}
+	if paths := topicUpdatePaths(current, desired); !reflect.DeepEqual(paths, want) {
+		t.Errorf("got %v, want %v", paths, want)
+	}
+}
+
+func TestSubscriptionUpdatePaths(t *testing.T) {
+	current := &SubscriptionConfig{
+		Name:        "orders-sub",
+		Topic:       "orders",
+		AckDeadline: 10 * time.Second,
+		RetryPolicy: &RetryPolicy{MinimumBackoff: time.Second, MaximumBackoff: time.Minute},
+	}
+	paths, err := subscriptionUpdatePaths("proj", current, &SubscriptionConfig{Topic: "projects/proj/topics/orders"})
+	if err != nil || len(paths) != 0 {
+		t.Errorf("expected no changes, got %v, %v", paths, err)
+	}
+
+	desired := &SubscriptionConfig{
+		Topic:                     "orders",
+		AckDeadline:               time.Minute,
+		EnableExactlyOnceDelivery: true,
+		DeadLetterPolicy:          &DeadLetterPolicy{Topic: "orders-dlq", MaxDeliveryAttempts: 5},
+		RetryPolicy:               &RetryPolicy{MinimumBackoff: time.Second, MaximumBackoff: time.Minute},
+	}
+	paths, err = subscriptionUpdatePaths("proj", current, desired)
+	want := []string{"ack_deadline_seconds", "enable_exactly_once_delivery", "dead_letter_policy"}
+	if err != nil || !reflect.DeepEqual(paths, want) {
+		t.Errorf("got %v, %v, want %v", paths, err, want)
+	}
+}
+
+func TestSubscriptionUpdatePaths_Immutable(t *testing.T) {
+	current := &SubscriptionConfig{Name: "orders-sub", Topic: "orders", Filter: `attributes.type = "a"`}
+	for _, desired := range []*SubscriptionConfig{
+		{Topic: "payments", Filter: current.Filter},
+		{Topic: "orders"},
+		{Topic: "orders", Filter: current.Filter, EnableMessageOrdering: true},
+	} {
+		if _, err := subscriptionUpdatePaths("proj", current, desired); err == nil {
+			t.Errorf("expected an error for %+v", desired)
+		}
+	}
+}
+
+func TestSubscriptionProtoRoundTrip(t *testing.T) {
+	config := &SubscriptionConfig{
+		Name:                      "orders-sub",
+		Topic:                     "orders",
+		AckDeadline:               30 * time.Second,
+		RetainAckedMessages:       true,
+		MessageRetention:          24 * time.Hour,
+		Labels:                    map[string]string{"team": "a"},
+		Filter:                    `attributes.type = "a"`,
+		EnableMessageOrdering:     true,
+		EnableExactlyOnceDelivery: true,
+		DeadLetterPolicy:          &DeadLetterPolicy{Topic: "projects/other/topics/dlq", MaxDeliveryAttempts: 10},
+		RetryPolicy:               &RetryPolicy{MinimumBackoff: time.Second, MaximumBackoff: time.Minute},
+	}
+	sub := subscriptionToProto("proj", "orders-sub", config)
+	if sub.Name != "projects/proj/subscriptions/orders-sub" || sub.Topic != "projects/proj/topics/orders" {
+		t.Errorf("unexpected names %q, %q", sub.Name, sub.Topic)
+	}
+	if got := subscriptionFromProto("proj", sub); !reflect.DeepEqual(got, config) {
+		t.Errorf("got %+v, want %+v", got, config)
+	}
+}
+
+func TestTopicProtoRoundTrip(t *testing.T) {
+	config := &TopicConfig{Name: "orders", Labels: map[string]string{"team": "a"}, MessageRetention: time.Hour, KMSKeyName: "key"}
+	if got := topicFromProto("proj", topicToProto("proj", "orders", config)); !reflect.DeepEqual(got, config) {
+		t.Errorf("got %+v, want %+v", got, config)
+	}
+	if topic := topicToProto("proj", "orders", nil); topic.Name != "projects/proj/topics/orders" {
+		t.Errorf("unexpected topic %v", topic)
+	}
+}
+
+func TestIsNotFound(t *testing.T) {
+	err := fmt.Errorf("pubsub: failed to get topic orders: %w", status.Error(codes.NotFound, "not found"))
+	if !isNotFound(err) || isAlreadyExists(err) {
+		t.Error("expected a wrapped NotFound error to be detected")
+	}
+	if isNotFound(nil) {
+		t.Error("expected nil not to be NotFound")
+	}
+}
+
+func TestEnsureTopic_NoConfig(t *testing.T) {
+	u, _ := url.Parse("pubsub://unregistered-admin-topic")
+	if _, err := (&Provider{}).EnsureTopic(context.Background(), u, nil); err == nil {
+		t.Error("expected an error without a registered config")
+	}
+}
@@ -0,0 +1,219 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+
+	gpubsub "cloud.google.com/go/pubsub/v2"
+	"oss.nandlabs.io/golly/messaging"
+)
+
+// Option keys for asynchronous publishing.
+const (
+	// OptPublishCallback is a func(msg messaging.Message, messageId string, err error) called
+	// once for every message published by PublishAsync or PublishBatchAsync, when its
+	// publish completes.
+	OptPublishCallback = "PublishCallback"
+	// OptPublishResults is a chan<- *PublishResult that receives the result of every message
+	// published by PublishAsync or PublishBatchAsync, when its publish completes. Sends
+	// block, so the channel must be drained.
+	OptPublishResults = "PublishResults"
+)
+
+// PublishResult is the pending result of an asynchronous publish.
+type PublishResult struct {
+	// Index is the position of the message in the batch passed to PublishBatchAsync, or 0
+	// for PublishAsync.
+	Index int
+	// Message is the published message.
+	Message messaging.Message
+
+	done chan struct{}
+	id   string
+	err  error
+}
+
+// newPublishResult returns the handle of a publish that is pending in result, or that
+// failed before reaching the publisher with err. onError, if not nil, is called when the
+// publish fails, before the result completes.
+func newPublishResult(index int, msg messaging.Message, result *gpubsub.PublishResult, err error, onError func()) *PublishResult {
+	r := &PublishResult{Index: index, Message: msg, done: make(chan struct{})}
+	if result == nil {
+		r.complete("", err)
+		return r
+	}
+	go func() {
+		<-result.Ready()
+		id, err := result.Get(context.Background())
+		if err != nil {
+			err = fmt.Errorf("pubsub: publish failed: %w", err)
+			if onError != nil {
+				onError()
+			}
+		}
+		r.complete(id, err)
+	}()
+	return r
+}
+
+// Ready returns a channel that is closed when the result is available.
+func (r *PublishResult) Ready() <-chan struct{} {
+	return r.done
+}
+
+// Get waits until the publish completes or ctx is done and returns the server-assigned
+// message ID or the publish error. On success the ID is also stored on the message if it is
+// a *MessagePubSub.
+func (r *PublishResult) Get(ctx context.Context) (string, error) {
+	select {
+	case <-r.done:
+		return r.id, r.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// complete records the outcome and releases waiters. It is called exactly once.
+func (r *PublishResult) complete(id string, err error) {
+	r.id, r.err = id, err
+	if psMsg, ok := r.Message.(*MessagePubSub); ok && err == nil {
+		psMsg.messageId = id
+	}
+	close(r.done)
+}
+
+// BatchError reports the messages of a batch that failed to publish. Failed messages can
+// be retried by index without republishing the ones that succeeded.
+type BatchError struct {
+	// Total is the number of messages in the batch.
+	Total int
+	// Errors maps the index of every failed message to its error.
+	Errors map[int]error
+}
+
+// Error summarises the failures, citing the first failed index.
+func (e *BatchError) Error() string {
+	failed := e.Failed()
+	if len(failed) == 0 {
+		return fmt.Sprintf("pubsub: 0 of %d messages failed to publish", e.Total)
+	}
+	return fmt.Sprintf("pubsub: %d of %d messages failed to publish, first at index %d: %v",
+		len(failed), e.Total, failed[0], e.Errors[failed[0]])
+}
+
+// Failed returns the indexes of the failed messages in ascending order.
+func (e *BatchError) Failed() []int {
+	failed := make([]int, 0, len(e.Errors))
+	for i := range e.Errors {
+		failed = append(failed, i)
+	}
+	sort.Ints(failed)
+	return failed
+}
+
+// Unwrap returns the individual publish errors, ordered by index, for errors.Is and errors.As.
+func (e *BatchError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errors))
+	for _, i := range e.Failed() {
+		errs = append(errs, e.Errors[i])
+	}
+	return errs
+}
+
+// PublishAsync publishes a message to a Pub/Sub topic without waiting for the server and
+// returns a handle to its result. The message is batched with other messages published to
+// the same topic.
+// URL format: pubsub://topic-name
+// Supported options: OrderingKey, ResumeAfterError, PublishBatchCount, PublishBatchBytes,
+// PublishBatchDelay, PublishCallback, PublishResults.
+func (p *Provider) PublishAsync(u *url.URL, msg messaging.Message, options ...messaging.Option) *PublishResult {
+	return p.PublishBatchAsync(u, []messaging.Message{msg}, options...)[0]
+}
+
+// PublishBatchAsync publishes messages to a Pub/Sub topic without waiting for the server and
+// returns a result handle per message, in the order of msgs. Use WaitBatch to wait for all of
+// them and collect the failures. Each message is published with its own ordering key if set,
+// or else the OrderingKey option.
+// Supported options: see PublishAsync.
+func (p *Provider) PublishBatchAsync(u *url.URL, msgs []messaging.Message, options ...messaging.Option) []*PublishResult {
+	optResolver := messaging.NewOptionsResolver(options...)
+	var results []*PublishResult
+	if publisher, err := p.publisher(u, optResolver, ordered(msgs, optResolver)); err != nil {
+		results = make([]*PublishResult, len(msgs))
+		for i, msg := range msgs {
+			results[i] = newPublishResult(i, msg, nil, err, nil)
+		}
+	} else {
+		results = publishAll(publisher, msgs, optResolver)
+	}
+	notifyResults(results, optResolver)
+	return results
+}
+
+// publishAll hands every message to the publisher and returns their pending results.
+// Ordering keys paused by a failed publish are resumed unless ResumeAfterError is false.
+func publishAll(publisher *gpubsub.Publisher, msgs []messaging.Message, optResolver *messaging.OptionsResolver) []*PublishResult {
+	ctx := context.Background()
+	resume := resumeAfterError(optResolver)
+	results := make([]*PublishResult, len(msgs))
+	for i, msg := range msgs {
+		message := &gpubsub.Message{
+			Data:        msg.ReadBytes(),
+			Attributes:  buildAttributes(msg),
+			OrderingKey: orderingKey(msg, optResolver),
+		}
+		results[i] = newPublishResult(i, msg, publisher.Publish(ctx, message), nil,
+			resumer(publisher, message.OrderingKey, resume))
+	}
+	return results
+}
+
+// WaitBatch waits for every result and returns a *BatchError describing the failed
+// messages, or nil if all of them were published.
+func WaitBatch(ctx context.Context, results []*PublishResult) error {
+	batchErr := &BatchError{Total: len(results), Errors: make(map[int]error)}
+	for i, result := range results {
+		if _, err := result.Get(ctx); err != nil {
+			batchErr.Errors[i] = err
+		}
+	}
+	if len(batchErr.Errors) > 0 {
+		return batchErr
+	}
+	return nil
+}
+
+// notifyResults delivers completed results to the callback and channel options, in order,
+// from a background goroutine.
+func notifyResults(results []*PublishResult, optResolver *messaging.OptionsResolver) {
+	var callback func(messaging.Message, string, error)
+	if v, ok := optResolver.Get(OptPublishCallback); ok {
+		callback = v.(func(messaging.Message, string, error))
+	}
+	var resultChan chan<- *PublishResult
+	if v, ok := optResolver.Get(OptPublishResults); ok {
+		switch ch := v.(type) {
+		case chan *PublishResult:
+			resultChan = ch
+		case chan<- *PublishResult:
+			resultChan = ch
+		}
+	}
+	if callback == nil && resultChan == nil {
+		return
+	}
+
+	go func() {
+		for _, result := range results {
+			id, err := result.Get(context.Background())
+			if callback != nil {
+				callback(result.Message, id, err)
+			}
+			if resultChan != nil {
+				resultChan <- result
+			}
+		}
+	}()
+}
@@ -0,0 +1,120 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"oss.nandlabs.io/golly/messaging"
+)
+
+func TestBatchError(t *testing.T) {
+	errA := errors.New("a")
+	errB := errors.New("b")
+	batchErr := &BatchError{Total: 5, Errors: map[int]error{3: errB, 1: errA}}
+
+	if got := batchErr.Failed(); !reflect.DeepEqual(got, []int{1, 3}) {
+		t.Errorf("expected failed indexes [1 3], got %v", got)
+	}
+	if msg := batchErr.Error(); !strings.Contains(msg, "2 of 5") || !strings.Contains(msg, "index 1") {
+		t.Errorf("unexpected error message %q", msg)
+	}
+	if !errors.Is(batchErr, errA) || !errors.Is(batchErr, errB) {
+		t.Error("expected errors.Is to match the individual errors")
+	}
+}
+
+func TestNewPublishResult_EarlyError(t *testing.T) {
+	msg, _ := (&Provider{}).NewMessage(PubSubScheme)
+	result := newPublishResult(2, msg, nil, errors.New("publish failed"), nil)
+
+	select {
+	case <-result.Ready():
+	default:
+		t.Fatal("expected the result to be ready")
+	}
+	id, err := result.Get(context.Background())
+	if id != "" || err == nil || err.Error() != "publish failed" {
+		t.Errorf("expected the publish error, got %q, %v", id, err)
+	}
+	if result.Index != 2 || result.Message != msg {
+		t.Errorf("unexpected result %+v", result)
+	}
+}
+
+func TestWaitBatch(t *testing.T) {
+	msg, _ := (&Provider{}).NewMessage(PubSubScheme)
+	if err := WaitBatch(context.Background(), nil); err != nil {
+		t.Errorf("expected nil error for an empty batch, got %v", err)
+	}
+
+	ok := &PublishResult{Message: msg, done: make(chan struct{})}
+	ok.complete("id-0", nil)
+	results := []*PublishResult{ok, newPublishResult(1, msg, nil, errors.New("publish failed"), nil)}
+	err := WaitBatch(context.Background(), results)
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("expected *BatchError, got %v", err)
+	}
+	if batchErr.Total != 2 || !reflect.DeepEqual(batchErr.Failed(), []int{1}) {
+		t.Errorf("unexpected batch error %+v", batchErr)
+	}
+	if msg.(*MessagePubSub).messageId != "id-0" {
+		t.Errorf("expected message ID to be stored on the message, got %q", msg.(*MessagePubSub).messageId)
+	}
+}
+
+func TestWaitBatch_ContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	pending := &PublishResult{done: make(chan struct{})}
+	err := WaitBatch(ctx, []*PublishResult{pending})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestPublishBatchAsync_Notify(t *testing.T) {
+	// No gcpsvc config is registered for the topic, so every publish fails
+	p := &Provider{}
+	msgs := make([]messaging.Message, 3)
+	for i := range msgs {
+		msgs[i], _ = p.NewMessage(PubSubScheme)
+	}
+
+	var calls []int
+	resultChan := make(chan *PublishResult, len(msgs))
+	options := messaging.NewOptionsBuilder().
+		Add(OptPublishCallback, func(msg messaging.Message, id string, err error) {
+			for i := range msgs {
+				if msgs[i] == msg && err != nil {
+					calls = append(calls, i)
+				}
+			}
+		}).
+		Add(OptPublishResults, resultChan).
+		Build()
+	u, _ := url.Parse("pubsub://async-unregistered-topic")
+	results := p.PublishBatchAsync(u, msgs, options...)
+	if len(results) != len(msgs) {
+		t.Fatalf("expected %d results, got %d", len(msgs), len(results))
+	}
+
+	for i := range msgs {
+		select {
+		case result := <-resultChan:
+			if result.Index != i {
+				t.Errorf("expected result %d, got %d", i, result.Index)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for results")
+		}
+	}
+	if !reflect.DeepEqual(calls, []int{0, 1, 2}) {
+		t.Errorf("expected callbacks for every message in order, got %v", calls)
+	}
+}
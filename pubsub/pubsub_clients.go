@@ -0,0 +1,132 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	gpubsub "cloud.google.com/go/pubsub/v2"
+	"oss.nandlabs.io/golly-gcp/gcpsvc"
+	"oss.nandlabs.io/golly/messaging"
+)
+
+// clientEntry is a cached Pub/Sub client and the publishers created from it.
+type clientEntry struct {
+	client     *gpubsub.Client
+	publishers map[publisherKey]*gpubsub.Publisher
+}
+
+// publisherKey identifies a cached publisher. Publishers are configured when created, so
+// sends with different batching settings or ordering use different publishers.
+type publisherKey struct {
+	topic    string
+	ordering bool
+	count    int
+	bytes    int
+	delay    time.Duration
+}
+
+// newPublisherKey returns the publisher key for a topic and the options of a send, with
+// message ordering enabled if ordering is true.
+func newPublisherKey(topic string, optResolver *messaging.OptionsResolver, ordering bool) publisherKey {
+	key := publisherKey{topic: topic, ordering: ordering}
+	if v, ok := optResolver.Get(OptPublishBatchCount); ok {
+		key.count = v.(int)
+	}
+	if v, ok := optResolver.Get(OptPublishBatchBytes); ok {
+		key.bytes = v.(int)
+	}
+	if v, ok := optResolver.Get(OptPublishBatchDelay); ok {
+		key.delay = time.Duration(v.(int)) * time.Millisecond
+	}
+	return key
+}
+
+// apply configures a new publisher with the settings of the key. Zero settings keep the
+// client library defaults.
+func (k publisherKey) apply(publisher *gpubsub.Publisher) {
+	publisher.EnableMessageOrdering = k.ordering
+	if k.count > 0 {
+		publisher.PublishSettings.CountThreshold = k.count
+	}
+	if k.bytes > 0 {
+		publisher.PublishSettings.ByteThreshold = k.bytes
+	}
+	if k.delay > 0 {
+		publisher.PublishSettings.DelayThreshold = k.delay
+	}
+}
+
+// client returns the cached Pub/Sub client for the gcpsvc config resolved for u, creating
+// it on first use. Clients are shared by all operations until Close, and created again by
+// the next call after it.
+func (p *Provider) client(u *url.URL) (*clientEntry, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.clientLocked(u)
+}
+
+// clientLocked is client for callers holding p.mu.
+func (p *Provider) clientLocked(u *url.URL) (*clientEntry, error) {
+	cfg := gcpsvc.GetConfig(u, PubSubScheme)
+	if cfg == nil || cfg.ProjectId == "" {
+		return nil, fmt.Errorf("pubsub: no GCP config with ProjectId registered for %v", u)
+	}
+	if entry, ok := p.clients[cfg]; ok {
+		return entry, nil
+	}
+	client, err := getPubSubClient(u)
+	if err != nil {
+		return nil, err
+	}
+	if p.clients == nil {
+		p.clients = make(map[*gcpsvc.Config]*clientEntry)
+	}
+	entry := &clientEntry{client: client, publishers: make(map[publisherKey]*gpubsub.Publisher)}
+	p.clients[cfg] = entry
+	return entry, nil
+}
+
+// publisher returns the cached publisher for the topic of u and the options of a send,
+// creating it on first use. Publishers are safe for concurrent use and batch messages
+// published from all callers. Messages with ordering keys require ordering to be true.
+func (p *Provider) publisher(u *url.URL, optResolver *messaging.OptionsResolver, ordering bool) (*gpubsub.Publisher, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// The client is resolved under the same lock as the publisher, so a concurrent Close
+	// cannot drop it in between and leave the publisher on a closed client.
+	entry, err := p.clientLocked(u)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("pubsub: topic name (URL host) is required")
+	}
+	key := newPublisherKey(u.Host, optResolver, ordering)
+	if publisher, ok := entry.publishers[key]; ok {
+		return publisher, nil
+	}
+	publisher, err := resolvePublisher(entry.client, u)
+	if err != nil {
+		return nil, err
+	}
+	key.apply(publisher)
+	entry.publishers[key] = publisher
+	return publisher, nil
+}
+
+// closeClients flushes and stops every cached publisher, then closes the cached clients.
+func closeClients(clients map[*gcpsvc.Config]*clientEntry) error {
+	var errs []error
+	for _, entry := range clients {
+		for _, publisher := range entry.publishers {
+			// Stop blocks until all pending messages have been published
+			publisher.Stop()
+		}
+		if err := entry.client.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("pubsub: failed to close client: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
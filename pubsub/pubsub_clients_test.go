@@ -0,0 +1,83 @@
+package pubsub
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	gpubsub "cloud.google.com/go/pubsub/v2"
+	"oss.nandlabs.io/golly-gcp/gcpsvc"
+	"oss.nandlabs.io/golly/messaging"
+)
+
+func TestNewPublisherKey_Defaults(t *testing.T) {
+	key := newPublisherKey("orders", messaging.NewOptionsResolver(), false)
+	if key != (publisherKey{topic: "orders"}) {
+		t.Errorf("unexpected key %+v", key)
+	}
+}
+
+func TestNewPublisherKey_Options(t *testing.T) {
+	options := messaging.NewOptionsBuilder().
+		Add(OptPublishBatchCount, 500).
+		Add(OptPublishBatchBytes, 4<<20).
+		Add(OptPublishBatchDelay, 50).
+		Build()
+	key := newPublisherKey("orders", messaging.NewOptionsResolver(options...), true)
+	want := publisherKey{topic: "orders", ordering: true, count: 500, bytes: 4 << 20, delay: 50 * time.Millisecond}
+	if key != want {
+		t.Errorf("got %+v, want %+v", key, want)
+	}
+}
+
+func TestPublisherKey_Apply(t *testing.T) {
+	publisher := &gpubsub.Publisher{PublishSettings: gpubsub.DefaultPublishSettings}
+	publisherKey{topic: "orders", count: 500, delay: 50 * time.Millisecond}.apply(publisher)
+	if publisher.EnableMessageOrdering {
+		t.Error("expected ordering to stay disabled")
+	}
+	if publisher.PublishSettings.CountThreshold != 500 {
+		t.Errorf("expected count threshold 500, got %d", publisher.PublishSettings.CountThreshold)
+	}
+	if publisher.PublishSettings.ByteThreshold != gpubsub.DefaultPublishSettings.ByteThreshold {
+		t.Errorf("expected default byte threshold, got %d", publisher.PublishSettings.ByteThreshold)
+	}
+	if publisher.PublishSettings.DelayThreshold != 50*time.Millisecond {
+		t.Errorf("expected 50ms delay, got %v", publisher.PublishSettings.DelayThreshold)
+	}
+}
+
+func TestProvider_ClientAfterClose(t *testing.T) {
+	t.Setenv("PUBSUB_EMULATOR_HOST", "localhost:8085")
+	gcpsvc.Manager.Register("closed-provider-topic", &gcpsvc.Config{ProjectId: "test-project"})
+	defer gcpsvc.Manager.Unregister("closed-provider-topic")
+
+	p := &Provider{}
+	u, _ := url.Parse("pubsub://closed-provider-topic")
+	first, err := p.client(u)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.clients != nil {
+		t.Error("expected the cached clients to be dropped by Close")
+	}
+	second, err := p.client(u)
+	if err != nil {
+		t.Fatalf("expected a new client after Close, got %v", err)
+	}
+	if second == first {
+		t.Error("expected Close not to reuse the closed client")
+	}
+	if err := p.Close(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCloseClients_Empty(t *testing.T) {
+	if err := closeClients(nil); err != nil {
+		t.Errorf("expected nil error, got %v", err)
+	}
+}
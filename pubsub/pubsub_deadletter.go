@@ -0,0 +1,314 @@
+package pubsub
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gpubsub "cloud.google.com/go/pubsub/v2"
+	"oss.nandlabs.io/golly-gcp/gcpsvc"
+	"oss.nandlabs.io/golly/messaging"
+)
+
+// Listener options for client-side dead-lettering.
+const (
+	// OptDeadLetterTopic is the ID of a topic that AddListener forwards a message to, and
+	// acks it, once it has been delivered more than MaxDeliveryAttempts times. Use it for
+	// subscriptions without a dead-letter policy. Unless the subscription reports delivery
+	// attempts, deliveries are counted in memory by each listener process: counts start over
+	// when the listener restarts, are not shared between processes receiving from the same
+	// subscription, and are dropped for messages not redelivered within an hour.
+	OptDeadLetterTopic = "DeadLetterTopic"
+	// OptMaxDeliveryAttempts is the number of deliveries to the listener before a message is
+	// dead-lettered. Default: 5.
+	OptMaxDeliveryAttempts = "MaxDeliveryAttempts"
+)
+
+// defaultMaxDeliveryAttempts is the default of OptMaxDeliveryAttempts.
+const defaultMaxDeliveryAttempts = 5
+
+// Bounds of the delivery counts kept by a deadLetterRouter. The count of a message that is
+// not redelivered within deliveryCountTTL is dropped, and the least recently delivered
+// messages are dropped beyond maxDeliveryCounts.
+const (
+	deliveryCountTTL  = time.Hour
+	maxDeliveryCounts = 100000
+)
+
+// Attributes added to dead-lettered messages. They match the attributes set by Pub/Sub
+// dead-letter policies, so messages dead-lettered by either can be handled alike.
+const (
+	// AttrDeadLetterDeliveryCount is the number of delivery attempts of the message.
+	AttrDeadLetterDeliveryCount = "CloudPubSubDeadLetterSourceDeliveryCount"
+	// AttrDeadLetterSubscription is the ID of the subscription the message was received from.
+	AttrDeadLetterSubscription = "CloudPubSubDeadLetterSourceSubscription"
+	// AttrDeadLetterSubscriptionProject is the project of that subscription.
+	AttrDeadLetterSubscriptionProject = "CloudPubSubDeadLetterSourceSubscriptionProject"
+	// AttrDeadLetterPublishTime is when the message was originally published.
+	AttrDeadLetterPublishTime = "CloudPubSubDeadLetterSourceTopicPublishTime"
+)
+
+// deadLetterPrefix is the common prefix of the dead-letter attributes.
+const deadLetterPrefix = "CloudPubSubDeadLetter"
+
+// defaultReplayIdleTimeout is the default of ReplayOptions.IdleTimeout.
+const defaultReplayIdleTimeout = 10 * time.Second
+
+// deadLetterRouter forwards messages of a listener that exceeded their delivery attempts to
+// a dead-letter topic. When the subscription has no dead-letter policy, Pub/Sub does not
+// report delivery attempts, so they are counted per listener by message ID. Those counts
+// start over when the listener restarts and are bounded as described by deliveryCountTTL.
+type deadLetterRouter struct {
+	provider     *Provider
+	topic        *url.URL
+	subscription string
+	project      string
+	maxAttempts  int
+
+	mu       sync.Mutex
+	attempts map[string]*list.Element
+	// recent orders the counts by last delivery, most recent first.
+	recent *list.List
+}
+
+// deliveryCount is the number of deliveries of a message seen by a deadLetterRouter.
+type deliveryCount struct {
+	id    string
+	count int
+	seen  time.Time
+}
+
+// newDeadLetterRouter returns the router configured by the listener options, or nil if
+// OptDeadLetterTopic is not set.
+func newDeadLetterRouter(p *Provider, u *url.URL, optResolver *messaging.OptionsResolver) *deadLetterRouter {
+	v, ok := optResolver.Get(OptDeadLetterTopic)
+	if !ok || v.(string) == "" {
+		return nil
+	}
+	r := &deadLetterRouter{
+		provider:     p,
+		topic:        &url.URL{Scheme: PubSubScheme, Host: v.(string)},
+		subscription: u.Host,
+		maxAttempts:  defaultMaxDeliveryAttempts,
+		attempts:     make(map[string]*list.Element),
+		recent:       list.New(),
+	}
+	if v, ok := optResolver.Get(OptMaxDeliveryAttempts); ok && v.(int) > 0 {
+		r.maxAttempts = v.(int)
+	}
+	if cfg := gcpsvc.GetConfig(u, PubSubScheme); cfg != nil {
+		r.project = cfg.ProjectId
+	}
+	return r
+}
+
+// attempt records a delivery of m and returns its delivery attempt.
+func (r *deadLetterRouter) attempt(m *gpubsub.Message) int {
+	if m.DeliveryAttempt != nil {
+		return *m.DeliveryAttempt
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.expire(now)
+	elem, ok := r.attempts[m.ID]
+	if ok {
+		r.recent.MoveToFront(elem)
+	} else {
+		elem = r.recent.PushFront(&deliveryCount{id: m.ID})
+		r.attempts[m.ID] = elem
+	}
+	dc := elem.Value.(*deliveryCount)
+	dc.count++
+	dc.seen = now
+	for r.recent.Len() > maxDeliveryCounts {
+		r.remove(r.recent.Back())
+	}
+	return dc.count
+}
+
+// expire drops the counts of messages not delivered since deliveryCountTTL. Must be called
+// with mu held.
+func (r *deadLetterRouter) expire(now time.Time) {
+	for elem := r.recent.Back(); elem != nil && now.Sub(elem.Value.(*deliveryCount).seen) > deliveryCountTTL; elem = r.recent.Back() {
+		r.remove(elem)
+	}
+}
+
+// remove drops a delivery count. Must be called with mu held.
+func (r *deadLetterRouter) remove(elem *list.Element) {
+	r.recent.Remove(elem)
+	delete(r.attempts, elem.Value.(*deliveryCount).id)
+}
+
+// forget drops the delivery count of an acknowledged message.
+func (r *deadLetterRouter) forget(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if elem, ok := r.attempts[id]; ok {
+		r.remove(elem)
+	}
+}
+
+// exceeded reports whether a message delivered for the given attempt must be dead-lettered.
+func (r *deadLetterRouter) exceeded(attempt int) bool {
+	return attempt > r.maxAttempts
+}
+
+// deadLetter publishes m to the dead-letter topic and acks it. If the publish fails the
+// message is nacked so that it is tried again, and the error is returned.
+func (r *deadLetterRouter) deadLetter(ctx context.Context, m *gpubsub.Message, attempt int) error {
+	publisher, err := r.provider.publisher(r.topic, messaging.NewOptionsResolver(), false)
+	if err == nil {
+		_, err = publisher.Publish(ctx, &gpubsub.Message{
+			Data:       m.Data,
+			Attributes: r.attributes(m, attempt),
+		}).Get(ctx)
+	}
+	if err != nil {
+		logger.ErrorF("Pub/Sub failed to dead-letter message %s to topic %s: %v", m.ID, r.topic.Host, err)
+		m.Nack()
+		return fmt.Errorf("pubsub: failed to dead-letter message %s to topic %s: %w", m.ID, r.topic.Host, err)
+	}
+	logger.WarnF("Pub/Sub dead-lettered message %s of subscription %s to topic %s after %d delivery attempts",
+		m.ID, r.subscription, r.topic.Host, attempt-1)
+	m.Ack()
+	r.forget(m.ID)
+	return nil
+}
+
+// attributes returns the attributes of m with the dead-letter attributes added.
+func (r *deadLetterRouter) attributes(m *gpubsub.Message, attempt int) map[string]string {
+	attrs := make(map[string]string, len(m.Attributes)+4)
+	for k, v := range m.Attributes {
+		attrs[k] = v
+	}
+	attrs[AttrDeadLetterDeliveryCount] = strconv.Itoa(attempt - 1)
+	attrs[AttrDeadLetterSubscription] = r.subscription
+	attrs[AttrDeadLetterSubscriptionProject] = r.project
+	attrs[AttrDeadLetterPublishTime] = m.PublishTime.UTC().Format(time.RFC3339Nano)
+	return attrs
+}
+
+// ReplayOptions configures ReplayDeadLetters.
+type ReplayOptions struct {
+	// MaxMessages limits the number of messages replayed. Zero replays all of them.
+	MaxMessages int
+	// IdleTimeout ends the replay once no message has been received for this long.
+	// Default: 10s.
+	IdleTimeout time.Duration
+}
+
+// ReplayReport summarises a replay.
+type ReplayReport struct {
+	// Replayed is the number of messages published back to the topic and acked.
+	Replayed int
+	// Failed maps the ID of every message that could not be replayed to its error. Failed
+	// messages are nacked and stay on the dead-letter subscription.
+	Failed map[string]error
+}
+
+// ReplayDeadLetters moves messages from a dead-letter subscription back onto a topic,
+// typically the original topic once the cause of the failures is fixed. Each message is
+// republished with its data, attributes and ordering key, without the dead-letter attributes,
+// and acked once the publish succeeds. The replay ends when the subscription has been idle
+// for IdleTimeout, MaxMessages have been replayed or ctx is done.
+// URL format: dlqSub pubsub://subscription-name, topic pubsub://topic-name
+func (p *Provider) ReplayDeadLetters(ctx context.Context, dlqSub, topic *url.URL, options *ReplayOptions) (*ReplayReport, error) {
+	if options == nil {
+		options = &ReplayOptions{}
+	}
+	idle := options.IdleTimeout
+	if idle <= 0 {
+		idle = defaultReplayIdleTimeout
+	}
+	if topic == nil || topic.Host == "" {
+		return nil, fmt.Errorf("pubsub: topic name (URL host) is required")
+	}
+	entry, err := p.client(dlqSub)
+	if err != nil {
+		return nil, err
+	}
+	sub, err := resolveSubscriber(entry.client, dlqSub)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	timer := time.AfterFunc(idle, cancel)
+	defer timer.Stop()
+
+	var (
+		mu      sync.Mutex
+		claimed int
+	)
+	report := &ReplayReport{Failed: make(map[string]error)}
+	err = sub.Receive(ctx, func(msgCtx context.Context, m *gpubsub.Message) {
+		timer.Reset(idle)
+		mu.Lock()
+		if options.MaxMessages > 0 && claimed >= options.MaxMessages {
+			mu.Unlock()
+			m.Nack()
+			cancel()
+			return
+		}
+		claimed++
+		mu.Unlock()
+
+		err := p.replay(msgCtx, topic, m)
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			report.Failed[m.ID] = err
+			m.Nack()
+			return
+		}
+		report.Replayed++
+		m.Ack()
+	})
+	if err != nil && !errors.Is(err, context.Canceled) {
+		return report, fmt.Errorf("pubsub: replay from %s failed: %w", dlqSub.Host, err)
+	}
+	logger.InfoF("Pub/Sub replayed %d messages from %s to topic %s, %d failed",
+		report.Replayed, dlqSub.Host, topic.Host, len(report.Failed))
+	return report, nil
+}
+
+// replay publishes a dead-lettered message to topic and waits for the result. The ordering
+// key of a failed message is resumed so that the other messages can still be replayed.
+func (p *Provider) replay(ctx context.Context, topic *url.URL, m *gpubsub.Message) error {
+	publisher, err := p.publisher(topic, messaging.NewOptionsResolver(), m.OrderingKey != "")
+	if err != nil {
+		return err
+	}
+	_, err = publisher.Publish(ctx, &gpubsub.Message{
+		Data:        m.Data,
+		Attributes:  stripDeadLetterAttributes(m.Attributes),
+		OrderingKey: m.OrderingKey,
+	}).Get(ctx)
+	if err != nil {
+		if m.OrderingKey != "" {
+			publisher.ResumePublish(m.OrderingKey)
+		}
+		return fmt.Errorf("pubsub: publish failed: %w", err)
+	}
+	return nil
+}
+
+// stripDeadLetterAttributes returns attrs without the attributes added when dead-lettering.
+func stripDeadLetterAttributes(attrs map[string]string) map[string]string {
+	stripped := make(map[string]string, len(attrs))
+	for k, v := range attrs {
+		if !strings.HasPrefix(k, deadLetterPrefix) {
+			stripped[k] = v
+		}
+	}
+	return stripped
+}
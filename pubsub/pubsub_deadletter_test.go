@@ -0,0 +1,123 @@
+package pubsub
+
+import (
+	"container/list"
+	"context"
+	"net/url"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	gpubsub "cloud.google.com/go/pubsub/v2"
+	"oss.nandlabs.io/golly-gcp/gcpsvc"
+	"oss.nandlabs.io/golly/messaging"
+)
+
+func TestNewDeadLetterRouter(t *testing.T) {
+	u, _ := url.Parse("pubsub://orders-sub")
+	if r := newDeadLetterRouter(&Provider{}, u, messaging.NewOptionsResolver()); r != nil {
+		t.Errorf("expected no router without a dead-letter topic, got %+v", r)
+	}
+
+	gcpsvc.Manager.Register("orders-sub", &gcpsvc.Config{ProjectId: "test-project"})
+	defer gcpsvc.Manager.Unregister("orders-sub")
+	options := messaging.NewOptionsBuilder().Add(OptDeadLetterTopic, "orders-dlq").Build()
+	r := newDeadLetterRouter(&Provider{}, u, messaging.NewOptionsResolver(options...))
+	if r == nil {
+		t.Fatal("expected a router")
+	}
+	if r.topic.Host != "orders-dlq" || r.subscription != "orders-sub" || r.project != "test-project" {
+		t.Errorf("unexpected router %+v", r)
+	}
+	if r.maxAttempts != defaultMaxDeliveryAttempts {
+		t.Errorf("expected default max attempts, got %d", r.maxAttempts)
+	}
+}
+
+func TestDeadLetterRouter_Attempts(t *testing.T) {
+	r := &deadLetterRouter{maxAttempts: 2, attempts: make(map[string]*list.Element), recent: list.New()}
+	m := &gpubsub.Message{ID: "m1"}
+	for want := 1; want <= 3; want++ {
+		if got := r.attempt(m); got != want {
+			t.Errorf("expected attempt %d, got %d", want, got)
+		}
+	}
+	if !r.exceeded(3) || r.exceeded(2) {
+		t.Error("expected only the third attempt to exceed the maximum")
+	}
+	r.forget("m1")
+	if got := r.attempt(m); got != 1 {
+		t.Errorf("expected the count to restart after forget, got %d", got)
+	}
+
+	reported := 7
+	if got := r.attempt(&gpubsub.Message{ID: "m2", DeliveryAttempt: &reported}); got != 7 {
+		t.Errorf("expected the attempt reported by Pub/Sub, got %d", got)
+	}
+}
+
+func TestDeadLetterRouter_AttemptsBounded(t *testing.T) {
+	r := &deadLetterRouter{maxAttempts: 2, attempts: make(map[string]*list.Element), recent: list.New()}
+	r.attempt(&gpubsub.Message{ID: "stale"})
+	r.recent.Front().Value.(*deliveryCount).seen = time.Now().Add(-2 * deliveryCountTTL)
+	r.attempt(&gpubsub.Message{ID: "fresh"})
+	if _, ok := r.attempts["stale"]; ok || len(r.attempts) != 1 || r.recent.Len() != 1 {
+		t.Errorf("expected the stale count to expire, got %d counts", len(r.attempts))
+	}
+
+	for i := 0; i < maxDeliveryCounts+10; i++ {
+		r.attempt(&gpubsub.Message{ID: strconv.Itoa(i)})
+	}
+	if len(r.attempts) != maxDeliveryCounts || r.recent.Len() != maxDeliveryCounts {
+		t.Errorf("expected at most %d counts, got %d", maxDeliveryCounts, len(r.attempts))
+	}
+	if _, ok := r.attempts["0"]; ok {
+		t.Error("expected the least recently delivered count to be dropped")
+	}
+}
+
+func TestDeadLetterRouter_Attributes(t *testing.T) {
+	r := &deadLetterRouter{subscription: "orders-sub", project: "test-project"}
+	published := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	m := &gpubsub.Message{ID: "m1", Attributes: map[string]string{"type": "order"}, PublishTime: published}
+	attrs := r.attributes(m, 6)
+	want := map[string]string{
+		"type":                            "order",
+		AttrDeadLetterDeliveryCount:       "5",
+		AttrDeadLetterSubscription:        "orders-sub",
+		AttrDeadLetterSubscriptionProject: "test-project",
+		AttrDeadLetterPublishTime:         "2026-01-02T03:04:05Z",
+	}
+	if !reflect.DeepEqual(attrs, want) {
+		t.Errorf("got %v, want %v", attrs, want)
+	}
+	if got := stripDeadLetterAttributes(attrs); !reflect.DeepEqual(got, map[string]string{"type": "order"}) {
+		t.Errorf("expected dead-letter attributes to be stripped, got %v", got)
+	}
+}
+
+func TestMessagePubSub_DeliveryAttempt(t *testing.T) {
+	p := &Provider{}
+	msg, _ := p.NewMessage(PubSubScheme)
+	if got := msg.(*MessagePubSub).DeliveryAttempt(); got != 0 {
+		t.Errorf("expected 0 for an outbound message, got %d", got)
+	}
+
+	reported := 3
+	received := p.toMessage(&gpubsub.Message{ID: "m1", DeliveryAttempt: &reported})
+	if got := received.DeliveryAttempt(); got != 3 {
+		t.Errorf("expected 3, got %d", got)
+	}
+	received.deliveryAttempt = 4
+	if got := received.DeliveryAttempt(); got != 4 {
+		t.Errorf("expected the counted attempt, got %d", got)
+	}
+}
+
+func TestReplayDeadLetters_NoTopic(t *testing.T) {
+	u, _ := url.Parse("pubsub://orders-dlq-sub")
+	if _, err := (&Provider{}).ReplayDeadLetters(context.Background(), u, &url.URL{Scheme: PubSubScheme}, nil); err == nil {
+		t.Error("expected an error without a topic")
+	}
+}
@@ -0,0 +1,134 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/googleapis/gax-go/v2"
+	"oss.nandlabs.io/golly-gcp/gcpsvc"
+	"oss.nandlabs.io/golly/messaging"
+)
+
+// Listener options for error-returning handlers.
+const (
+	// OptHandler is a Handler used by AddListener and Listen instead of the listener
+	// callback, so that messages are acked or nacked by the outcome of the handler.
+	OptHandler = "Handler"
+	// OptHandlerRetry is a *gcpsvc.RetryPolicy for handlers that fail: the handler is called
+	// again after a backoff, up to MaxAttempts calls in total and within MaxDuration, before the
+	// message is nacked. A MaxAttempts of 0 retries until MaxDuration passes or the listener
+	// stops. ShouldRetry selects the errors to retry; when nil, all are retried. Idempotency
+	// is ignored.
+	OptHandlerRetry = "HandlerRetry"
+)
+
+// Handler processes a received message. Returning nil acks the message and returning an
+// error nacks it, unless the handler already called Rsvp.
+type Handler func(msg messaging.Message) error
+
+// ErrHandlerPanic is wrapped by the error of a listener callback or handler that panicked.
+var ErrHandlerPanic = errors.New("pubsub: listener panicked")
+
+// Handle starts a listener like Listen that calls handler for every message and acks or
+// nacks the message by its result. A handler that panics fails with ErrHandlerPanic.
+// URL format: pubsub://subscription-name
+// Supported options: see AddListener.
+func (p *Provider) Handle(u *url.URL, handler Handler, options ...messaging.Option) (*Listener, error) {
+	options = append(options, messaging.NewOptionsBuilder().Add(OptHandler, handler).Build()...)
+	return p.Listen(u, nil, options...)
+}
+
+// messageProcessor calls the listener callback or the handler of a listener for each message.
+type messageProcessor struct {
+	listener func(msg messaging.Message)
+	handler  Handler
+	retry    *gcpsvc.RetryPolicy
+}
+
+// newMessageProcessor returns the processor for a listener callback and listener options.
+// The Handler option takes precedence over the callback.
+func newMessageProcessor(listener func(msg messaging.Message), optResolver *messaging.OptionsResolver) *messageProcessor {
+	mp := &messageProcessor{listener: listener}
+	if v, ok := optResolver.Get(OptHandler); ok {
+		switch h := v.(type) {
+		case Handler:
+			mp.handler = h
+		case func(msg messaging.Message) error:
+			mp.handler = h
+		}
+	}
+	if v, ok := optResolver.Get(OptHandlerRetry); ok {
+		mp.retry = v.(*gcpsvc.RetryPolicy)
+	}
+	return mp
+}
+
+// process handles a message. A listener callback that panics has its message nacked and
+// the panic returned as an error. A handler is retried according to the retry policy until
+// it succeeds or ctx is done, then its message is acked on success or nacked on failure,
+// unless the handler settled it. The returned error is that of the last call.
+func (mp *messageProcessor) process(ctx context.Context, msg *MessagePubSub) error {
+	if mp.handler == nil {
+		err := callListener(func(m messaging.Message) error {
+			mp.listener(m)
+			return nil
+		}, msg)
+		if err != nil {
+			_ = msg.Rsvp(false)
+		}
+		return err
+	}
+
+	err := callListener(mp.handler, msg)
+	if err != nil && mp.retry != nil {
+		err = mp.retryHandler(ctx, msg, err)
+	}
+	if err != nil {
+		if nackErr := msg.Rsvp(false); nackErr != nil {
+			return errors.Join(err, nackErr)
+		}
+		return err
+	}
+	return msg.Rsvp(true)
+}
+
+// retryHandler calls the handler again after a backoff while it fails, as allowed by the
+// retry policy, and returns the error of the last call. MaxAttempts 0 leaves the number of
+// calls unbounded.
+func (mp *messageProcessor) retryHandler(ctx context.Context, msg *MessagePubSub, err error) error {
+	policy := mp.retry
+	backoff := gax.Backoff{Initial: policy.InitialBackoff, Max: policy.MaxBackoff, Multiplier: policy.Multiplier}
+	start := time.Now()
+	for attempt := 1; policy.MaxAttempts <= 0 || attempt < policy.MaxAttempts; attempt++ {
+		if msg.isSettled() || (policy.ShouldRetry != nil && !policy.ShouldRetry(err)) {
+			return err
+		}
+		pause := backoff.Pause()
+		if policy.MaxDuration > 0 && time.Since(start)+pause > policy.MaxDuration {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(pause):
+		}
+		logger.WarnF("Pub/Sub retrying handler for message %s after error: %v", msg.messageId, err)
+		if err = callListener(mp.handler, msg); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// callListener calls fn with msg and converts a panic to an error wrapping ErrHandlerPanic.
+func callListener(fn func(messaging.Message) error, msg *MessagePubSub) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w on message %s: %v", ErrHandlerPanic, msg.messageId, r)
+		}
+	}()
+	return fn(msg)
+}
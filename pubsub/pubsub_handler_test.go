@@ -0,0 +1,197 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	gpubsub "cloud.google.com/go/pubsub/v2"
+	"oss.nandlabs.io/golly-gcp/gcpsvc"
+	"oss.nandlabs.io/golly/messaging"
+)
+
+// handlerMessage returns a received message that records whether it was acked.
+func handlerMessage(acked *bool) *MessagePubSub {
+	msg := (&Provider{}).toMessage(&gpubsub.Message{ID: "m1"})
+	msg.onAck = func() { *acked = true }
+	return msg
+}
+
+func TestMessageProcessor_ListenerPanic(t *testing.T) {
+	var acked bool
+	msg := handlerMessage(&acked)
+	mp := &messageProcessor{listener: func(msg messaging.Message) { panic("boom") }}
+
+	err := mp.process(context.Background(), msg)
+	if !errors.Is(err, ErrHandlerPanic) {
+		t.Fatalf("expected ErrHandlerPanic, got %v", err)
+	}
+	if acked || !msg.isSettled() {
+		t.Error("expected the message to be nacked")
+	}
+}
+
+func TestMessageProcessor_ListenerNoAutoAck(t *testing.T) {
+	var acked bool
+	msg := handlerMessage(&acked)
+	mp := &messageProcessor{listener: func(msg messaging.Message) {}}
+
+	if err := mp.process(context.Background(), msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if msg.isSettled() {
+		t.Error("expected a listener callback message not to be settled")
+	}
+}
+
+func TestMessageProcessor_Handler(t *testing.T) {
+	cause := errors.New("invalid order")
+	tests := []struct {
+		name    string
+		handler Handler
+		wantErr error
+		acked   bool
+	}{
+		{"success", func(msg messaging.Message) error { return nil }, nil, true},
+		{"error", func(msg messaging.Message) error { return cause }, cause, false},
+		{"panic", func(msg messaging.Message) error { panic("boom") }, ErrHandlerPanic, false},
+		{"settled", func(msg messaging.Message) error {
+			_ = msg.Rsvp(true)
+			return cause
+		}, cause, true},
+	}
+	for _, tt := range tests {
+		var acked bool
+		msg := handlerMessage(&acked)
+		err := (&messageProcessor{handler: tt.handler}).process(context.Background(), msg)
+		if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.wantErr, err)
+		}
+		if acked != tt.acked || !msg.isSettled() {
+			t.Errorf("%s: expected acked %v, got %v", tt.name, tt.acked, acked)
+		}
+	}
+}
+
+func TestMessageProcessor_Retry(t *testing.T) {
+	var acked bool
+	msg := handlerMessage(&acked)
+	calls := 0
+	mp := &messageProcessor{
+		handler: func(msg messaging.Message) error {
+			calls++
+			if calls < 3 {
+				return errors.New("unavailable")
+			}
+			return nil
+		},
+		retry: &gcpsvc.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, Multiplier: 2},
+	}
+	if err := mp.process(context.Background(), msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls != 3 || !acked {
+		t.Errorf("expected an ack after 3 calls, got %d calls, acked %v", calls, acked)
+	}
+}
+
+func TestMessageProcessor_RetryExhausted(t *testing.T) {
+	permanent := errors.New("permanent")
+	tests := []struct {
+		name   string
+		policy *gcpsvc.RetryPolicy
+		calls  int
+	}{
+		{"attempts", &gcpsvc.RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}, 2},
+		{"should retry", &gcpsvc.RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Millisecond,
+			ShouldRetry: func(err error) bool { return !errors.Is(err, permanent) }}, 1},
+		{"duration", &gcpsvc.RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Second, MaxDuration: time.Millisecond}, 1},
+	}
+	for _, tt := range tests {
+		var acked bool
+		msg := handlerMessage(&acked)
+		calls := 0
+		mp := &messageProcessor{
+			handler: func(msg messaging.Message) error {
+				calls++
+				return permanent
+			},
+			retry: tt.policy,
+		}
+		if err := mp.process(context.Background(), msg); !errors.Is(err, permanent) {
+			t.Errorf("%s: expected the handler error, got %v", tt.name, err)
+		}
+		if calls != tt.calls || acked {
+			t.Errorf("%s: expected a nack after %d calls, got %d calls, acked %v", tt.name, tt.calls, calls, acked)
+		}
+	}
+}
+
+func TestMessageProcessor_RetryUnlimitedAttempts(t *testing.T) {
+	var acked bool
+	msg := handlerMessage(&acked)
+	calls := 0
+	mp := &messageProcessor{
+		handler: func(msg messaging.Message) error {
+			calls++
+			if calls < 5 {
+				return errors.New("unavailable")
+			}
+			return nil
+		},
+		retry: &gcpsvc.RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+	}
+	if err := mp.process(context.Background(), msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls != 5 || !acked {
+		t.Errorf("expected an ack after 5 calls, got %d calls, acked %v", calls, acked)
+	}
+}
+
+func TestMessageProcessor_RetryUnlimitedAttemptsBounded(t *testing.T) {
+	unavailable := errors.New("unavailable")
+	policy := &gcpsvc.RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxDuration: 50 * time.Millisecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		policy *gcpsvc.RetryPolicy
+	}{
+		{"duration", context.Background(), policy},
+		{"stopped", ctx, &gcpsvc.RetryPolicy{InitialBackoff: time.Millisecond}},
+	}
+	for _, tt := range tests {
+		var acked bool
+		msg := handlerMessage(&acked)
+		calls := 0
+		mp := &messageProcessor{
+			handler: func(msg messaging.Message) error {
+				calls++
+				return unavailable
+			},
+			retry: tt.policy,
+		}
+		if err := mp.process(tt.ctx, msg); !errors.Is(err, unavailable) {
+			t.Errorf("%s: expected the handler error, got %v", tt.name, err)
+		}
+		if calls == 0 || acked {
+			t.Errorf("%s: expected a nack, got %d calls, acked %v", tt.name, calls, acked)
+		}
+	}
+}
+
+func TestNewMessageProcessor(t *testing.T) {
+	handler := func(msg messaging.Message) error { return nil }
+	policy := &gcpsvc.RetryPolicy{MaxAttempts: 3}
+	options := messaging.NewOptionsBuilder().
+		Add(OptHandler, handler).
+		Add(OptHandlerRetry, policy).
+		Build()
+	mp := newMessageProcessor(nil, messaging.NewOptionsResolver(options...))
+	if mp.handler == nil || mp.retry != policy {
+		t.Errorf("expected the handler and retry policy from the options, got %+v", mp)
+	}
+}
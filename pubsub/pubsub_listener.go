@@ -0,0 +1,304 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	gpubsub "cloud.google.com/go/pubsub/v2"
+	"oss.nandlabs.io/golly/messaging"
+)
+
+// ListenerState is the lifecycle state of a Listener.
+type ListenerState int32
+
+const (
+	// ListenerRunning means the listener is receiving messages.
+	ListenerRunning ListenerState = iota
+	// ListenerStopping means the listener stopped pulling and is draining in-flight messages.
+	ListenerStopping
+	// ListenerStopped means the listener ended after Stop, Close or its Timeout.
+	ListenerStopped
+	// ListenerErrored means the listener ended because of a non-retryable receive error.
+	ListenerErrored
+)
+
+// String returns the name of the state.
+func (s ListenerState) String() string {
+	switch s {
+	case ListenerRunning:
+		return "running"
+	case ListenerStopping:
+		return "stopping"
+	case ListenerStopped:
+		return "stopped"
+	case ListenerErrored:
+		return "errored"
+	}
+	return fmt.Sprintf("ListenerState(%d)", int32(s))
+}
+
+// listenerErrorBuffer is the capacity of the channel returned by Listener.Errors.
+const listenerErrorBuffer = 16
+
+// Listener is a handle to a subscription listener started with Listen.
+type Listener struct {
+	subscription string
+	cancel       context.CancelFunc
+	done         chan struct{}
+	state        atomic.Int32
+	errs         chan error
+	err          error
+
+	mu       sync.Mutex
+	inflight map[*MessagePubSub]struct{}
+	// deadlines holds the messages with an ack deadline set by ModifyAckDeadline.
+	deadlines map[*MessagePubSub]struct{}
+	// released is set once the pending deadlines have been cancelled.
+	released bool
+}
+
+// newListener returns a running listener handle for a subscription.
+func newListener(subscription string, cancel context.CancelFunc) *Listener {
+	return &Listener{
+		subscription: subscription,
+		cancel:       cancel,
+		done:         make(chan struct{}),
+		errs:         make(chan error, listenerErrorBuffer),
+		inflight:     make(map[*MessagePubSub]struct{}),
+		deadlines:    make(map[*MessagePubSub]struct{}),
+	}
+}
+
+// Subscription returns the name of the subscription the listener receives from.
+func (l *Listener) Subscription() string {
+	return l.subscription
+}
+
+// State returns the current state of the listener.
+func (l *Listener) State() ListenerState {
+	return ListenerState(l.state.Load())
+}
+
+// Errors returns a channel receiving the errors of the listener: panics of the callback or
+// handler, failed acks, failures to dead-letter a message and the receive error that ends an
+// errored listener. Errors returned by a Handler are only logged. Errors are dropped when the
+// channel is full. It is closed when the listener has ended.
+func (l *Listener) Errors() <-chan error {
+	return l.errs
+}
+
+// Done returns a channel that is closed when the listener has ended and all its handlers
+// have returned.
+func (l *Listener) Done() <-chan struct{} {
+	return l.done
+}
+
+// Err returns the error that ended an errored listener, or nil.
+func (l *Listener) Err() error {
+	select {
+	case <-l.done:
+		return l.err
+	default:
+		return nil
+	}
+}
+
+// Stop stops pulling new messages and waits until the handlers of the messages in flight
+// have returned, giving them the chance to ack. If ctx is done first, the messages still in
+// flight that were not acked or nacked are nacked for redelivery and ctx.Err() is returned;
+// their handlers keep running until they return. Stopping an ended listener returns nil.
+func (l *Listener) Stop(ctx context.Context) error {
+	l.state.CompareAndSwap(int32(ListenerRunning), int32(ListenerStopping))
+	l.cancel()
+	select {
+	case <-l.done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	pending := make([]*MessagePubSub, 0, len(l.inflight))
+	for msg := range l.inflight {
+		pending = append(pending, msg)
+	}
+	l.mu.Unlock()
+	nacked := 0
+	for _, msg := range pending {
+		if msg.settle() {
+			msg.pubsubMessage.Nack()
+			nacked++
+		}
+	}
+	return fmt.Errorf("pubsub: listener for %s did not drain in time, nacked %d in-flight messages: %w",
+		l.subscription, nacked, ctx.Err())
+}
+
+// track records a message whose handler is running.
+func (l *Listener) track(msg *MessagePubSub) {
+	l.mu.Lock()
+	l.inflight[msg] = struct{}{}
+	l.mu.Unlock()
+}
+
+// untrack records that the handler of a message returned.
+func (l *Listener) untrack(msg *MessagePubSub) {
+	l.mu.Lock()
+	delete(l.inflight, msg)
+	l.mu.Unlock()
+}
+
+// watchDeadline records a message with a pending ack deadline. It returns false once the
+// listener has released its deadlines.
+func (l *Listener) watchDeadline(msg *MessagePubSub) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.released {
+		return false
+	}
+	l.deadlines[msg] = struct{}{}
+	return true
+}
+
+// unwatchDeadline records that the deadline of a message no longer applies.
+func (l *Listener) unwatchDeadline(msg *MessagePubSub) {
+	l.mu.Lock()
+	delete(l.deadlines, msg)
+	l.mu.Unlock()
+}
+
+// releaseDeadlines cancels the pending ack deadlines and nacks their messages, so that they
+// are redelivered at once instead of when the timers of a stopped listener fire.
+func (l *Listener) releaseDeadlines() {
+	l.mu.Lock()
+	l.released = true
+	pending := make([]*MessagePubSub, 0, len(l.deadlines))
+	for msg := range l.deadlines {
+		pending = append(pending, msg)
+	}
+	l.deadlines = make(map[*MessagePubSub]struct{})
+	l.mu.Unlock()
+	for _, msg := range pending {
+		if msg.settle() {
+			msg.pubsubMessage.Nack()
+		}
+	}
+}
+
+// report sends err to the error channel without blocking.
+func (l *Listener) report(err error) {
+	select {
+	case l.errs <- err:
+	default:
+	}
+}
+
+// finish records how the listener ended and releases waiters.
+func (l *Listener) finish(err error) {
+	if err != nil {
+		l.err = err
+		l.state.Store(int32(ListenerErrored))
+		l.report(err)
+	} else {
+		l.state.Store(int32(ListenerStopped))
+	}
+	close(l.errs)
+	close(l.done)
+}
+
+// Listen starts a listener that continuously receives messages from a Pub/Sub subscription
+// and returns a handle to stop it and observe its state. Listeners are also stopped by Close.
+// URL format: pubsub://subscription-name
+// Supported options: see AddListener.
+// Messages are NOT auto-acknowledged. The listener callback must call msg.Rsvp(true) to ack.
+// If the callback panics, the panic is recovered and the message is nacked.
+func (p *Provider) Listen(u *url.URL, listener func(msg messaging.Message), options ...messaging.Option) (*Listener, error) {
+	entry, err := p.client(u)
+	if err != nil {
+		return nil, err
+	}
+
+	sub, err := resolveSubscriber(entry.client, u)
+	if err != nil {
+		return nil, err
+	}
+
+	optResolver := messaging.NewOptionsResolver(options...)
+
+	// Configure subscriber receive settings
+	if v, ok := optResolver.Get(OptMaxOutstandingMessages); ok {
+		sub.ReceiveSettings.MaxOutstandingMessages = v.(int)
+	}
+	if v, ok := optResolver.Get(OptMaxExtension); ok {
+		sub.ReceiveSettings.MaxExtension = time.Duration(v.(int)) * time.Second
+	}
+
+	dlq := newDeadLetterRouter(p, u, optResolver)
+	processor := newMessageProcessor(listener, optResolver)
+	if processor.listener == nil && processor.handler == nil {
+		return nil, fmt.Errorf("pubsub: a listener callback or Handler option is required")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if v, ok := optResolver.Get(OptTimeout); ok {
+		timeout := time.Duration(v.(int)) * time.Second
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	}
+
+	l := newListener(u.Host, cancel)
+	p.mu.Lock()
+	p.stopFns = append(p.stopFns, cancel)
+	p.mu.Unlock()
+
+	// Pending ack deadlines are released as soon as the listener is stopped, by Stop, Close
+	// or the Timeout option, while Receive can still deliver the nacks.
+	context.AfterFunc(ctx, l.releaseDeadlines)
+
+	go func() {
+		defer cancel()
+		logger.InfoF("Pub/Sub listener started for subscription %s", u.Host)
+
+		err := sub.Receive(ctx, func(msgCtx context.Context, m *gpubsub.Message) {
+			if ctx.Err() != nil {
+				m.Nack()
+				return
+			}
+			msg := p.toMessage(m)
+			msg.listener = l
+			if dlq != nil {
+				attempt := dlq.attempt(m)
+				if dlq.exceeded(attempt) {
+					if err := dlq.deadLetter(msgCtx, m, attempt); err != nil {
+						l.report(err)
+					}
+					return
+				}
+				msg.deliveryAttempt = attempt
+				msg.onAck = func() { dlq.forget(m.ID) }
+			}
+			l.track(msg)
+			defer l.untrack(msg)
+			if err := processor.process(msgCtx, msg); err != nil {
+				logger.ErrorF("Pub/Sub listener for %s failed to process message %s: %v", u.Host, m.ID, err)
+				if !errors.Is(err, ErrHandlerPanic) && !errors.As(err, new(*AckError)) {
+					return
+				}
+				l.report(err)
+			}
+		})
+		if err != nil && ctx.Err() == nil {
+			logger.ErrorF("Pub/Sub listener error: %v", err)
+			l.finish(fmt.Errorf("pubsub: listener for %s failed: %w", u.Host, err))
+		} else {
+			l.finish(nil)
+		}
+
+		logger.InfoF("Pub/Sub listener stopped for subscription %s", u.Host)
+	}()
+
+	return l, nil
+}
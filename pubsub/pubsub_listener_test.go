@@ -0,0 +1,94 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	gpubsub "cloud.google.com/go/pubsub/v2"
+)
+
+func TestListenerState_String(t *testing.T) {
+	for state, want := range map[ListenerState]string{
+		ListenerRunning:   "running",
+		ListenerStopping:  "stopping",
+		ListenerStopped:   "stopped",
+		ListenerErrored:   "errored",
+		ListenerState(42): "ListenerState(42)",
+	} {
+		if got := state.String(); got != want {
+			t.Errorf("expected %q, got %q", want, got)
+		}
+	}
+}
+
+func TestListener_StopDrained(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	l := newListener("orders-sub", cancel)
+	go func() {
+		<-ctx.Done()
+		l.finish(nil)
+	}()
+
+	if err := l.Stop(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if l.State() != ListenerStopped || l.Err() != nil {
+		t.Errorf("expected a stopped listener, got %v, %v", l.State(), l.Err())
+	}
+	if _, open := <-l.Errors(); open {
+		t.Error("expected the error channel to be closed")
+	}
+	if err := l.Stop(context.Background()); err != nil {
+		t.Errorf("expected stopping an ended listener to succeed, got %v", err)
+	}
+}
+
+func TestListener_StopDeadline(t *testing.T) {
+	l := newListener("orders-sub", func() {})
+	inflight := (&Provider{}).toMessage(&gpubsub.Message{ID: "m1"})
+	settled := (&Provider{}).toMessage(&gpubsub.Message{ID: "m2"})
+	settled.settle()
+	l.track(inflight)
+	l.track(settled)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := l.Stop(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if l.State() != ListenerStopping {
+		t.Errorf("expected the listener to be stopping, got %v", l.State())
+	}
+	if inflight.settle() {
+		t.Error("expected the in-flight message to be nacked")
+	}
+}
+
+func TestListener_FinishError(t *testing.T) {
+	l := newListener("orders-sub", func() {})
+	cause := errors.New("subscription not found")
+	l.finish(cause)
+
+	if l.State() != ListenerErrored || !errors.Is(l.Err(), cause) {
+		t.Errorf("expected an errored listener, got %v, %v", l.State(), l.Err())
+	}
+	if err := <-l.Errors(); !errors.Is(err, cause) {
+		t.Errorf("expected the error on the channel, got %v", err)
+	}
+	select {
+	case <-l.Done():
+	default:
+		t.Error("expected the listener to be done")
+	}
+}
+
+func TestListen_NoConfig(t *testing.T) {
+	u, _ := url.Parse("pubsub://unregistered-listen-sub")
+	if l, err := (&Provider{}).Listen(u, nil); err == nil || l != nil {
+		t.Errorf("expected an error without a registered config, got %v, %v", l, err)
+	}
+}
@@ -2,6 +2,8 @@ package pubsub
 
 import (
 	"fmt"
+	"sync"
+	"time"
 
 	gpubsub "cloud.google.com/go/pubsub/v2"
 	"oss.nandlabs.io/golly/messaging"
@@ -13,12 +15,60 @@ type MessagePubSub struct {
 	// pubsubMessage is the underlying Pub/Sub message, used for Ack/Nack.
 	// Nil for outbound (sent) messages.
 	pubsubMessage *gpubsub.Message
+	// pulled acknowledges messages received with a unary Pull. Nil for messages of a
+	// streaming pull, which are acknowledged through pubsubMessage.
+	pulled *pulledAck
 	// messageId is the server-assigned message ID after publishing.
 	messageId string
 	// provider is a back-reference to the provider.
 	provider *Provider
 	// stringHeaders tracks all headers as string key-value pairs for Pub/Sub attributes.
 	stringHeaders map[string]string
+	// deliveryAttempt is the delivery attempt counted by the listener when Pub/Sub does not
+	// report it. Zero if not counted.
+	deliveryAttempt int
+	// orderingKey is the ordering key to publish the message with, or the ordering key of a
+	// received message.
+	orderingKey string
+	// onAck is called after the message is acknowledged. Nil if not needed.
+	onAck func()
+	// listener is the listener that received the message, which cancels its deadline when
+	// it stops. Nil for messages not received by a listener.
+	listener *Listener
+	// deadlineMu guards deadline and settled.
+	deadlineMu sync.Mutex
+	// deadline nacks the message when the ack deadline set by ModifyAckDeadline expires.
+	deadline *time.Timer
+	// settled is set once the message has been acked or nacked.
+	settled bool
+}
+
+// DeliveryAttempt returns how many times the message has been delivered, starting at 1.
+// Pub/Sub reports it for subscriptions with a dead-letter policy; listeners with the
+// DeadLetterTopic option count it themselves. It returns 0 when the count is unknown,
+// including for outbound messages.
+func (m *MessagePubSub) DeliveryAttempt() int {
+	if m.deliveryAttempt > 0 {
+		return m.deliveryAttempt
+	}
+	if m.pubsubMessage != nil && m.pubsubMessage.DeliveryAttempt != nil {
+		return *m.pubsubMessage.DeliveryAttempt
+	}
+	return 0
+}
+
+// SetOrderingKey sets the ordering key the message is published with. It takes precedence
+// over the OrderingKey option, so messages for different keys can be sent in one batch.
+// Messages with the same key are delivered in publish order on subscriptions with message
+// ordering enabled. An empty key publishes the message without ordering.
+func (m *MessagePubSub) SetOrderingKey(key string) {
+	m.orderingKey = key
+}
+
+// OrderingKey returns the ordering key of the message: the key set with SetOrderingKey, or
+// the key a received message was published with. Empty if the message has none.
+func (m *MessagePubSub) OrderingKey() string {
+	return m.orderingKey
 }
 
 // trackHeader stores the string representation of a header value.
@@ -82,15 +132,35 @@ func (m *MessagePubSub) SetFloat64Header(key string, value float64) {
 // Rsvp acknowledges or rejects a received Pub/Sub message.
 // If accept is true, the message is acknowledged (removed from subscription).
 // If accept is false, the message is nacked (made available for redelivery).
+// On subscriptions with exactly-once delivery, Rsvp waits up to the AckTimeout option
+// (seconds, default 30) for Pub/Sub to confirm and returns an *AckError matching
+// ErrInvalidAckID, ErrAckPermissionDenied, ErrAckFailedPrecondition, ErrAckTimeout or
+// ErrAckFailed if it does not. On other subscriptions it returns nil without waiting.
+// With the NackDelay option (seconds), a nack is deferred: the message is redelivered once the
+// delay has passed, as with ModifyAckDeadline and with the same limitations for messages of
+// AddListener.
 // For outbound messages (no underlying Pub/Sub message), this is a no-op.
 func (m *MessagePubSub) Rsvp(accept bool, options ...messaging.Option) error {
 	if m.pubsubMessage == nil {
 		return nil
 	}
-	if accept {
-		m.pubsubMessage.Ack()
-	} else {
-		m.pubsubMessage.Nack()
+	optResolver := messaging.NewOptionsResolver(options...)
+	timeout := defaultAckTimeout
+	if v, ok := optResolver.Get(OptAckTimeout); ok {
+		timeout = time.Duration(v.(int)) * time.Second
+	}
+	if v, ok := optResolver.Get(OptNackDelay); ok && !accept && v.(int) > 0 {
+		return m.ModifyAckDeadline(time.Duration(v.(int)) * time.Second)
+	}
+	if !m.settle() {
+		return nil
+	}
+
+	if err := m.ack(accept, timeout); err != nil {
+		return err
+	}
+	if accept && m.onAck != nil {
+		m.onAck()
 	}
 	return nil
 }
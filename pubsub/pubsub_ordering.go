@@ -0,0 +1,99 @@
+package pubsub
+
+import (
+	"fmt"
+	"net/url"
+
+	gpubsub "cloud.google.com/go/pubsub/v2"
+	"oss.nandlabs.io/golly/messaging"
+)
+
+// OptResumeAfterError resumes publishing for an ordering key after a message with that key
+// failed to publish. Pub/Sub pauses a key on failure so that later messages are not
+// published out of order; with false, the key stays paused until ResumePublish is called.
+// Default: true.
+const OptResumeAfterError = "ResumeAfterError"
+
+// HeaderOrderingKey is a reserved message header carrying the ordering key to publish the
+// message with, so that messages not created by this provider can have a key. The header is
+// not published as an attribute. Its name is namespaced so that it does not hide ordinary
+// headers. A key set with SetOrderingKey takes precedence over it, and it takes precedence
+// over the OrderingKey option.
+const HeaderOrderingKey = "golly.pubsub.orderingKey"
+
+// orderingKey returns the ordering key of an outbound message: its own key, or else the
+// OrderingKey option.
+func orderingKey(msg messaging.Message, optResolver *messaging.OptionsResolver) string {
+	if key := messageOrderingKey(msg); key != "" {
+		return key
+	}
+	if v, ok := optResolver.Get(OptOrderingKey); ok {
+		return v.(string)
+	}
+	return ""
+}
+
+// messageOrderingKey returns the key set on a *MessagePubSub, or else the value of the
+// HeaderOrderingKey header of msg.
+func messageOrderingKey(msg messaging.Message) string {
+	if psMsg, ok := msg.(*MessagePubSub); ok && psMsg.orderingKey != "" {
+		return psMsg.orderingKey
+	}
+	key, _ := msg.GetStrHeader(HeaderOrderingKey)
+	return key
+}
+
+// ordered reports whether msgs need a publisher with message ordering enabled: the
+// OrderingKey option is set or one of the messages has an ordering key.
+func ordered(msgs []messaging.Message, optResolver *messaging.OptionsResolver) bool {
+	if _, ok := optResolver.Get(OptOrderingKey); ok {
+		return true
+	}
+	for _, msg := range msgs {
+		if messageOrderingKey(msg) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// resumeAfterError reports whether the OptResumeAfterError option is enabled.
+func resumeAfterError(optResolver *messaging.OptionsResolver) bool {
+	if v, ok := optResolver.Get(OptResumeAfterError); ok {
+		return v.(bool)
+	}
+	return true
+}
+
+// resumer returns a function that resumes publishing for key on publisher, or nil if there
+// is nothing to resume.
+func resumer(publisher *gpubsub.Publisher, key string, enabled bool) func() {
+	if key == "" || !enabled {
+		return nil
+	}
+	return func() {
+		logger.WarnF("Pub/Sub resuming publishing for ordering key %s after a failed publish", key)
+		publisher.ResumePublish(key)
+	}
+}
+
+// ResumePublish resumes publishing for an ordering key of a topic after a failed publish
+// paused it. It is only needed when the ResumeAfterError option is false.
+// URL format: pubsub://topic-name
+func (p *Provider) ResumePublish(u *url.URL, orderingKey string) error {
+	entry, err := p.client(u)
+	if err != nil {
+		return err
+	}
+	if u.Host == "" {
+		return fmt.Errorf("pubsub: topic name (URL host) is required")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, publisher := range entry.publishers {
+		if key.topic == u.Host && key.ordering {
+			publisher.ResumePublish(orderingKey)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package pubsub
+
+import (
+	"net/url"
+	"testing"
+
+	gpubsub "cloud.google.com/go/pubsub/v2"
+	"oss.nandlabs.io/golly/messaging"
+)
+
+func TestOrderingKey(t *testing.T) {
+	p := &Provider{}
+	keyed, _ := p.NewMessage(PubSubScheme)
+	keyed.(*MessagePubSub).SetOrderingKey("customer-1")
+	plain, _ := p.NewMessage(PubSubScheme)
+	headed, _ := p.NewMessage(PubSubScheme)
+	headed.SetStrHeader(HeaderOrderingKey, "customer-2")
+	both, _ := p.NewMessage(PubSubScheme)
+	both.SetStrHeader(HeaderOrderingKey, "customer-2")
+	both.(*MessagePubSub).SetOrderingKey("customer-1")
+	generic, _ := messaging.NewBaseMessage()
+	generic.SetStrHeader(HeaderOrderingKey, "customer-3")
+
+	noOption := messaging.NewOptionsResolver()
+	withOption := messaging.NewOptionsResolver(messaging.NewOptionsBuilder().Add(OptOrderingKey, "default").Build()...)
+	tests := []struct {
+		name        string
+		msg         messaging.Message
+		optResolver *messaging.OptionsResolver
+		want        string
+	}{
+		{"message key", keyed, noOption, "customer-1"},
+		{"message key over option", keyed, withOption, "customer-1"},
+		{"header", headed, noOption, "customer-2"},
+		{"header over option", headed, withOption, "customer-2"},
+		{"message key over header", both, noOption, "customer-1"},
+		{"header of a generic message", generic, noOption, "customer-3"},
+		{"option", plain, withOption, "default"},
+		{"none", plain, noOption, ""},
+	}
+	for _, tt := range tests {
+		if got := orderingKey(tt.msg, tt.optResolver); got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestOrdered(t *testing.T) {
+	p := &Provider{}
+	keyed, _ := p.NewMessage(PubSubScheme)
+	keyed.(*MessagePubSub).SetOrderingKey("customer-1")
+	plain, _ := p.NewMessage(PubSubScheme)
+	noOption := messaging.NewOptionsResolver()
+
+	if ordered([]messaging.Message{plain}, noOption) {
+		t.Error("expected messages without keys not to need ordering")
+	}
+	if !ordered([]messaging.Message{plain, keyed}, noOption) {
+		t.Error("expected a message with a key to need ordering")
+	}
+	generic, _ := messaging.NewBaseMessage()
+	generic.SetStrHeader(HeaderOrderingKey, "customer-3")
+	if !ordered([]messaging.Message{plain, generic}, noOption) {
+		t.Error("expected a message with an ordering key header to need ordering")
+	}
+	withOption := messaging.NewOptionsResolver(messaging.NewOptionsBuilder().Add(OptOrderingKey, "").Build()...)
+	if !ordered([]messaging.Message{plain}, withOption) {
+		t.Error("expected the OrderingKey option to need ordering")
+	}
+}
+
+func TestResumeAfterError(t *testing.T) {
+	if !resumeAfterError(messaging.NewOptionsResolver()) {
+		t.Error("expected resuming to be enabled by default")
+	}
+	options := messaging.NewOptionsBuilder().Add(OptResumeAfterError, false).Build()
+	if resumeAfterError(messaging.NewOptionsResolver(options...)) {
+		t.Error("expected resuming to be disabled by the option")
+	}
+	publisher := &gpubsub.Publisher{}
+	if resumer(publisher, "", true) != nil || resumer(publisher, "customer-1", false) != nil {
+		t.Error("expected nothing to resume without a key or when disabled")
+	}
+	if resumer(publisher, "customer-1", true) == nil {
+		t.Error("expected a resume function for a key")
+	}
+}
+
+func TestToMessage_OrderingKey(t *testing.T) {
+	msg := (&Provider{}).toMessage(&gpubsub.Message{ID: "m1", OrderingKey: "customer-1"})
+	if msg.OrderingKey() != "customer-1" {
+		t.Errorf("expected ordering key customer-1, got %q", msg.OrderingKey())
+	}
+}
+
+func TestResumePublish_NoConfig(t *testing.T) {
+	u, _ := url.Parse("pubsub://unregistered-ordered-topic")
+	if err := (&Provider{}).ResumePublish(u, "customer-1"); err == nil {
+		t.Error("expected an error without a registered config")
+	}
+}
+
+func TestBuildAttributes_StripsOrderingKeyHeader(t *testing.T) {
+	msg, _ := (&Provider{}).NewMessage(PubSubScheme)
+	msg.SetStrHeader("type", "order")
+	msg.SetStrHeader(HeaderOrderingKey, "customer-1")
+	attrs := buildAttributes(msg)
+	if _, ok := attrs[HeaderOrderingKey]; ok || attrs["type"] != "order" || len(attrs) != 1 {
+		t.Errorf("expected only the type attribute, got %v", attrs)
+	}
+	if _, ok := msg.GetStrHeader(HeaderOrderingKey); !ok {
+		t.Error("expected the header to remain on the message")
+	}
+}
@@ -0,0 +1,160 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	gpubsub "cloud.google.com/go/pubsub/v2"
+	"cloud.google.com/go/pubsub/v2/apiv1/pubsubpb"
+	"github.com/googleapis/gax-go/v2"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"oss.nandlabs.io/golly-gcp/gcpsvc"
+)
+
+// pulledAck acknowledges a message received with a unary Pull. Unlike messages of a
+// streaming pull, these are acked, nacked and have their deadline modified with RPCs on the
+// subscription, so it works after the Receive call has returned.
+type pulledAck struct {
+	client       *gpubsub.Client
+	subscription string
+	ackID        string
+}
+
+// ack acknowledges the message.
+func (a *pulledAck) ack(ctx context.Context) error {
+	return a.client.SubscriptionAdminClient.Acknowledge(ctx, &pubsubpb.AcknowledgeRequest{
+		Subscription: a.subscription,
+		AckIds:       []string{a.ackID},
+	})
+}
+
+// modify sets the ack deadline of the message to d from now. A zero d nacks the message.
+func (a *pulledAck) modify(ctx context.Context, d time.Duration) error {
+	return a.client.SubscriptionAdminClient.ModifyAckDeadline(ctx, &pubsubpb.ModifyAckDeadlineRequest{
+		Subscription:       a.subscription,
+		AckIds:             []string{a.ackID},
+		AckDeadlineSeconds: int32(d / time.Second),
+	})
+}
+
+// Backoff between Pull requests that returned no messages.
+const (
+	emptyPullInitialBackoff = 100 * time.Millisecond
+	emptyPullMaxBackoff     = 2 * time.Second
+)
+
+// pull receives up to maxMessages messages from the subscription of u with unary Pull
+// requests. It returns as soon as a request yields messages, without waiting for a full
+// batch, and fails if none are available within timeout.
+func (p *Provider) pull(u *url.URL, maxMessages int, timeout time.Duration) ([]*MessagePubSub, error) {
+	entry, err := p.client(u)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("pubsub: subscription name (URL host) is required")
+	}
+	subscription := subscriptionPath(gcpsvc.GetConfig(u, PubSubScheme).ProjectId, u.Host)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	received, err := pullUntilReceived(ctx, func(ctx context.Context) (*pubsubpb.PullResponse, error) {
+		return entry.client.SubscriptionAdminClient.Pull(ctx, &pubsubpb.PullRequest{
+			Subscription: subscription,
+			MaxMessages:  int32(maxMessages),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]*MessagePubSub, 0, len(received))
+	for _, rm := range received {
+		msg := p.toMessage(fromReceivedMessage(rm))
+		msg.pulled = &pulledAck{client: entry.client, subscription: subscription, ackID: rm.GetAckId()}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// pullUntilReceived calls pull until it returns messages, backing off between empty
+// responses, and fails once ctx is done. Messages returned by a request are kept even if
+// ctx expired while it was answered, since they are already leased to this subscriber.
+func pullUntilReceived(ctx context.Context, pull func(ctx context.Context) (*pubsubpb.PullResponse, error)) ([]*pubsubpb.ReceivedMessage, error) {
+	backoff := gax.Backoff{Initial: emptyPullInitialBackoff, Max: emptyPullMaxBackoff, Multiplier: 2}
+	for {
+		resp, err := pull(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, fmt.Errorf("pubsub: no messages available within timeout")
+			}
+			return nil, fmt.Errorf("pubsub: receive failed: %w", err)
+		}
+		if received := resp.GetReceivedMessages(); len(received) > 0 {
+			return received, nil
+		}
+		// The server may answer before any message is available
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("pubsub: no messages available within timeout")
+		case <-time.After(backoff.Pause()):
+		}
+	}
+}
+
+// fromReceivedMessage converts a pulled message to a client library message. The result has
+// no ack handler; it is acknowledged through pulledAck.
+func fromReceivedMessage(rm *pubsubpb.ReceivedMessage) *gpubsub.Message {
+	pm := rm.GetMessage()
+	m := &gpubsub.Message{
+		ID:          pm.GetMessageId(),
+		Data:        pm.GetData(),
+		Attributes:  pm.GetAttributes(),
+		PublishTime: pm.GetPublishTime().AsTime(),
+		OrderingKey: pm.GetOrderingKey(),
+	}
+	if attempt := int(rm.GetDeliveryAttempt()); attempt > 0 {
+		m.DeliveryAttempt = &attempt
+	}
+	return m
+}
+
+// pulledAckError converts the error of an ack or modify-ack-deadline RPC to an *AckError,
+// or returns nil if err is nil.
+func pulledAckError(messageId string, accept bool, err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, context.DeadlineExceeded) || status.Code(err) == codes.DeadlineExceeded {
+		return &AckError{MessageId: messageId, Accept: accept, Status: gpubsub.AcknowledgeStatusOther, Err: err, kind: ErrAckTimeout}
+	}
+	return ackStatusError(messageId, accept, rpcAckStatus(err), err)
+}
+
+// rpcAckStatus returns the acknowledge status of a failed ack RPC. On subscriptions with
+// exactly-once delivery, invalid ack IDs are reported in the metadata of an ErrorInfo detail.
+func rpcAckStatus(err error) gpubsub.AcknowledgeStatus {
+	st, _ := status.FromError(err)
+	switch st.Code() {
+	case codes.PermissionDenied:
+		return gpubsub.AcknowledgeStatusPermissionDenied
+	case codes.FailedPrecondition:
+		return gpubsub.AcknowledgeStatusFailedPrecondition
+	case codes.InvalidArgument:
+		for _, detail := range st.Details() {
+			if info, ok := detail.(*errdetails.ErrorInfo); ok {
+				for _, reason := range info.GetMetadata() {
+					if strings.HasPrefix(reason, "PERMANENT_FAILURE_INVALID_ACK_ID") {
+						return gpubsub.AcknowledgeStatusInvalidAckID
+					}
+				}
+			}
+		}
+	}
+	return gpubsub.AcknowledgeStatusOther
+}
@@ -0,0 +1,146 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	gpubsub "cloud.google.com/go/pubsub/v2"
+	"cloud.google.com/go/pubsub/v2/apiv1/pubsubpb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestFromReceivedMessage(t *testing.T) {
+	published := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	rm := &pubsubpb.ReceivedMessage{
+		AckId: "ack-1",
+		Message: &pubsubpb.PubsubMessage{
+			MessageId:   "m1",
+			Data:        []byte("hello"),
+			Attributes:  map[string]string{"type": "order"},
+			PublishTime: timestamppb.New(published),
+			OrderingKey: "customer-1",
+		},
+		DeliveryAttempt: 3,
+	}
+	m := fromReceivedMessage(rm)
+	if m.ID != "m1" || string(m.Data) != "hello" || m.Attributes["type"] != "order" || m.OrderingKey != "customer-1" {
+		t.Errorf("unexpected message %+v", m)
+	}
+	if !m.PublishTime.Equal(published) {
+		t.Errorf("expected publish time %v, got %v", published, m.PublishTime)
+	}
+	if m.DeliveryAttempt == nil || *m.DeliveryAttempt != 3 {
+		t.Errorf("expected delivery attempt 3, got %v", m.DeliveryAttempt)
+	}
+
+	rm.DeliveryAttempt = 0
+	if m := fromReceivedMessage(rm); m.DeliveryAttempt != nil {
+		t.Errorf("expected no delivery attempt, got %d", *m.DeliveryAttempt)
+	}
+}
+
+func TestRPCAckStatus(t *testing.T) {
+	st, err := status.New(codes.InvalidArgument, "invalid ack ids").WithDetails(&errdetails.ErrorInfo{
+		Reason:   "EXACTLY_ONCE_ACKID_FAILURE",
+		Metadata: map[string]string{"ack-1": "PERMANENT_FAILURE_INVALID_ACK_ID"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		err  error
+		want gpubsub.AcknowledgeStatus
+	}{
+		{st.Err(), gpubsub.AcknowledgeStatusInvalidAckID},
+		{status.Error(codes.InvalidArgument, "bad request"), gpubsub.AcknowledgeStatusOther},
+		{status.Error(codes.PermissionDenied, "denied"), gpubsub.AcknowledgeStatusPermissionDenied},
+		{status.Error(codes.FailedPrecondition, "detached"), gpubsub.AcknowledgeStatusFailedPrecondition},
+		{errors.New("boom"), gpubsub.AcknowledgeStatusOther},
+	}
+	for _, tt := range tests {
+		if got := rpcAckStatus(tt.err); got != tt.want {
+			t.Errorf("%v: expected status %v, got %v", tt.err, tt.want, got)
+		}
+	}
+}
+
+func TestPulledAckError(t *testing.T) {
+	if err := pulledAckError("m1", true, nil); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+	err := pulledAckError("m1", true, fmt.Errorf("rpc: %w", context.DeadlineExceeded))
+	if !errors.Is(err, ErrAckTimeout) {
+		t.Errorf("expected ErrAckTimeout, got %v", err)
+	}
+	err = pulledAckError("m1", false, status.Error(codes.PermissionDenied, "denied"))
+	if !errors.Is(err, ErrAckPermissionDenied) {
+		t.Errorf("expected ErrAckPermissionDenied, got %v", err)
+	}
+}
+
+func TestReceive_NoConfig(t *testing.T) {
+	u, _ := url.Parse("pubsub://unregistered-pull-sub")
+	if _, err := (&Provider{}).Receive(u); err == nil {
+		t.Error("expected an error without a registered config")
+	}
+}
+
+func TestPullUntilReceived(t *testing.T) {
+	msg := &pubsubpb.ReceivedMessage{AckId: "a1", Message: &pubsubpb.PubsubMessage{MessageId: "m1"}}
+
+	// Messages answered as the deadline expires are kept
+	ctx, cancel := context.WithCancel(context.Background())
+	received, err := pullUntilReceived(ctx, func(ctx context.Context) (*pubsubpb.PullResponse, error) {
+		cancel()
+		return &pubsubpb.PullResponse{ReceivedMessages: []*pubsubpb.ReceivedMessage{msg}}, nil
+	})
+	if err != nil || len(received) != 1 {
+		t.Fatalf("expected the pulled message, got %v, %v", received, err)
+	}
+
+	// Empty responses are retried after a backoff
+	calls := 0
+	start := time.Now()
+	received, err = pullUntilReceived(context.Background(), func(ctx context.Context) (*pubsubpb.PullResponse, error) {
+		calls++
+		if calls < 3 {
+			return &pubsubpb.PullResponse{}, nil
+		}
+		return &pubsubpb.PullResponse{ReceivedMessages: []*pubsubpb.ReceivedMessage{msg}}, nil
+	})
+	if err != nil || len(received) != 1 || calls != 3 {
+		t.Fatalf("expected a message after 3 pulls, got %v, %v after %d pulls", received, err, calls)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected short backoffs, took %v", elapsed)
+	}
+
+	// An empty subscription fails once the deadline passes without spinning
+	calls = 0
+	ctx, cancel = context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+	if _, err = pullUntilReceived(ctx, func(ctx context.Context) (*pubsubpb.PullResponse, error) {
+		calls++
+		return &pubsubpb.PullResponse{}, nil
+	}); err == nil {
+		t.Fatal("expected a timeout error")
+	}
+	if calls > 5 {
+		t.Errorf("expected empty pulls to back off, got %d pulls", calls)
+	}
+
+	// Errors other than the deadline are returned as such
+	rpcErr := status.Error(codes.PermissionDenied, "denied")
+	if _, err = pullUntilReceived(context.Background(), func(ctx context.Context) (*pubsubpb.PullResponse, error) {
+		return nil, rpcErr
+	}); !errors.Is(err, rpcErr) {
+		t.Errorf("expected the pull error, got %v", err)
+	}
+}
@@ -58,8 +58,8 @@ func TestProvider_Close(t *testing.T) {
 	if err := p.Close(); err != nil {
 		t.Errorf("expected nil error from Close, got %v", err)
 	}
-	if !p.closed.Load() {
-		t.Error("expected closed to be true after Close()")
+	if p.clients != nil {
+		t.Error("expected clients to be nil after Close()")
 	}
 }
 